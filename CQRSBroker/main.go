@@ -0,0 +1,41 @@
+package main
+
+import (
+	s "SimpleCQRS/SimpleCQRS"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	network := flag.String("network", "tcp", "tcp or unix")
+	address := flag.String("address", "127.0.0.1:7070", "address or socket path to listen on")
+	ackTimeout := flag.Duration("ack-timeout", 30*time.Second, "redeliver messages not acknowledged within this long")
+	maxAttempts := flag.Int("max-attempts", 5, "give up on a message after this many deliveries")
+	flag.Parse()
+
+	listener, err := net.Listen(*network, *address)
+	if err != nil {
+		fmt.Println("Listen failed:", err)
+		os.Exit(1)
+	}
+	broker := s.NewBroker()
+	broker.AckTimeout = *ackTimeout
+	broker.MaxAttempts = *maxAttempts
+	go broker.Serve(listener)
+	fmt.Println("Broker listening on", listener.Addr())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Println("Shutting down on", sig)
+	broker.Close()
+	for _, dead := range broker.DeadLetters() {
+		fmt.Println("Dead letter:", dead.Type, dead.Id, string(dead.Payload))
+	}
+	fmt.Println("Stopped")
+}
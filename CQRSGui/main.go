@@ -3,12 +3,22 @@ package main
 import (
 	s "SimpleCQRS/SimpleCQRS"
 	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/gorilla/mux"
 	"html/template"
+	"io"
+	"log"
 	"net/http"
-	"reflect"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 func addTemplates(templates map[string]*template.Template) func(next http.Handler) http.Handler {
@@ -24,17 +34,17 @@ func getTemplates(r *http.Request) map[string]*template.Template {
 	return r.Context().Value("templates").(map[string]*template.Template)
 }
 
-func addReadModel(rm s.ReadModel) func(next http.Handler) http.Handler {
+func addQueries(queries s.QueryDispatcher) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			ctx := context.WithValue(r.Context(), "readmodel", rm)
+			ctx := context.WithValue(r.Context(), "queries", queries)
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-func getReadModel(r *http.Request) s.ReadModel {
-	return r.Context().Value("readmodel").(s.ReadModel)
+func getQueries(r *http.Request) s.QueryDispatcher {
+	return r.Context().Value("queries").(s.QueryDispatcher)
 }
 
 func addBus(bus s.CommandDispatcher) func(next http.Handler) http.Handler {
@@ -50,22 +60,248 @@ func getBus(r *http.Request) s.CommandDispatcher {
 	return r.Context().Value("bus").(s.CommandDispatcher)
 }
 
-func indexHandler(w http.ResponseWriter, r *http.Request) {
-	template := getTemplates(r)["index"]
-	readmodel := getReadModel(r)
-	data := make(map[string][]s.InventoryItemListDto)
-	data["InventoryItems"] = readmodel.GetInventoryItems()
+func addMonitor(monitor *s.ProjectionMonitor) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "monitor", monitor)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func getMonitor(r *http.Request) *s.ProjectionMonitor {
+	return r.Context().Value("monitor").(*s.ProjectionMonitor)
+}
+
+func addRunner(runner *s.ProjectionRunner) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "runner", runner)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func getRunner(r *http.Request) *s.ProjectionRunner {
+	return r.Context().Value("runner").(*s.ProjectionRunner)
+}
+
+// addUser records who sent each request. The GUI cannot tell by itself, so
+// only with trustProxy is it taken from the X-Forwarded-User header that a
+// proxy in front of the GUI sets, otherwise the sender is anonymous.
+func addUser(trustProxy bool) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user := ""
+			if trustProxy {
+				user = r.Header.Get("X-Forwarded-User")
+			}
+			ctx := context.WithValue(r.Context(), "user", user)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func addChanges(changes *s.ChangeFeed) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "changes", changes)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func getChanges(r *http.Request) *s.ChangeFeed {
+	return r.Context().Value("changes").(*s.ChangeFeed)
+}
+
+func addScheduler(scheduler *s.Scheduler) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := context.WithValue(r.Context(), "scheduler", scheduler)
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+func getScheduler(r *http.Request) *s.Scheduler {
+	return r.Context().Value("scheduler").(*s.Scheduler)
+}
+
+// formData is what the command forms are rendered with, each render gets a
+// fresh idempotency key so that submitting the same form twice only counts once
+type formData struct {
+	s.InventoryItemDetailsDto
+	IdempotencyKey s.Guid
+}
+
+func newFormData(ii s.InventoryItemDetailsDto) formData {
+	return formData{ii, s.NewGuid()}
+}
+
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	template := getTemplates(r)["search"]
+	text := r.URL.Query().Get("q")
+	results := make([]s.InventorySearchResult, 0)
+	if strings.TrimSpace(text) != "" {
+		var err error
+		results, err = s.Ask(r.Context(), getQueries(r), s.SearchInventoryItems{Text: text, Limit: s.DefaultPageSize})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	data := make(map[string]interface{})
+	data["Query"] = text
+	data["Results"] = results
 	err := template.ExecuteTemplate(w, "base", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
+// listOptions reads the sort, filters and page of the inventory list from the query string
+func listOptions(query url.Values) (s.InventoryItemListOptions, error) {
+	opts := s.InventoryItemListOptions{
+		Sort:       s.InventoryItemSort(query.Get("sort")),
+		Descending: query.Get("desc") != "",
+		Status:     s.InventoryItemStatus(query.Get("status")),
+		NamePrefix: query.Get("prefix"),
+		Cursor:     query.Get("cursor"),
+	}
+	counts := map[string]**int{"min": &opts.MinCount, "max": &opts.MaxCount}
+	for name, count := range counts {
+		if query.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			return opts, fmt.Errorf("%v count %q is not a number", name, query.Get(name))
+		}
+		*count = &n
+	}
+	if query.Get("limit") != "" {
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil {
+			return opts, fmt.Errorf("limit %q is not a number", query.Get("limit"))
+		}
+		opts.Limit = limit
+	}
+	return opts, nil
+}
+
+func indexHandler(w http.ResponseWriter, r *http.Request) {
+	listHandler(w, r, getTemplates(r)["index"], r.URL.Query())
+}
+
+// archiveHandler lists deactivated items, most recently deactivated first
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	query.Set("status", string(s.InactiveItems))
+	if query.Get("sort") == "" {
+		query.Set("sort", string(s.SortByLastUpdated))
+		query.Set("desc", "1")
+	}
+	listHandler(w, r, getTemplates(r)["archive"], query)
+}
+
+func listHandler(w http.ResponseWriter, r *http.Request, template *template.Template, query url.Values) {
+	after, err := s.ParseConsistencyToken(query.Get("after"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := listOptions(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	asOf, err := s.ParsePointInTime(query.Get("asOf"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	page, err := s.Ask(ctx, getQueries(r), s.GetInventoryItems{InventoryItemListOptions: opts, After: after, AsOf: asOf})
+	if errors.Is(err, s.ErrProjectionBehind) {
+		fmt.Println("List has not caught up with", after, "showing it anyway")
+		page, err = s.Ask(r.Context(), getQueries(r), s.GetInventoryItems{InventoryItemListOptions: opts, AsOf: asOf})
+	}
+	if errors.Is(err, s.ErrBadCursor) || errors.Is(err, s.ErrInvalidListOptions) || errors.Is(err, s.ErrBeyondHead) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := make(map[string]interface{})
+	data["InventoryItems"] = page.Items
+	data["Query"] = query
+	data["AsOf"] = asOf
+	if page.Next != "" {
+		query.Del("after")
+		query.Set("cursor", page.Next)
+		data["Next"] = r.URL.Path + "?" + query.Encode()
+	}
+	err = template.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// dispatchError tells the browser to back off and retry when the bus is overloaded
+func dispatchError(w http.ResponseWriter, err error) {
+	var overloaded *s.BusOverloadedError
+	if errors.As(err, &overloaded) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// dispatchAndRedirect waits for the command to be handled, then sends the
+// browser to the index, which waits for the list to reflect the command. If
+// the command takes too long the index is shown without waiting.
+func dispatchAndRedirect(w http.ResponseWriter, r *http.Request, cmd s.Command) {
+	handled := make(chan s.CommandResult, 1)
+	if err := getBus(r).Dispatch(cmd, handled); err != nil {
+		dispatchError(w, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	select {
+	case result := <-handled:
+		if result.Err != nil {
+			http.Error(w, result.Err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/?after="+url.QueryEscape(result.Token().String()), http.StatusFound)
+	case <-ctx.Done():
+		if r.Context().Err() != nil {
+			return
+		}
+		fmt.Println("Command not handled yet, not waiting for it:", cmd)
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+func idempotent(r *http.Request) s.Idempotent {
+	return s.Idempotent{Key: r.FormValue("idempotency_key")}
+}
+
+// issued is whoever addUser found sent the request
+func issued(r *http.Request) s.Issued {
+	return s.Issued{User: r.Context().Value("user").(string)}
+}
+
 func addHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		template := getTemplates(r)["add"]
-		err := template.ExecuteTemplate(w, "base", nil)
+		err := template.ExecuteTemplate(w, "base", newFormData(s.InventoryItemDetailsDto{}))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -77,13 +313,7 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		//fmt.Fprintf(w, "Post from website! r.PostFrom = %v\n", r.PostForm)
 		name := r.FormValue("name")
-		bus := getBus(r)
-		err := bus.Dispatch(s.CreateInventoryItem{InventoryItemId: s.NewGuid(), Name: name}, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		http.Redirect(w, r, "/", http.StatusFound)
+		dispatchAndRedirect(w, r, s.CreateInventoryItem{Idempotent: idempotent(r), Issued: issued(r), InventoryItemId: s.NewGuid(), Name: name})
 	default:
 		fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
 	}
@@ -92,8 +322,7 @@ func addHandler(w http.ResponseWriter, r *http.Request) {
 func changeNameHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	readmodel := getReadModel(r)
-	ii, err := readmodel.GetInventoryItemDetails(s.Guid(id))
+	ii, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemDetails{Id: s.Guid(id)})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -102,7 +331,7 @@ func changeNameHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		template := getTemplates(r)["changename"]
-		err := template.ExecuteTemplate(w, "base", ii)
+		err := template.ExecuteTemplate(w, "base", newFormData(ii))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -121,29 +350,35 @@ func changeNameHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		version := int(v)
 
-		wait_for_success := r.FormValue("wait_for_success")
-		var waitForSuccess chan s.CommandProcessingError = nil
-		if wait_for_success != "" {
-			waitForSuccess = make(chan s.CommandProcessingError)
+		cmd := s.RenameInventoryItem{Idempotent: idempotent(r), Issued: issued(r), InventoryItemId: ii.Id, OriginalVersion: version, NewName: name}
+		// without wait_for_success the list is shown, once it has the rename
+		if r.FormValue("wait_for_success") == "" {
+			dispatchAndRedirect(w, r, cmd)
+			return
 		}
 
-		bus := getBus(r)
-		err = bus.Dispatch(s.RenameInventoryItem{ii.Id, version, name}, waitForSuccess)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		waitForSuccess := make(chan s.CommandResult, 1)
+		if err := getBus(r).Dispatch(cmd, waitForSuccess); err != nil {
+			dispatchError(w, err)
 			return
 		}
-
-		if waitForSuccess != nil {
-			err = <-waitForSuccess
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		select {
+		case result := <-waitForSuccess:
+			if result.Err != nil {
+				http.Error(w, result.Err.Error(), http.StatusInternalServerError)
 				return
 			}
-		} else {
-			fmt.Println("Not waiting around!")
+			// show the item once the read model has caught up with the rename
+			http.Redirect(w, r, fmt.Sprintf("/details/%v?version=%v", result.AggregateId, result.Version), http.StatusFound)
+		case <-ctx.Done():
+			if r.Context().Err() != nil {
+				return
+			}
+			fmt.Println("Rename not handled yet, not waiting for it")
+			http.Redirect(w, r, "/", http.StatusFound)
 		}
-		http.Redirect(w, r, "/", http.StatusFound)
 	default:
 		fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
 	}
@@ -152,8 +387,7 @@ func changeNameHandler(w http.ResponseWriter, r *http.Request) {
 func checkinHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	readmodel := getReadModel(r)
-	ii, err := readmodel.GetInventoryItemDetails(s.Guid(id))
+	ii, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemDetails{Id: s.Guid(id)})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -162,7 +396,7 @@ func checkinHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		template := getTemplates(r)["checkin"]
-		err := template.ExecuteTemplate(w, "base", ii)
+		err := template.ExecuteTemplate(w, "base", newFormData(ii))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -183,13 +417,7 @@ func checkinHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		bus := getBus(r)
-		err = bus.Dispatch(s.CheckInItemsToInventory{ii.Id, version, number}, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		http.Redirect(w, r, "/", http.StatusFound)
+		dispatchAndRedirect(w, r, s.CheckInItemsToInventory{Idempotent: idempotent(r), Issued: issued(r), InventoryItemId: ii.Id, OriginalVersion: version, Count: number})
 	default:
 		fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
 	}
@@ -198,8 +426,7 @@ func checkinHandler(w http.ResponseWriter, r *http.Request) {
 func removeHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	readmodel := getReadModel(r)
-	ii, err := readmodel.GetInventoryItemDetails(s.Guid(id))
+	ii, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemDetails{Id: s.Guid(id)})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -208,7 +435,7 @@ func removeHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		template := getTemplates(r)["remove"]
-		err := template.ExecuteTemplate(w, "base", ii)
+		err := template.ExecuteTemplate(w, "base", newFormData(ii))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -229,13 +456,44 @@ func removeHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		bus := getBus(r)
-		err = bus.Dispatch(s.RemoveItemsFromInventory{ii.Id, version, number}, nil)
+		dispatchAndRedirect(w, r, s.RemoveItemsFromInventory{Idempotent: idempotent(r), Issued: issued(r), InventoryItemId: ii.Id, OriginalVersion: version, Count: number})
+	default:
+		fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
+	}
+}
+
+func reorderPointHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+	ii, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemDetails{Id: s.Guid(id)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		template := getTemplates(r)["reorderpoint"]
+		err := template.ExecuteTemplate(w, "base", newFormData(ii))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			fmt.Fprintf(w, "ParseForm() err: %v", err)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusFound)
+		reorderPoint, err := strconv.Atoi(r.FormValue("reorderpoint"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		version, err := strconv.Atoi(r.FormValue("version"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		dispatchAndRedirect(w, r, s.SetReorderPoint{Idempotent: idempotent(r), Issued: issued(r), InventoryItemId: ii.Id, OriginalVersion: version, ReorderPoint: reorderPoint})
 	default:
 		fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
 	}
@@ -244,8 +502,7 @@ func removeHandler(w http.ResponseWriter, r *http.Request) {
 func deactivateHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
-	readmodel := getReadModel(r)
-	ii, err := readmodel.GetInventoryItemDetails(s.Guid(id))
+	ii, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemDetails{Id: s.Guid(id)})
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -254,7 +511,7 @@ func deactivateHandler(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "GET":
 		template := getTemplates(r)["deactivate"]
-		err := template.ExecuteTemplate(w, "base", ii)
+		err := template.ExecuteTemplate(w, "base", newFormData(ii))
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -270,71 +527,408 @@ func deactivateHandler(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		bus := getBus(r)
-		err = bus.Dispatch(s.DeactivateInventoryItem{s.Guid(id), version}, nil)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		cmd := s.DeactivateInventoryItem{Idempotent: idempotent(r), Issued: issued(r), InventoryItemId: s.Guid(id), OriginalVersion: version}
+		if on := r.FormValue("on"); on != "" {
+			due, err := time.ParseInLocation("2006-01-02", on, time.Local)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			_, err = getScheduler(r).Schedule(cmd, due)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/", http.StatusFound)
 			return
 		}
-		http.Redirect(w, r, "/", http.StatusFound)
+		dispatchAndRedirect(w, r, cmd)
 	default:
 		fmt.Fprintf(w, "Sorry, only GET and POST methods are supported.")
 	}
 }
 
+// statusHandler reports on each projection, answering 503 if any is degraded
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := getMonitor(r).Statuses()
+	w.Header().Set("Content-Type", "application/json")
+	for _, status := range statuses {
+		if status.Degraded {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+	}
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// changesHandler streams read model changes as server sent events. A client
+// that falls behind is cut off, and the browser reconnects by itself.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	changes, stop := getChanges(r).Subscribe(64)
+	defer stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(15 * time.Second)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case change, ok := <-changes:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(change)
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(w, "event: %v\ndata: %s\n\n", change.View, data)
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep alive\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// rebuildHandler starts a blue/green rebuild of a projection, the old
+// version keeps answering queries until the new one has caught up
+func rebuildHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	runner := getRunner(r)
+	if _, err := runner.Checkpoint(name); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	go func() {
+		if err := runner.Rebuild(name); err != nil {
+			fmt.Println("Rebuild failed:", err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
 func detailsHandler(w http.ResponseWriter, r *http.Request) {
 	template := getTemplates(r)["details"]
-	readmodel := getReadModel(r)
 	vars := mux.Vars(r)
 	id := vars["id"]
 
 	guid := s.Guid(id)
-	data := make(map[string]s.InventoryItemDetailsDto)
-	model, _ := readmodel.GetInventoryItemDetails(guid)
+	minVersion, _ := strconv.Atoi(r.URL.Query().Get("version"))
+	asOf, err := s.ParsePointInTime(r.URL.Query().Get("asOf"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := make(map[string]interface{})
+	model, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemDetails{Id: guid, MinVersion: minVersion, AsOf: asOf})
+	if errors.Is(err, s.ErrBeyondHead) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	data["Model"] = model
-	err := template.ExecuteTemplate(w, "base", data)
+	data["AsOf"] = asOf
+	err = template.ExecuteTemplate(w, "base", data)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func setupCQRS(mimicEventualConsistency bool) (s.ReadModel, s.CommandDispatcher) {
+// alertsHandler shows what is low on stock now and the alerts raised so far
+func alertsHandler(w http.ResponseWriter, r *http.Request) {
+	template := getTemplates(r)["alerts"]
+	low, err := s.Ask(r.Context(), getQueries(r), s.GetLowStockItems{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	alerts, err := s.Ask(r.Context(), getQueries(r), s.GetLowStockAlerts{Limit: 100})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := make(map[string]interface{})
+	data["Low"] = low
+	data["Alerts"] = alerts
+	err = template.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
 
-	bus := s.NewFakeBus(mimicEventualConsistency)
+// reportsHandler shows the top movers of the last week and what has not
+// moved for a month, and an item's daily or weekly totals when one is picked
+func reportsHandler(w http.ResponseWriter, r *http.Request) {
+	template := getTemplates(r)["reports"]
+	days := map[string]int{"moved": 7, "idle": 30}
+	for name := range days {
+		if v := r.URL.Query().Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				http.Error(w, fmt.Sprintf("%v %q is not a number of days", name, v), http.StatusBadRequest)
+				return
+			}
+			days[name] = n
+		}
+	}
+	movers, err := s.Ask(r.Context(), getQueries(r), s.GetTopMovers{Days: days["moved"], Limit: 10})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	idle, err := s.Ask(r.Context(), getQueries(r), s.GetIdleItems{Days: days["idle"]})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := make(map[string]interface{})
+	data["Days"] = days
+	data["Movers"] = movers
+	data["Idle"] = idle
+	if id := s.Guid(r.URL.Query().Get("item")); id != "" {
+		period := s.StockPeriod(r.URL.Query().Get("period"))
+		if period == "" {
+			period = s.Daily
+		}
+		totals, err := s.Ask(r.Context(), getQueries(r), s.GetStockTotals{Id: id, Period: period})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		item, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemDetails{Id: id})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		data["Item"] = item
+		data["Period"] = period
+		data["Totals"] = totals
+	}
+	err = template.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	template := getTemplates(r)["history"]
+	id := s.Guid(mux.Vars(r)["id"])
+	entries, err := s.Ask(r.Context(), getQueries(r), s.GetInventoryItemHistory{Id: id})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	data := make(map[string]interface{})
+	data["Id"] = id
+	data["Entries"] = entries
+	err = template.ExecuteTemplate(w, "base", data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// cqrs is everything setupCQRS wires together
+type cqrs struct {
+	queries   s.QueryDispatcher
+	bus       s.Bus
+	nudges    s.Bus // tells the projections about events, the bus itself unless there is a broker
+	scheduler *s.Scheduler
+	monitor   *s.ProjectionMonitor
+	runner    *s.ProjectionRunner
+	changes   *s.ChangeFeed
+	alerter   *s.LowStockAlerter
+	// background workers that dispatch commands by themselves
+	stopBackground []func()
+}
+
+// shutdown stops everything that could send more commands, then drains the
+// bus, then sends the alerts the last events raised
+func (c *cqrs) shutdown(ctx context.Context) error {
+	for _, stop := range c.stopBackground {
+		stop()
+	}
+	err := c.bus.Stop(ctx)
+	if c.nudges != c.bus {
+		if nudgesErr := c.nudges.Stop(ctx); err == nil {
+			err = nudgesErr
+		}
+	}
+	if alertsErr := c.alerter.Stop(ctx); err == nil {
+		err = alertsErr
+	}
+	return err
+}
+
+// newBus is the in process FakeBus, or a RemoteBus when a broker address
+// such as "tcp:127.0.0.1:7070" or "unix:/tmp/cqrs.sock" is given. Processes
+// that dial the broker with the same name compete for events.
+func newBus(mimicEventualConsistency bool, broker string, name string) (s.Bus, error) {
+	if broker == "" {
+		bus := s.NewFakeBus(mimicEventualConsistency)
+		bus.UseIdempotencyStore(s.NewInMemoryIdempotencyStore(10000, 24*time.Hour, s.SystemClock))
+		return bus, nil
+	}
+	network, address, ok := strings.Cut(broker, ":")
+	if !ok {
+		return nil, fmt.Errorf("broker %q is not network:address", broker)
+	}
+	return s.DialBroker(network, address, name, s.NewInventoryCommandCodec(), s.NewInventoryEventCodec())
+}
+
+// settings are what main's flags chose for setupCQRS
+type settings struct {
+	broker     string
+	events     string
+	readModel  string
+	schedule   string
+	sagas      string
+	audit      bool
+	thresholds s.ProjectionThresholds
+	notifiers  []s.AlertNotifier
+}
+
+func setupCQRS(mimicEventualConsistency bool, settings settings) (*cqrs, error) {
+
+	bus, err := newBus(mimicEventualConsistency, settings.broker, "CQRSGui")
+	if err != nil {
+		return nil, err
+	}
+	// processes sharing a broker compete for the events their sagas handle,
+	// but each has its own projections to tell about every event
+	nudges := bus
+	if settings.broker != "" {
+		if nudges, err = newBus(false, settings.broker, fmt.Sprintf("CQRSGui-%v", os.Getpid())); err != nil {
+			return nil, err
+		}
+	}
 	storage := s.NewEventStore(bus)
-	rep := s.InventoryItemRepository{storage}
+	if settings.events != "" {
+		if storage, err = s.NewFileEventStore(settings.events, s.NewInventoryEventCodec(), bus); err != nil {
+			return nil, err
+		}
+	}
+	rep := s.InventoryItemRepository{Storage: storage}
 	commands := s.NewInventoryCommandHandlers(rep)
-	bus.SetCommandHandler(reflect.TypeOf(s.CheckInItemsToInventory{}), commands.HandleCheckInItemsToInventory)
-	bus.SetCommandHandler(reflect.TypeOf(s.CreateInventoryItem{}), commands.HandleCreateInventoryItem)
-	bus.SetCommandHandler(reflect.TypeOf(s.DeactivateInventoryItem{}), commands.HandleDeactivateInventoryItem)
-	bus.SetCommandHandler(reflect.TypeOf(s.RemoveItemsFromInventory{}), commands.HandleRemoveItemsFromInventory)
-	bus.SetCommandHandler(reflect.TypeOf(s.RenameInventoryItem{}), commands.HandleRenameInventoryItem)
+	s.RegisterCommandHandler(bus, commands.HandleCheckInItemsToInventory)
+	s.RegisterCommandHandler(bus, commands.HandleCreateInventoryItem)
+	s.RegisterCommandHandler(bus, commands.HandleDeactivateInventoryItem)
+	s.RegisterCommandHandler(bus, commands.HandleRemoveItemsFromInventory)
+	s.RegisterCommandHandler(bus, commands.HandleRenameInventoryItem)
+	s.RegisterCommandHandler(bus, commands.HandleSetReorderPoint)
 
 	bsdb := s.NewBSDB()
+	rmf := s.NewReadModelFacade(&bsdb)
+	monitor := s.NewProjectionMonitor(storage, s.SystemClock, settings.thresholds)
 
-	detail := s.NewInventoryItemDetailView(&bsdb)
-	bus.AddEventProcessor(reflect.TypeOf(s.InventoryItemCreated{}), detail.ProcessInventoryItemCreated)
-	bus.AddEventProcessor(reflect.TypeOf(s.InventoryItemDeactivated{}), detail.ProcessInventoryItemDeactivated)
-	bus.AddEventProcessor(reflect.TypeOf(s.InventoryItemRenamed{}), detail.ProcessInventoryItemRenamed)
-	bus.AddEventProcessor(reflect.TypeOf(s.ItemsCheckedInToInventory{}), detail.ProcessItemsCheckedInToInventory)
-	bus.AddEventProcessor(reflect.TypeOf(s.ItemsRemovedFromInventory{}), detail.ProcessItemsRemovedFromInventory)
+	// the read model is fed from the event store, the bus just says when there is more to read
+	var readModelStore s.KeyValueStore
+	if settings.readModel != "" {
+		if readModelStore, err = s.NewFileKeyValueStore(settings.readModel); err != nil {
+			return nil, err
+		}
+	}
+	runner := s.NewProjectionRunner(storage, s.NewInMemoryCheckpointStore())
+	if err := runner.Add(s.InventoryReadModelProjection(&rmf, readModelStore)); err != nil {
+		return nil, err
+	}
+	search := s.NewInventorySearch()
+	if err := runner.Add(search.Definition()); err != nil {
+		return nil, err
+	}
+	history := s.NewInventoryHistory()
+	if err := runner.Add(history.Definition()); err != nil {
+		return nil, err
+	}
+	ledger := s.NewStockLedger()
+	if err := runner.Add(ledger.Definition()); err != nil {
+		return nil, err
+	}
+	// the alerts sent are remembered as long as the events that raised them
+	alerted := s.NewInMemoryCheckpointStore()
+	if settings.events != "" {
+		if alerted, err = s.NewFileCheckpointStore(settings.events + ".alerted"); err != nil {
+			return nil, err
+		}
+	}
+	alerter, err := s.NewLowStockAlerter(alerted, settings.notifiers...)
+	if err != nil {
+		return nil, err
+	}
+	alerts := s.NewLowStockAlerts(alerter)
+	if err := runner.Add(alerts.Definition()); err != nil {
+		return nil, err
+	}
+	runner.ReportTo(monitor)
+	nudges.SubscribeEvents(s.EventFilter{}, runner.CatchUp)
 
-	list := s.NewInventoryListView(&bsdb)
-	bus.AddEventProcessor(reflect.TypeOf(s.InventoryItemCreated{}), list.ProcessInventoryItemCreated)
-	bus.AddEventProcessor(reflect.TypeOf(s.InventoryItemRenamed{}), list.ProcessInventoryItemRenamed)
-	bus.AddEventProcessor(reflect.TypeOf(s.InventoryItemDeactivated{}), list.ProcessInventoryItemDeactivated)
+	if settings.audit {
+		bus.SubscribeEvents(s.EventFilter{}, func(evt s.Event) error {
+			fmt.Printf("Audit: %T version %v\n", evt, evt.Version())
+			return nil
+		})
+	}
 
+	schedule := s.NewInMemoryScheduleStore()
+	if settings.schedule != "" {
+		if schedule, err = s.NewFileScheduleStore(settings.schedule); err != nil {
+			return nil, err
+		}
+	}
+	scheduler := s.NewScheduler(schedule, s.NewInventoryCommandCodec(), bus, storage, s.SystemClock)
+	stopScheduler := scheduler.Run(time.Minute)
+
+	sagas := s.NewInMemorySagaStore()
+	if settings.sagas != "" {
+		if sagas, err = s.NewFileSagaStore(settings.sagas); err != nil {
+			return nil, err
+		}
+	}
+	reorder := s.NewReorderSaga(20, 30*time.Second, sagas, storage, scheduler)
+	reorder.Subscribe(bus)
+
+	bus.Start()
+	if nudges != bus {
+		nudges.Start()
+	}
 	id := s.NewGuid()
-	bus.Dispatch(s.CreateInventoryItem{id, "The self-seed inventory item"}, nil)
-	rmf := s.NewReadModelFacade(&bsdb)
-	fmt.Println("Returning facade")
-	return &rmf, bus
+	bus.Dispatch(s.CreateInventoryItem{InventoryItemId: id, Name: "The self-seed inventory item"}, nil)
+	queries := s.NewQueryBus(
+		s.TimingQueryMiddleware(func(q s.Query, took time.Duration, err error) {
+			if took > 250*time.Millisecond {
+				fmt.Printf("Slow query %T took %v, error: %v\n", q, took, err)
+			}
+		}),
+		s.MinimumVersionQueryMiddleware(5*time.Second, 50*time.Millisecond))
+	handlers := s.NewReadModelQueryHandlers(&rmf, s.NewTimeTravel(storage, 8))
+	s.RegisterQueryHandler(queries, handlers.HandleGetInventoryItems)
+	s.RegisterQueryHandler(queries, handlers.HandleGetInventoryItemDetails)
+	searchHandlers := s.NewSearchQueryHandlers(search)
+	s.RegisterQueryHandler(queries, searchHandlers.HandleSearchInventoryItems)
+	historyHandlers := s.NewHistoryQueryHandlers(history)
+	s.RegisterQueryHandler(queries, historyHandlers.HandleGetInventoryItemHistory)
+	reportHandlers := s.NewStockReportQueryHandlers(ledger, s.SystemClock)
+	s.RegisterQueryHandler(queries, reportHandlers.HandleGetStockMovements)
+	s.RegisterQueryHandler(queries, reportHandlers.HandleGetStockTotals)
+	s.RegisterQueryHandler(queries, reportHandlers.HandleGetTopMovers)
+	s.RegisterQueryHandler(queries, reportHandlers.HandleGetIdleItems)
+	lowStockHandlers := s.NewLowStockQueryHandlers(alerts)
+	s.RegisterQueryHandler(queries, lowStockHandlers.HandleGetLowStockItems)
+	s.RegisterQueryHandler(queries, lowStockHandlers.HandleGetLowStockAlerts)
+	return &cqrs{queries, bus, nudges, scheduler, monitor, runner, rmf.Changes(), alerter, []func(){stopScheduler}}, nil
 }
 
 func buildTemplates() map[string]*template.Template {
 	t := make(map[string]*template.Template)
 
-	for _, name := range []string{"index", "details", "add", "changename", "checkin", "remove", "deactivate"} {
+	for _, name := range []string{"index", "archive", "search", "reports", "alerts", "details", "history", "add", "changename", "checkin", "remove", "reorderpoint", "deactivate"} {
 		t[name] = template.Must(
 			template.ParseFiles(
 				fmt.Sprintf("./CQRSGui/pages/%v.html", name),
@@ -345,33 +939,121 @@ func buildTemplates() map[string]*template.Template {
 }
 
 func main() {
+	addr := flag.String("addr", ":8080", "address to serve the GUI on")
+	broker := flag.String("broker", "", "send commands and events through a broker at network:address instead of in process")
+	events := flag.String("events", "", "keep events in this file rather than only in memory, processes sharing a broker have to share it")
+	readModel := flag.String("read-model", "", "save the read model in this file, to pick up from on restart, needs -events")
+	schedule := flag.String("schedule", "", "keep scheduled commands in this file rather than only in memory")
+	sagas := flag.String("sagas", "", "keep saga state in this directory rather than only in memory")
+	trustProxy := flag.Bool("trust-proxy", false, "take the user from the X-Forwarded-User header, only safe behind a proxy that sets it")
+	audit := flag.Bool("audit", false, "print every event as it is published")
+	quiet := flag.Bool("quiet", false, "do not print what the bus, projections and scheduler are doing")
+	thresholds := s.DefaultProjectionThresholds()
+	flag.Int64Var(&thresholds.MaxLag, "max-lag", thresholds.MaxLag, "events a projection may fall behind before it is degraded")
+	flag.DurationVar(&thresholds.MaxStaleness, "max-staleness", thresholds.MaxStaleness, "how long a projection may be behind without progress before it is degraded")
+	flag.IntVar(&thresholds.MaxConsecutiveErrors, "max-errors", thresholds.MaxConsecutiveErrors, "errors in a row before a projection is degraded")
+	webhook := flag.String("alert-webhook", "", "post low stock alerts as JSON to this URL")
+	smtpAddr := flag.String("alert-smtp", "", "mail low stock alerts through the SMTP server at host:port")
+	alertFrom := flag.String("alert-from", "inventory@localhost", "who low stock alert mails are from")
+	alertTo := flag.String("alert-to", "", "comma separated addresses to mail low stock alerts to")
+	flag.Parse()
+
+	if *broker != "" && *events == "" {
+		fmt.Println("-broker needs -events, so that every process reads the same events")
+		os.Exit(2)
+	}
+	if *readModel != "" && *events == "" {
+		fmt.Println("-read-model needs -events, a saved read model is no use once the events it was built from are gone")
+		os.Exit(2)
+	}
+
+	if *quiet {
+		s.Logger = log.New(io.Discard, "", 0)
+	}
+
+	notifiers := []s.AlertNotifier{s.LogNotifier{}}
+	if *webhook != "" {
+		notifiers = append(notifiers, s.NewWebhookNotifier(*webhook))
+	}
+	if *smtpAddr != "" {
+		if *alertTo == "" {
+			fmt.Println("-alert-smtp needs -alert-to")
+			os.Exit(2)
+		}
+		notifiers = append(notifiers, s.NewEmailNotifier(*smtpAddr, *alertFrom, strings.Split(*alertTo, ",")...))
+	}
+
 	fmt.Println("Starting")
 	templates := buildTemplates()
 
 	fmt.Println("Starting CQRS")
-	readmodel, bus := setupCQRS(false) // true to introduce delays
+	system, err := setupCQRS(false, settings{*broker, *events, *readModel, *schedule, *sagas, *audit, thresholds, notifiers}) // true to introduce delays
+	if err != nil {
+		fmt.Println("Setting up CQRS failed:", err)
+		os.Exit(1)
+	}
 
 	fmt.Println("Starting Router")
 	rtr := mux.NewRouter()
-	rtr.Use(addReadModel(readmodel))
+	rtr.Use(addQueries(system.queries))
 	rtr.Use(addTemplates(templates))
-	rtr.Use(addBus(bus))
+	rtr.Use(addBus(system.bus))
+	rtr.Use(addScheduler(system.scheduler))
+	rtr.Use(addMonitor(system.monitor))
+	rtr.Use(addRunner(system.runner))
+	rtr.Use(addChanges(system.changes))
+	rtr.Use(addUser(*trustProxy))
 
 	rtr.HandleFunc("/", indexHandler).Methods("GET")
+	rtr.HandleFunc("/archive", archiveHandler).Methods("GET")
+	rtr.HandleFunc("/search", searchHandler).Methods("GET")
+	rtr.HandleFunc("/reports", reportsHandler).Methods("GET")
+	rtr.HandleFunc("/alerts", alertsHandler).Methods("GET")
 	rtr.HandleFunc("/add", addHandler).Methods("GET", "POST")
+	rtr.HandleFunc("/status", statusHandler).Methods("GET")
+	rtr.HandleFunc("/changes", changesHandler).Methods("GET")
+	rtr.HandleFunc("/projections/{name}/rebuild", rebuildHandler).Methods("POST")
 
 	ii := rtr.PathPrefix("/details").Subrouter()
 	ii.HandleFunc("/{id}", detailsHandler).Methods("GET")
+	ii.HandleFunc("/{id}/history", historyHandler).Methods("GET")
 	ii.HandleFunc("/{id}/changename", changeNameHandler).Methods("GET", "POST")
 	ii.HandleFunc("/{id}/checkin", checkinHandler).Methods("GET", "POST")
 	ii.HandleFunc("/{id}/remove", removeHandler).Methods("GET", "POST")
+	ii.HandleFunc("/{id}/reorderpoint", reorderPointHandler).Methods("GET", "POST")
 	ii.HandleFunc("/{id}/deactivate", deactivateHandler).Methods("GET", "POST")
 
 	rtr.PathPrefix("/Content/").Handler(
 		http.StripPrefix("/Content/",
 			http.FileServer(http.Dir("./CQRSGui/Content/"))))
 
-	http.Handle("/", rtr)
-	fmt.Println("Starting ListenAndServe")
-	http.ListenAndServe(":8080", nil)
+	srv := &http.Server{Addr: *addr, Handler: rtr}
+	// event streams never finish by themselves, so end them for Shutdown
+	srv.RegisterOnShutdown(system.changes.Close)
+	serverErr := make(chan error, 1)
+	go func() {
+		fmt.Println("Starting ListenAndServe")
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		fmt.Println("Shutting down on", sig)
+	case err := <-serverErr:
+		fmt.Println("ListenAndServe failed:", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// stop taking requests first so nothing new reaches the bus, then let it drain
+	if err := srv.Shutdown(ctx); err != nil {
+		fmt.Println("HTTP server shutdown:", err)
+	}
+	if err := system.shutdown(ctx); err != nil {
+		fmt.Println("Shutdown:", err)
+	}
+	fmt.Println("Stopped")
 }
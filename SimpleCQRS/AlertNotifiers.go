@@ -0,0 +1,68 @@
+package SimpleCQRS
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// LogNotifier prints alerts
+type LogNotifier struct{}
+
+func (LogNotifier) Notify(alert LowStockAlert) error {
+	Logger.Println("Low stock:", alert)
+	return nil
+}
+
+// WebhookNotifier posts each alert as JSON to a URL
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (wn *WebhookNotifier) Notify(alert LowStockAlert) error {
+	data, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	resp, err := wn.Client.Post(wn.URL, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %v answered %v", wn.URL, resp.Status)
+	}
+	return nil
+}
+
+// EmailNotifier mails each alert through an SMTP server that needs no
+// authentication, such as a local relay or a stand-in for testing
+type EmailNotifier struct {
+	Addr string // host:port
+	From string
+	To   []string
+}
+
+func NewEmailNotifier(addr, from string, to ...string) *EmailNotifier {
+	return &EmailNotifier{addr, from, to}
+}
+
+func (en *EmailNotifier) Notify(alert LowStockAlert) error {
+	// names are typed in by users, so they must not be able to add headers
+	alert.Name = strings.NewReplacer("\r", " ", "\n", " ").Replace(alert.Name)
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %v\r\n", en.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", strings.Join(en.To, ", "))
+	fmt.Fprintf(&msg, "Subject: Low stock: %v\r\n", alert.Name)
+	fmt.Fprintf(&msg, "\r\n%v.\r\nItem %v, raised %v.\r\n", alert, alert.Id, alert.Raised.Format(time.RFC1123))
+	return smtp.SendMail(en.Addr, nil, en.From, en.To, []byte(msg.String()))
+}
@@ -0,0 +1,98 @@
+package SimpleCQRS
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// BackpressurePolicy decides what a full queue does with one more item
+type BackpressurePolicy int
+
+const (
+	// BlockWhenFull makes the sender wait for room
+	BlockWhenFull BackpressurePolicy = iota
+	// FailWhenFull rejects the new item with a *BusOverloadedError
+	FailWhenFull
+	// DropOldestWhenFull discards the item that has waited longest to make room
+	DropOldestWhenFull
+)
+
+type BusOverloadedError struct {
+	Queue    string
+	Capacity int
+}
+
+func (e *BusOverloadedError) Error() string {
+	return fmt.Sprintf("bus overloaded, queue %v is full (capacity %v)", e.Queue, e.Capacity)
+}
+
+type QueueStats struct {
+	Name     string
+	Depth    int
+	Capacity int
+	Dropped  uint64
+	Rejected uint64
+}
+
+type boundedQueue[T any] struct {
+	name     string
+	items    chan T
+	policy   BackpressurePolicy
+	onDrop   func(item T)
+	dropped  atomic.Uint64
+	rejected atomic.Uint64
+}
+
+func newBoundedQueue[T any](name string, capacity int, policy BackpressurePolicy, onDrop func(item T)) *boundedQueue[T] {
+	if policy != BlockWhenFull && capacity < 1 {
+		capacity = 1 // an unbuffered queue is always full
+	}
+	return &boundedQueue[T]{
+		name:   name,
+		items:  make(chan T, capacity),
+		policy: policy,
+		onDrop: onDrop,
+	}
+}
+
+func (q *boundedQueue[T]) push(item T) error {
+	switch q.policy {
+	case FailWhenFull:
+		select {
+		case q.items <- item:
+			return nil
+		default:
+			q.rejected.Add(1)
+			return &BusOverloadedError{q.name, cap(q.items)}
+		}
+	case DropOldestWhenFull:
+		for {
+			select {
+			case q.items <- item:
+				return nil
+			default:
+			}
+			select {
+			case old := <-q.items:
+				q.dropped.Add(1)
+				if q.onDrop != nil {
+					q.onDrop(old)
+				}
+			default:
+			}
+		}
+	default:
+		q.items <- item
+		return nil
+	}
+}
+
+func (q *boundedQueue[T]) stats() QueueStats {
+	return QueueStats{
+		Name:     q.name,
+		Depth:    len(q.items),
+		Capacity: cap(q.items),
+		Dropped:  q.dropped.Load(),
+		Rejected: q.rejected.Load(),
+	}
+}
@@ -0,0 +1,68 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func drain(q *boundedQueue[int]) []int {
+	items := make([]int, 0)
+	for len(q.items) > 0 {
+		items = append(items, <-q.items)
+	}
+	return items
+}
+
+func TestBoundedQueueFailWhenFullRejectsTheNewItem(t *testing.T) {
+	q := newBoundedQueue[int]("q", 2, FailWhenFull, nil)
+	q.push(1)
+	q.push(2)
+	var overloaded *BusOverloadedError
+	if err := q.push(3); !errors.As(err, &overloaded) || overloaded.Queue != "q" || overloaded.Capacity != 2 {
+		t.Fatal(err)
+	}
+	if stats := q.stats(); stats.Depth != 2 || stats.Rejected != 1 || stats.Dropped != 0 {
+		t.Fatalf("%+v", stats)
+	}
+	if items := drain(q); !reflect.DeepEqual(items, []int{1, 2}) {
+		t.Fatal(items)
+	}
+}
+
+func TestBoundedQueueDropOldestWhenFullMakesRoom(t *testing.T) {
+	dropped := make([]int, 0)
+	q := newBoundedQueue("q", 2, DropOldestWhenFull, func(item int) { dropped = append(dropped, item) })
+	for i := 1; i <= 4; i++ {
+		if err := q.push(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stats := q.stats(); stats.Depth != 2 || stats.Dropped != 2 || stats.Rejected != 0 {
+		t.Fatalf("%+v", stats)
+	}
+	if items := drain(q); !reflect.DeepEqual(items, []int{3, 4}) || !reflect.DeepEqual(dropped, []int{1, 2}) {
+		t.Fatal(items, dropped)
+	}
+}
+
+func TestBoundedQueueBlockWhenFullWaitsForRoom(t *testing.T) {
+	q := newBoundedQueue[int]("q", 1, BlockWhenFull, nil)
+	q.push(1)
+	pushed := make(chan error)
+	go func() { pushed <- q.push(2) }()
+	select {
+	case <-pushed:
+		t.Fatal("pushed onto a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	<-q.items
+	if err := <-pushed; err != nil {
+		t.Fatal(err)
+	}
+	if items := drain(q); !reflect.DeepEqual(items, []int{2}) {
+		t.Fatal(items)
+	}
+}
@@ -0,0 +1,407 @@
+package SimpleCQRS
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"path"
+	"sync"
+	"time"
+)
+
+// brokerFrame is one line of the newline delimited JSON spoken between the
+// broker and its clients.
+//
+// Client to broker:  subscribe, unsubscribe, publish (to every group on the
+// topic), send (to the topic's single command group), ack, nack, reply.
+// Broker to client:  deliver, reply.
+type brokerFrame struct {
+	Op          string          `json:"op"`
+	Topic       string          `json:"topic,omitempty"`
+	Group       string          `json:"group,omitempty"`
+	Sub         string          `json:"sub,omitempty"`
+	Id          string          `json:"id,omitempty"`
+	Type        string          `json:"type,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	WantReply   bool            `json:"wantReply,omitempty"`
+	Redelivered bool            `json:"redelivered,omitempty"`
+	Error       string          `json:"error,omitempty"`
+}
+
+// commandGroup is the group every command handler joins, so commands go to
+// exactly one of the competing handlers
+const commandGroup = "commands"
+
+type brokerMessage struct {
+	id        string
+	topic     string
+	msgType   string
+	payload   json.RawMessage
+	wantReply bool
+	attempts  int
+}
+
+// DeadLetter is a message the broker gave up on
+type DeadLetter struct {
+	Topic   string
+	Id      string
+	Type    string
+	Payload json.RawMessage
+}
+
+// brokerGroup holds a topic's messages for one group of competing consumers
+type brokerGroup struct {
+	pending   []*brokerMessage
+	consumers []*brokerConsumer
+	next      int
+}
+
+// brokerConsumer has at most one unacknowledged message at a time
+type brokerConsumer struct {
+	conn     *brokerConn
+	sub      string
+	group    *brokerGroup
+	inFlight *brokerMessage
+	deadline time.Time
+}
+
+type brokerConn struct {
+	conn     net.Conn
+	outbound chan brokerFrame
+	subs     map[string]*brokerConsumer
+	cutOff   bool // too slow to keep up, it is being disconnected
+}
+
+// Broker routes messages between processes. Every event topic fans out to
+// each group subscribed to it and within a group consumers compete, commands
+// go to one group of competing handlers. A message is redelivered if it is
+// nacked, not acked within AckTimeout or its consumer goes away, and is put
+// aside as a dead letter after MaxAttempts deliveries. Events published to a
+// topic nobody has subscribed to are dropped, commands wait for a handler.
+// Subscriptions can use path.Match patterns, "event.*" receives every event.
+type Broker struct {
+	AckTimeout  time.Duration
+	MaxAttempts int
+	// OutboundBuffer is how many frames can wait to be written to a client,
+	// one that lets more back up is cut off
+	OutboundBuffer int
+
+	listener    net.Listener
+	topics      map[string]map[string]*brokerGroup
+	replies     map[string]*brokerConn
+	conns       map[*brokerConn]bool
+	deadLetters []DeadLetter
+	done        chan struct{}
+	s           sync.Mutex
+}
+
+func NewBroker() *Broker {
+	return &Broker{
+		AckTimeout:     30 * time.Second,
+		MaxAttempts:    5,
+		OutboundBuffer: 1024,
+		topics:         make(map[string]map[string]*brokerGroup),
+		replies:        make(map[string]*brokerConn),
+		conns:          make(map[*brokerConn]bool),
+		deadLetters:    make([]DeadLetter, 0),
+		done:           make(chan struct{}),
+	}
+}
+
+// ListenBroker starts a broker on a "tcp" or "unix" address, use
+// "127.0.0.1:0" to have tests pick a free port and ask Addr for it
+func ListenBroker(network, address string) (*Broker, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	b := NewBroker()
+	b.listener = l
+	go b.Serve(l)
+	return b, nil
+}
+
+func (b *Broker) Addr() net.Addr {
+	b.s.Lock()
+	defer b.s.Unlock()
+
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Addr()
+}
+
+func (b *Broker) Serve(l net.Listener) error {
+	b.s.Lock()
+	b.listener = l
+	b.s.Unlock()
+
+	go b.checkAckTimeouts()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-b.done:
+				return nil
+			default:
+				return err
+			}
+		}
+		go b.serveConn(conn)
+	}
+}
+
+func (b *Broker) Close() error {
+	b.s.Lock()
+	defer b.s.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	default:
+	}
+	close(b.done)
+	for bc := range b.conns {
+		bc.conn.Close()
+	}
+	if b.listener == nil {
+		return nil
+	}
+	return b.listener.Close()
+}
+
+// DeadLetters returns the messages given up on after MaxAttempts deliveries
+func (b *Broker) DeadLetters() []DeadLetter {
+	b.s.Lock()
+	defer b.s.Unlock()
+
+	return append([]DeadLetter(nil), b.deadLetters...)
+}
+
+func (b *Broker) serveConn(conn net.Conn) {
+	b.s.Lock()
+	bc := &brokerConn{conn: conn, outbound: make(chan brokerFrame, b.OutboundBuffer), subs: make(map[string]*brokerConsumer)}
+	b.conns[bc] = true
+	b.s.Unlock()
+
+	go func() {
+		enc := json.NewEncoder(conn)
+		for f := range bc.outbound {
+			if err := enc.Encode(f); err != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var f brokerFrame
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			Logger.Println("Broker dropping bad frame:", err)
+			continue
+		}
+		b.handle(bc, f)
+	}
+	b.disconnect(bc)
+	conn.Close()
+}
+
+func (b *Broker) handle(bc *brokerConn, f brokerFrame) {
+	b.s.Lock()
+	defer b.s.Unlock()
+
+	switch f.Op {
+	case "subscribe":
+		// subscribing again under the same id replaces the consumer
+		if old, ok := bc.subs[f.Sub]; ok {
+			b.removeConsumer(old)
+		}
+		group := b.group(f.Topic, f.Group)
+		consumer := &brokerConsumer{conn: bc, sub: f.Sub, group: group}
+		bc.subs[f.Sub] = consumer
+		group.consumers = append(group.consumers, consumer)
+		b.pump(group)
+	case "unsubscribe":
+		if consumer, ok := bc.subs[f.Sub]; ok {
+			b.removeConsumer(consumer)
+			delete(bc.subs, f.Sub)
+		}
+	case "publish":
+		for topic, groups := range b.topics {
+			if matched, _ := path.Match(topic, f.Topic); !matched {
+				continue
+			}
+			for _, group := range groups {
+				group.pending = append(group.pending, b.message(bc, f))
+				b.pump(group)
+			}
+		}
+	case "send":
+		group := b.group(f.Topic, commandGroup)
+		group.pending = append(group.pending, b.message(bc, f))
+		b.pump(group)
+	case "ack", "nack":
+		consumer, ok := bc.subs[f.Sub]
+		if !ok || consumer.inFlight == nil || consumer.inFlight.id != f.Id {
+			return
+		}
+		msg := consumer.inFlight
+		consumer.inFlight = nil
+		if f.Op == "nack" {
+			b.requeue(consumer.group, msg)
+		}
+		b.pump(consumer.group)
+	case "reply":
+		if origin, ok := b.replies[f.Id]; ok {
+			delete(b.replies, f.Id)
+			b.send(origin, brokerFrame{Op: "reply", Id: f.Id, Payload: f.Payload, Error: f.Error})
+		}
+	default:
+		Logger.Println("Broker dropping unknown frame:", f.Op)
+	}
+}
+
+func (b *Broker) group(topic, name string) *brokerGroup {
+	groups, ok := b.topics[topic]
+	if !ok {
+		groups = make(map[string]*brokerGroup)
+		b.topics[topic] = groups
+	}
+	group, ok := groups[name]
+	if !ok {
+		group = &brokerGroup{pending: make([]*brokerMessage, 0), consumers: make([]*brokerConsumer, 0)}
+		groups[name] = group
+	}
+	return group
+}
+
+func (b *Broker) message(origin *brokerConn, f brokerFrame) *brokerMessage {
+	if f.WantReply {
+		b.replies[f.Id] = origin
+	}
+	return &brokerMessage{id: f.Id, topic: f.Topic, msgType: f.Type, payload: f.Payload, wantReply: f.WantReply}
+}
+
+// pump hands pending messages to idle consumers, taking turns between them
+func (b *Broker) pump(group *brokerGroup) {
+	for len(group.pending) > 0 {
+		var consumer *brokerConsumer
+		for i := 0; i < len(group.consumers); i++ {
+			c := group.consumers[(group.next+i)%len(group.consumers)]
+			if c.inFlight == nil && !c.conn.cutOff {
+				consumer = c
+				group.next = (group.next + i + 1) % len(group.consumers)
+				break
+			}
+		}
+		if consumer == nil {
+			return
+		}
+
+		msg := group.pending[0]
+		delivered := b.send(consumer.conn, brokerFrame{
+			Op:          "deliver",
+			Topic:       msg.topic,
+			Sub:         consumer.sub,
+			Id:          msg.id,
+			Type:        msg.msgType,
+			Payload:     msg.payload,
+			WantReply:   msg.wantReply,
+			Redelivered: msg.attempts > 0,
+		})
+		if delivered {
+			group.pending = group.pending[1:]
+			msg.attempts++
+			consumer.inFlight = msg
+			consumer.deadline = time.Now().Add(b.AckTimeout)
+		}
+	}
+}
+
+// send never waits, as it is called holding the lock every client needs. A
+// client that has let its outbound frames back up is cut off, and what it
+// had not acknowledged goes to the other consumers once it has gone.
+func (b *Broker) send(bc *brokerConn, f brokerFrame) bool {
+	if bc.cutOff {
+		return false
+	}
+	select {
+	case bc.outbound <- f:
+		return true
+	default:
+		Logger.Println("Broker cutting off slow client:", bc.conn.RemoteAddr())
+		bc.cutOff = true
+		bc.conn.Close()
+		return false
+	}
+}
+
+// requeue puts a message back at the front of its group, or aside if it has run out of attempts
+func (b *Broker) requeue(group *brokerGroup, msg *brokerMessage) {
+	if msg.attempts >= b.MaxAttempts {
+		Logger.Println("Broker giving up on message:", msg.id, msg.msgType)
+		b.deadLetters = append(b.deadLetters, DeadLetter{msg.topic, msg.id, msg.msgType, msg.payload})
+		if origin, ok := b.replies[msg.id]; ok {
+			delete(b.replies, msg.id)
+			b.send(origin, brokerFrame{Op: "reply", Id: msg.id, Error: "message was not handled"})
+		}
+		return
+	}
+	group.pending = append([]*brokerMessage{msg}, group.pending...)
+}
+
+func (b *Broker) removeConsumer(consumer *brokerConsumer) {
+	group := consumer.group
+	for i, c := range group.consumers {
+		if c == consumer {
+			group.consumers = append(group.consumers[:i], group.consumers[i+1:]...)
+			break
+		}
+	}
+	if consumer.inFlight != nil {
+		b.requeue(group, consumer.inFlight)
+		consumer.inFlight = nil
+	}
+	b.pump(group)
+}
+
+func (b *Broker) disconnect(bc *brokerConn) {
+	b.s.Lock()
+	defer b.s.Unlock()
+
+	for _, consumer := range bc.subs {
+		b.removeConsumer(consumer)
+	}
+	for id, origin := range b.replies {
+		if origin == bc {
+			delete(b.replies, id)
+		}
+	}
+	delete(b.conns, bc)
+	close(bc.outbound)
+}
+
+func (b *Broker) checkAckTimeouts() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			b.s.Lock()
+			for bc := range b.conns {
+				for _, consumer := range bc.subs {
+					if consumer.inFlight != nil && now.After(consumer.deadline) {
+						msg := consumer.inFlight
+						consumer.inFlight = nil
+						b.requeue(consumer.group, msg)
+						b.pump(consumer.group)
+					}
+				}
+			}
+			b.s.Unlock()
+		case <-b.done:
+			return
+		}
+	}
+}
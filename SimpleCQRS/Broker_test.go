@@ -0,0 +1,289 @@
+package SimpleCQRS
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// brokerClient speaks frames to a broker directly
+type brokerClient struct {
+	t      *testing.T
+	conn   net.Conn
+	enc    *json.Encoder
+	frames chan brokerFrame
+}
+
+func dialTestBroker(t *testing.T, b *Broker) *brokerClient {
+	conn, err := net.Dial(b.Addr().Network(), b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &brokerClient{t: t, conn: conn, enc: json.NewEncoder(conn), frames: make(chan brokerFrame, 100)}
+	go func() {
+		defer close(c.frames)
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var f brokerFrame
+			if json.Unmarshal(scanner.Bytes(), &f) == nil {
+				c.frames <- f
+			}
+		}
+	}()
+	return c
+}
+
+func (c *brokerClient) send(f brokerFrame) {
+	if err := c.enc.Encode(f); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// subscribe waits for the broker to have taken the subscription
+func (c *brokerClient) subscribe(topic, group, sub string) {
+	c.send(brokerFrame{Op: "subscribe", Topic: topic, Group: group, Sub: sub})
+	time.Sleep(20 * time.Millisecond)
+}
+
+func (c *brokerClient) next() brokerFrame {
+	select {
+	case f, ok := <-c.frames:
+		if !ok {
+			c.t.Fatal("broker hung up")
+		}
+		return f
+	case <-time.After(2 * time.Second):
+		c.t.Fatal("nothing from the broker")
+	}
+	return brokerFrame{}
+}
+
+func (c *brokerClient) nothing(within time.Duration) {
+	select {
+	case f, ok := <-c.frames:
+		if ok {
+			c.t.Fatalf("unexpected %+v", f)
+		}
+	case <-time.After(within):
+	}
+}
+
+func listenTestBroker(t *testing.T) *Broker {
+	b, err := ListenBroker("unix", t.TempDir()+"/broker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestBrokerRedeliversNackedMessages(t *testing.T) {
+	b := listenTestBroker(t)
+	consumer := dialTestBroker(t, b)
+	consumer.subscribe("event.Renamed", "read", "s1")
+	producer := dialTestBroker(t, b)
+
+	producer.send(brokerFrame{Op: "publish", Topic: "event.Renamed", Id: "m1", Type: "Renamed"})
+	first := consumer.next()
+	if first.Op != "deliver" || first.Id != "m1" || first.Redelivered {
+		t.Fatalf("first delivery %+v", first)
+	}
+	producer.send(brokerFrame{Op: "publish", Topic: "event.Renamed", Id: "m2", Type: "Renamed"})
+	// one message in flight at a time
+	consumer.nothing(50 * time.Millisecond)
+
+	consumer.send(brokerFrame{Op: "nack", Sub: "s1", Id: "m1"})
+	again := consumer.next()
+	if again.Id != "m1" || !again.Redelivered {
+		t.Fatalf("redelivery %+v", again)
+	}
+	consumer.send(brokerFrame{Op: "ack", Sub: "s1", Id: "m1"})
+	if second := consumer.next(); second.Id != "m2" || second.Redelivered {
+		t.Fatalf("after the ack %+v", second)
+	}
+	consumer.send(brokerFrame{Op: "ack", Sub: "s1", Id: "m2"})
+	consumer.nothing(50 * time.Millisecond)
+	if len(b.DeadLetters()) != 0 {
+		t.Fatal(b.DeadLetters())
+	}
+}
+
+func TestBrokerDeadLettersAndRepliesAfterMaxAttempts(t *testing.T) {
+	b := listenTestBroker(t)
+	b.s.Lock()
+	b.MaxAttempts = 2
+	b.AckTimeout = 50 * time.Millisecond
+	b.s.Unlock()
+	handler := dialTestBroker(t, b)
+	handler.subscribe("command.Rename", commandGroup, "s1")
+	sender := dialTestBroker(t, b)
+
+	sender.send(brokerFrame{Op: "send", Topic: "command.Rename", Id: "c1", Type: "Rename", WantReply: true})
+	handler.next()
+	handler.send(brokerFrame{Op: "nack", Sub: "s1", Id: "c1"})
+	// the second delivery is never acked and times out
+	if f := handler.next(); !f.Redelivered {
+		t.Fatalf("redelivery %+v", f)
+	}
+	reply := sender.next()
+	if reply.Op != "reply" || reply.Id != "c1" || reply.Error == "" {
+		t.Fatalf("reply %+v", reply)
+	}
+	if dead := b.DeadLetters(); len(dead) != 1 || dead[0].Id != "c1" {
+		t.Fatal(dead)
+	}
+}
+
+func TestBrokerMovesMessagesOffADisconnectedConsumer(t *testing.T) {
+	b := listenTestBroker(t)
+	gone := dialTestBroker(t, b)
+	gone.subscribe("event.Renamed", "read", "s1")
+	stays := dialTestBroker(t, b)
+	stays.subscribe("event.Renamed", "read", "s2")
+	producer := dialTestBroker(t, b)
+
+	producer.send(brokerFrame{Op: "publish", Topic: "event.Renamed", Id: "m1"})
+	producer.send(brokerFrame{Op: "publish", Topic: "event.Renamed", Id: "m2"})
+	if f := gone.next(); f.Id != "m1" {
+		t.Fatalf("%+v", f)
+	}
+	if f := stays.next(); f.Id != "m2" {
+		t.Fatalf("%+v", f)
+	}
+	stays.send(brokerFrame{Op: "ack", Sub: "s2", Id: "m2"})
+	gone.conn.Close()
+	if f := stays.next(); f.Id != "m1" || !f.Redelivered {
+		t.Fatalf("%+v", f)
+	}
+}
+
+func TestBrokerCutsOffAClientThatStopsReading(t *testing.T) {
+	b := listenTestBroker(t)
+	b.s.Lock()
+	b.OutboundBuffer = 16
+	b.s.Unlock()
+	handler := dialTestBroker(t, b)
+	handler.subscribe("command.Rename", commandGroup, "h")
+	go func() {
+		for f := range handler.frames {
+			handler.enc.Encode(brokerFrame{Op: "reply", Id: f.Id, Payload: f.Payload})
+			handler.enc.Encode(brokerFrame{Op: "ack", Sub: "h", Id: f.Id})
+		}
+	}()
+
+	// sends commands but never reads the replies
+	slow, err := net.Dial(b.Addr().Network(), b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	payload, _ := json.Marshal(strings.Repeat("x", 16*1024))
+	enc := json.NewEncoder(slow)
+	for i := 0; i < 1000; i++ {
+		if err := enc.Encode(brokerFrame{Op: "send", Topic: "command.Rename", Id: string(NewGuid()), Payload: payload, WantReply: true}); err != nil {
+			break // cut off
+		}
+	}
+
+	// the broker is not held up by the slow client, and still serves others
+	watcher := dialTestBroker(t, b)
+	watcher.subscribe("event.Renamed", "watch", "w")
+	watcher.send(brokerFrame{Op: "publish", Topic: "event.Renamed", Id: "m1"})
+	if f := watcher.next(); f.Id != "m1" {
+		t.Fatalf("%+v", f)
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		b.s.Lock()
+		connected := len(b.conns)
+		b.s.Unlock()
+		if connected == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slow client still connected, %v clients", connected)
+		}
+	}
+}
+
+func TestBrokerReplacesAConsumerSubscribedAgain(t *testing.T) {
+	b := listenTestBroker(t)
+	consumer := dialTestBroker(t, b)
+	consumer.subscribe("event.Renamed", "read", "s1")
+	consumer.subscribe("event.Renamed", "read", "s1")
+	producer := dialTestBroker(t, b)
+
+	producer.send(brokerFrame{Op: "publish", Topic: "event.Renamed", Id: "m1", Type: "Renamed"})
+	producer.send(brokerFrame{Op: "publish", Topic: "event.Renamed", Id: "m2", Type: "Renamed"})
+	if first := consumer.next(); first.Id != "m1" {
+		t.Fatalf("%+v", first)
+	}
+	// still one message in flight at a time
+	consumer.nothing(50 * time.Millisecond)
+	consumer.send(brokerFrame{Op: "ack", Sub: "s1", Id: "m1"})
+	if second := consumer.next(); second.Id != "m2" {
+		t.Fatalf("%+v", second)
+	}
+}
+
+func TestRemoteBusAnswersARedeliveredCommandWithTheOriginalResult(t *testing.T) {
+	b := listenTestBroker(t)
+	commands := NewInventoryCommandCodec()
+	bus, err := DialBroker("unix", b.Addr().String(), "test", commands, NewInventoryEventCodec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Stop(context.Background())
+	handled := 0
+	bus.SetCommandHandler(reflect.TypeOf(CheckInItemsToInventory{}), func(ctx context.Context, cmd Command) (Commit, error) {
+		handled++
+		return Commit{AggregateId: "a", Version: handled}, nil
+	})
+	if err := bus.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same command as the broker sends it when it is redelivered
+	name, data, err := commands.Encode(CheckInItemsToInventory{Idempotent: Idempotent{"k"}, InventoryItemId: "a", Count: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := dialTestBroker(t, b)
+	for _, id := range []string{"m1", "m2"} {
+		sender.send(brokerFrame{Op: "send", Topic: commandTopic(name), Id: id, Type: name, Payload: data, WantReply: true})
+		reply := sender.next()
+		var commit remoteCommit
+		if err := json.Unmarshal(reply.Payload, &commit); err != nil || reply.Error != "" || commit.Version != 1 {
+			t.Fatalf("%v: %+v %v", id, reply, err)
+		}
+	}
+	if handled != 1 {
+		t.Fatal("handled", handled, "times")
+	}
+}
+
+func TestRemoteBusSendsEachCommandWithAnIdempotencyKey(t *testing.T) {
+	b := listenTestBroker(t)
+	handler := dialTestBroker(t, b)
+	handler.subscribe("command.CheckInItemsToInventory", commandGroup, "s1")
+	commands := NewInventoryCommandCodec()
+	bus, err := DialBroker("unix", b.Addr().String(), "test", commands, NewInventoryEventCodec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bus.Stop(context.Background())
+
+	if err := bus.Dispatch(CheckInItemsToInventory{InventoryItemId: "a", Count: 2}, nil); err != nil {
+		t.Fatal(err)
+	}
+	f := handler.next()
+	cmd, err := commands.Decode(f.Type, f.Payload)
+	if err != nil || cmd.(IdempotentCommand).IdempotencyKey() != f.Id {
+		t.Fatalf("%+v %v", cmd, err)
+	}
+}
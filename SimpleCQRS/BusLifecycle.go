@@ -0,0 +1,170 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrBusStopped = errors.New("bus stopped")
+
+// IncompleteShutdownError is returned by Stop when its context ends before
+// the bus has drained. It lists the work that was given up on.
+type IncompleteShutdownError struct {
+	Commands []Command // queued, never handled
+	Events   []Event   // queued, never delivered (once per processor)
+	InFlight int       // handlers and processors still running
+}
+
+func (e *IncompleteShutdownError) Error() string {
+	return fmt.Sprintf("bus stopped without finishing %v commands, %v event deliveries and %v in flight",
+		len(e.Commands), len(e.Events), e.InFlight)
+}
+
+// gate lets callers in until it is closed, closing waits for the callers already inside
+type gate struct {
+	s      sync.Mutex
+	closed bool
+	inside int
+	left   *sync.Cond
+}
+
+func (g *gate) enter() bool {
+	g.s.Lock()
+	defer g.s.Unlock()
+
+	if g.closed {
+		return false
+	}
+	g.inside++
+	return true
+}
+
+func (g *gate) leave() {
+	g.s.Lock()
+	defer g.s.Unlock()
+
+	g.inside--
+	if g.inside == 0 && g.left != nil {
+		g.left.Broadcast()
+	}
+}
+
+func (g *gate) close() {
+	g.s.Lock()
+	defer g.s.Unlock()
+
+	g.closed = true
+	if g.left == nil {
+		g.left = sync.NewCond(&g.s)
+	}
+	for g.inside > 0 {
+		g.left.Wait()
+	}
+}
+
+// Start begins handling queued commands and delivering events. Commands can
+// be dispatched before Start, they wait in the queue.
+func (fb *FakeBus) Start() error {
+	fb.lifecycle.Lock()
+	defer fb.lifecycle.Unlock()
+
+	if fb.stopped {
+		return ErrBusStopped
+	}
+	if fb.started {
+		return nil
+	}
+	fb.started = true
+
+	fb.s.RLock()
+	defer fb.s.RUnlock()
+	for _, sub := range fb.subscriptions {
+		fb.startDeliveries(sub)
+	}
+	go fb.processCommands()
+	return nil
+}
+
+func (fb *FakeBus) startDeliveries(sub *eventSubscription) {
+	for i := 0; i < sub.concurrency; i++ {
+		fb.deliveries.Add(1)
+		go fb.deliverEvents(sub)
+	}
+}
+
+// Stop refuses new commands, then waits for the queued commands to be
+// handled and the events they raise to be delivered. If ctx ends first the
+// remaining work is abandoned and returned in an *IncompleteShutdownError.
+func (fb *FakeBus) Stop(ctx context.Context) error {
+	fb.lifecycle.Lock()
+	if fb.stopped {
+		fb.lifecycle.Unlock()
+		return nil
+	}
+	fb.stopped = true
+	started := fb.started
+	fb.lifecycle.Unlock()
+
+	fb.s.RLock()
+	subs := fb.subscriptions
+	fb.s.RUnlock()
+
+	drained := make(chan struct{})
+	go func() {
+		fb.commandIntake.close()
+		close(fb.commandQueue.items)
+		if started {
+			<-fb.commandsDone
+		}
+		fb.eventIntake.close()
+		for _, sub := range subs {
+			sub.close()
+		}
+		fb.deliveries.Wait()
+		close(drained)
+	}()
+
+	if started {
+		select {
+		case <-drained:
+			fb.abandon()
+			return nil
+		case <-ctx.Done():
+		}
+	}
+
+	fb.abandon()
+	incomplete := &IncompleteShutdownError{InFlight: int(fb.inFlight.Load())}
+	for _, cmdReq := range drainQueue(fb.commandQueue) {
+		incomplete.Commands = append(incomplete.Commands, cmdReq.cmd)
+		select {
+		case cmdReq.synchronousResponse <- CommandResult{Err: ErrBusStopped}:
+		default:
+		}
+	}
+	for _, sub := range subs {
+		incomplete.Events = append(incomplete.Events, drainQueue(sub.queue)...)
+	}
+	if len(incomplete.Commands) == 0 && len(incomplete.Events) == 0 && incomplete.InFlight == 0 {
+		return nil
+	}
+	return incomplete
+}
+
+// drainQueue empties whatever is left in an abandoned queue
+func drainQueue[T any](q *boundedQueue[T]) []T {
+	left := make([]T, 0)
+	for {
+		select {
+		case item, ok := <-q.items:
+			if !ok {
+				return left
+			}
+			left = append(left, item)
+		default:
+			return left
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeBusStopDrainsQueuedCommandsAndTheirEvents(t *testing.T) {
+	bus := NewFakeBus(false)
+	RegisterCommandHandler(bus, func(ctx context.Context, cmd CheckInItemsToInventory) (Commit, error) {
+		time.Sleep(time.Millisecond)
+		return Commit{}, bus.Publish(NewItemsCheckedInToInventory(cmd.InventoryItemId, cmd.Count))
+	})
+	var checkedIn atomic.Int64
+	RegisterEventProcessor(bus, func(evt ItemsCheckedInToInventory) error {
+		time.Sleep(time.Millisecond)
+		checkedIn.Add(int64(evt.Count()))
+		return nil
+	})
+	bus.Start()
+	for i := 0; i < 10; i++ {
+		if err := bus.Dispatch(CheckInItemsToInventory{InventoryItemId: "a", Count: 1}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := bus.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if checkedIn.Load() != 10 {
+		t.Fatal(checkedIn.Load())
+	}
+	if err := bus.Dispatch(CheckInItemsToInventory{InventoryItemId: "a", Count: 1}, nil); err != ErrBusStopped {
+		t.Fatal("dispatched after Stop", err)
+	}
+}
+
+func TestFakeBusStopListsTheWorkItGaveUpOn(t *testing.T) {
+	bus := NewFakeBus(false)
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{}, 1)
+	RegisterCommandHandler(bus, func(ctx context.Context, cmd CheckInItemsToInventory) (Commit, error) {
+		started <- struct{}{}
+		<-release
+		return Commit{}, nil
+	})
+	bus.Start()
+	results := make([]chan CommandResult, 3)
+	for i := range results {
+		results[i] = make(chan CommandResult, 1)
+		bus.Dispatch(CheckInItemsToInventory{InventoryItemId: "a", Count: i}, results[i])
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var incomplete *IncompleteShutdownError
+	if err := bus.Stop(ctx); !errors.As(err, &incomplete) {
+		t.Fatal(err)
+	}
+	if len(incomplete.Commands) != 2 || incomplete.InFlight != 1 {
+		t.Fatalf("%+v", incomplete)
+	}
+	// the commands never handled are answered
+	for _, result := range results[1:] {
+		if r := <-result; r.Err != ErrBusStopped {
+			t.Fatalf("%+v", r)
+		}
+	}
+}
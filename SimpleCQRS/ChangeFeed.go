@@ -0,0 +1,83 @@
+package SimpleCQRS
+
+import "sync"
+
+// ReadModelChange says a view of the read model has changed
+type ReadModelChange struct {
+	View    string // "list" or "details"
+	Id      Guid   // empty when the whole view changed, as after a rebuild
+	Version int
+}
+
+const (
+	ListView    = "list"
+	DetailsView = "details"
+)
+
+// ChangeFeed passes read model changes on to whoever is listening. A
+// subscriber that falls too far behind is dropped, its channel is closed
+// and it has to read the views again to catch up.
+type ChangeFeed struct {
+	subscribers map[int]chan ReadModelChange
+	next        int
+	closed      bool
+	s           sync.Mutex
+}
+
+func NewChangeFeed() *ChangeFeed {
+	return &ChangeFeed{subscribers: make(map[int]chan ReadModelChange)}
+}
+
+// Subscribe returns every change from now on, buffering up to buffer of
+// them, and a func to stop
+func (feed *ChangeFeed) Subscribe(buffer int) (<-chan ReadModelChange, func()) {
+	feed.s.Lock()
+	defer feed.s.Unlock()
+
+	changes := make(chan ReadModelChange, buffer)
+	if feed.closed {
+		close(changes)
+		return changes, func() {}
+	}
+	id := feed.next
+	feed.next++
+	feed.subscribers[id] = changes
+	return changes, func() { feed.drop(id) }
+}
+
+func (feed *ChangeFeed) drop(id int) {
+	feed.s.Lock()
+	defer feed.s.Unlock()
+
+	if changes, ok := feed.subscribers[id]; ok {
+		delete(feed.subscribers, id)
+		close(changes)
+	}
+}
+
+// Publish never blocks
+func (feed *ChangeFeed) Publish(change ReadModelChange) {
+	feed.s.Lock()
+	defer feed.s.Unlock()
+
+	for id, changes := range feed.subscribers {
+		select {
+		case changes <- change:
+		default:
+			delete(feed.subscribers, id)
+			close(changes)
+		}
+	}
+}
+
+// Close ends every subscription, later ones end straight away
+func (feed *ChangeFeed) Close() {
+	feed.s.Lock()
+	defer feed.s.Unlock()
+
+	feed.closed = true
+	for id, changes := range feed.subscribers {
+		delete(feed.subscribers, id)
+		close(changes)
+	}
+}
@@ -0,0 +1,54 @@
+package SimpleCQRS
+
+import "testing"
+
+func TestChangeFeedPassesOnReadModelChanges(t *testing.T) {
+	store := NewEventStore(discardEvents{})
+	db := NewBSDB()
+	rmf := NewReadModelFacade(&db)
+	rm := newInventoryReadModel(&db)
+	changes, stop := rmf.Changes().Subscribe(10)
+
+	created, _ := store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "bolts")}, -1)
+	rm.Process(created.Events[0])
+	seen := map[ReadModelChange]bool{<-changes: true, <-changes: true}
+	if !seen[ReadModelChange{ListView, "a", 0}] || !seen[ReadModelChange{DetailsView, "a", 0}] {
+		t.Fatal(seen)
+	}
+
+	// swapping in another read model changes every view
+	other := NewBSDB()
+	rmf.Use(&other)
+	if change := <-changes; change.Id != "" {
+		t.Fatalf("%+v", change)
+	}
+	<-changes
+	stop()
+	if _, ok := <-changes; ok {
+		t.Fatal("a change after stopping")
+	}
+}
+
+func TestChangeFeedDropsASubscriberThatFallsBehind(t *testing.T) {
+	feed := NewChangeFeed()
+	slow, _ := feed.Subscribe(1)
+	fast, _ := feed.Subscribe(10)
+	feed.Publish(ReadModelChange{View: ListView, Id: "a"})
+	feed.Publish(ReadModelChange{View: ListView, Id: "b"})
+
+	if change := <-slow; change.Id != "a" {
+		t.Fatalf("%+v", change)
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("still subscribed once behind")
+	}
+	if len(fast) != 2 {
+		t.Fatal(len(fast))
+	}
+
+	feed.Close()
+	later, _ := feed.Subscribe(1)
+	if _, ok := <-later; ok {
+		t.Fatal("subscribed once closed")
+	}
+}
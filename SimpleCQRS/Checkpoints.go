@@ -0,0 +1,87 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+)
+
+// CheckpointStore remembers the position each projection has processed up
+// to. Checkpoints have to live exactly as long as the state of the
+// projections they describe, so in memory projections use an in memory store.
+type CheckpointStore interface {
+	// Load returns 0 for a projection that has no checkpoint
+	Load(projection string) (int64, error)
+	Save(projection string, position int64) error
+}
+
+type inMemoryCheckpointStore struct {
+	positions map[string]int64
+	s         sync.RWMutex
+}
+
+func NewInMemoryCheckpointStore() CheckpointStore {
+	return &inMemoryCheckpointStore{positions: make(map[string]int64)}
+}
+
+func (store *inMemoryCheckpointStore) Load(projection string) (int64, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	return store.positions[projection], nil
+}
+
+func (store *inMemoryCheckpointStore) Save(projection string, position int64) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	store.positions[projection] = position
+	return nil
+}
+
+// fileCheckpointStore keeps every checkpoint in one JSON file
+type fileCheckpointStore struct {
+	path      string
+	positions map[string]int64
+	s         sync.Mutex
+}
+
+func NewFileCheckpointStore(path string) (CheckpointStore, error) {
+	store := &fileCheckpointStore{path: path, positions: make(map[string]int64)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.positions); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *fileCheckpointStore) Load(projection string) (int64, error) {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	return store.positions[projection], nil
+}
+
+func (store *fileCheckpointStore) Save(projection string, position int64) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	store.positions[projection] = position
+	data, err := json.Marshal(store.positions)
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a half written file behind
+	tmp := store.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.path)
+}
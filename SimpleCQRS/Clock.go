@@ -0,0 +1,81 @@
+package SimpleCQRS
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+var SystemClock Clock = systemClock{}
+
+// VirtualClock only moves when it is advanced, so code waiting on it can be
+// driven deterministically from tests
+type VirtualClock struct {
+	now     time.Time
+	waiters []virtualWaiter
+	s       sync.Mutex
+}
+
+type virtualWaiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (vc *VirtualClock) Now() time.Time {
+	vc.s.Lock()
+	defer vc.s.Unlock()
+
+	return vc.now
+}
+
+func (vc *VirtualClock) After(d time.Duration) <-chan time.Time {
+	vc.s.Lock()
+	defer vc.s.Unlock()
+
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- vc.now
+		return c
+	}
+	vc.waiters = append(vc.waiters, virtualWaiter{vc.now.Add(d), c})
+	return c
+}
+
+// Advance moves the clock forward, firing every waiter that falls due in order
+func (vc *VirtualClock) Advance(d time.Duration) {
+	vc.s.Lock()
+	defer vc.s.Unlock()
+
+	vc.now = vc.now.Add(d)
+	sort.SliceStable(vc.waiters, func(i, j int) bool {
+		return vc.waiters[i].at.Before(vc.waiters[j].at)
+	})
+	remaining := make([]virtualWaiter, 0, len(vc.waiters))
+	for _, w := range vc.waiters {
+		if w.at.After(vc.now) {
+			remaining = append(remaining, w)
+			continue
+		}
+		w.c <- w.at
+	}
+	vc.waiters = remaining
+}
@@ -0,0 +1,65 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// CommandCodec turns commands into bytes and back, so they can be stored or
+// sent elsewhere. Only registered command types can be decoded.
+type CommandCodec struct {
+	types map[string]reflect.Type
+	s     sync.RWMutex
+}
+
+func NewCommandCodec() *CommandCodec {
+	return &CommandCodec{types: make(map[string]reflect.Type)}
+}
+
+// NewInventoryCommandCodec knows about every inventory command
+func NewInventoryCommandCodec() *CommandCodec {
+	codec := NewCommandCodec()
+	RegisterCommandType[CreateInventoryItem](codec)
+	RegisterCommandType[DeactivateInventoryItem](codec)
+	RegisterCommandType[RenameInventoryItem](codec)
+	RegisterCommandType[CheckInItemsToInventory](codec)
+	RegisterCommandType[RemoveItemsFromInventory](codec)
+	RegisterCommandType[SetReorderPoint](codec)
+	return codec
+}
+
+func RegisterCommandType[C Command](codec *CommandCodec) {
+	codec.s.Lock()
+	defer codec.s.Unlock()
+
+	t := typeOf[C]()
+	codec.types[t.Name()] = t
+}
+
+func (codec *CommandCodec) Encode(cmd Command) (string, []byte, error) {
+	name := reflect.TypeOf(cmd).Name()
+	codec.s.RLock()
+	_, ok := codec.types[name]
+	codec.s.RUnlock()
+	if !ok {
+		return "", nil, fmt.Errorf("command type %T not registered", cmd)
+	}
+	data, err := json.Marshal(cmd)
+	return name, data, err
+}
+
+func (codec *CommandCodec) Decode(name string, data []byte) (Command, error) {
+	codec.s.RLock()
+	t, ok := codec.types[name]
+	codec.s.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("command type %v not registered", name)
+	}
+	cmd := reflect.New(t)
+	if err := json.Unmarshal(data, cmd.Interface()); err != nil {
+		return nil, err
+	}
+	return cmd.Elem().Interface(), nil
+}
@@ -1,7 +1,7 @@
 package SimpleCQRS
 
 import (
-	"time"
+	"context"
 )
 
 type InventoryCommandHandlers struct {
@@ -12,54 +12,67 @@ func NewInventoryCommandHandlers(repo InventoryItemRepository) InventoryCommandH
 	return InventoryCommandHandlers{repo}
 }
 
-func (r *InventoryCommandHandlers) HandleCreateInventoryItem(m Command) error {
-	message := m.(CreateInventoryItem)
+func (r *InventoryCommandHandlers) HandleCreateInventoryItem(ctx context.Context, message CreateInventoryItem) (Commit, error) {
 	item := NewInventoryItem(message.InventoryItemId, message.Name)
-	return r.repo.Save(item, -1)
+	return r.save(message, item, -1)
 }
 
-func (r *InventoryCommandHandlers) HandleDeactivateInventoryItem(m Command) error {
-	message := m.(DeactivateInventoryItem)
+func (r *InventoryCommandHandlers) HandleDeactivateInventoryItem(ctx context.Context, message DeactivateInventoryItem) (Commit, error) {
 	ar, _ := r.repo.GetById(message.InventoryItemId)
 	item := ar.(*InventoryItem)
 	err := item.Deactivate()
 	if err != nil {
-		return err
+		return Commit{}, err
 	}
-	return r.repo.Save(item, message.OriginalVersion)
+	return r.save(message, item, message.OriginalVersion)
 }
 
-func (r *InventoryCommandHandlers) HandleRemoveItemsFromInventory(m Command) error {
-	message := m.(RemoveItemsFromInventory)
+func (r *InventoryCommandHandlers) HandleRemoveItemsFromInventory(ctx context.Context, message RemoveItemsFromInventory) (Commit, error) {
 	ar, _ := r.repo.GetById(message.InventoryItemId)
 	item := ar.(*InventoryItem)
 	err := item.Remove(message.Count)
 	if err != nil {
-		return err
+		return Commit{}, err
 	}
-	return r.repo.Save(item, message.OriginalVersion)
+	return r.save(message, item, message.OriginalVersion)
 }
 
-func (r *InventoryCommandHandlers) HandleCheckInItemsToInventory(m Command) error {
-	message := m.(CheckInItemsToInventory)
+func (r *InventoryCommandHandlers) HandleCheckInItemsToInventory(ctx context.Context, message CheckInItemsToInventory) (Commit, error) {
 	ar, _ := r.repo.GetById(message.InventoryItemId)
 	item := ar.(*InventoryItem)
 	err := item.CheckIn(message.Count)
 	if err != nil {
-		return err
+		return Commit{}, err
 	}
-	return r.repo.Save(item, message.OriginalVersion)
+	return r.save(message, item, message.OriginalVersion)
 }
 
-func (r *InventoryCommandHandlers) HandleRenameInventoryItem(m Command) error {
-	message := m.(RenameInventoryItem)
+func (r *InventoryCommandHandlers) HandleRenameInventoryItem(ctx context.Context, message RenameInventoryItem) (Commit, error) {
 	ar, _ := r.repo.GetById(message.InventoryItemId)
 	item := ar.(*InventoryItem)
-	//time.Sleep(10 * time.Second) // Name changes take ages, not sure why
-	time.Sleep(2 * time.Millisecond) // This is short enough to be handled before my next HTTP request (i.e. it "looks" synchronous)
 	err := item.ChangeName(message.NewName)
 	if err != nil {
-		return err
+		return Commit{}, err
 	}
-	return r.repo.Save(item, message.OriginalVersion)
+	return r.save(message, item, message.OriginalVersion)
+}
+
+func (r *InventoryCommandHandlers) HandleSetReorderPoint(ctx context.Context, message SetReorderPoint) (Commit, error) {
+	ar, _ := r.repo.GetById(message.InventoryItemId)
+	item := ar.(*InventoryItem)
+	err := item.SetReorderPoint(message.ReorderPoint)
+	if err != nil {
+		return Commit{}, err
+	}
+	return r.save(message, item, message.OriginalVersion)
+}
+
+// save stamps the item's new events with the user that sent cmd
+func (r *InventoryCommandHandlers) save(cmd AttributedCommand, item AggregateRoot, expectedVersion int) (Commit, error) {
+	for _, evt := range item.GetUncommittedChanges() {
+		if ae, ok := evt.(AttributedEvent); ok {
+			ae.SaveUser(cmd.IssuedBy())
+		}
+	}
+	return r.repo.Save(item, expectedVersion)
 }
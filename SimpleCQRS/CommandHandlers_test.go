@@ -0,0 +1,33 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCommandHandlersReturnWhatTheyCommitted(t *testing.T) {
+	store := NewEventStore(discardEvents{})
+	handlers := NewInventoryCommandHandlers(InventoryItemRepository{store})
+	ctx := context.Background()
+
+	created, err := handlers.HandleCreateInventoryItem(ctx, CreateInventoryItem{InventoryItemId: "a", Name: "bolts"})
+	if err != nil || created.AggregateId != "a" || created.Version != 0 || created.Position != 1 || len(created.Events) != 1 {
+		t.Fatalf("%+v %v", created, err)
+	}
+	checkedIn, err := handlers.HandleCheckInItemsToInventory(ctx, CheckInItemsToInventory{Issued: Issued{"sam"}, InventoryItemId: "a", OriginalVersion: 0, Count: 5})
+	if err != nil || checkedIn.Version != 1 || checkedIn.Position != 2 {
+		t.Fatalf("%+v %v", checkedIn, err)
+	}
+	evt := checkedIn.Events[0].(ItemsCheckedInToInventory)
+	if evt.Version() != 1 || evt.Count() != 5 || evt.User() != "sam" {
+		t.Fatalf("%+v", evt)
+	}
+	if token := checkedIn.Token(); token != (ConsistencyToken{"a", 1}) {
+		t.Fatal(token)
+	}
+
+	// a stale version commits nothing
+	if stale, err := handlers.HandleCheckInItemsToInventory(ctx, CheckInItemsToInventory{InventoryItemId: "a", OriginalVersion: 0, Count: 1}); err == nil || stale.Version != 0 || len(stale.Events) != 0 {
+		t.Fatalf("%+v %v", stale, err)
+	}
+}
@@ -0,0 +1,256 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConsistencyToken identifies a write, a read model that has caught up with
+// the token reflects that write
+type ConsistencyToken struct {
+	AggregateId Guid
+	Version     int
+}
+
+func (c Commit) Token() ConsistencyToken {
+	return ConsistencyToken{c.AggregateId, c.Version}
+}
+
+func (t ConsistencyToken) IsZero() bool {
+	return t.AggregateId == ""
+}
+
+// String is the token in a form that can be passed around in a URL
+func (t ConsistencyToken) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return fmt.Sprintf("%v@%v", t.AggregateId, t.Version)
+}
+
+func ParseConsistencyToken(s string) (ConsistencyToken, error) {
+	if s == "" {
+		return ConsistencyToken{}, nil
+	}
+	i := strings.LastIndex(s, "@")
+	if i < 1 {
+		return ConsistencyToken{}, fmt.Errorf("consistency token %q is not id@version", s)
+	}
+	version, err := strconv.Atoi(s[i+1:])
+	if err != nil {
+		return ConsistencyToken{}, fmt.Errorf("consistency token %q is not id@version", s)
+	}
+	return ConsistencyToken{Guid(s[:i]), version}, nil
+}
+
+// EventGapError says a projection has been given events for an aggregate
+// that it cannot apply, because an earlier event has not arrived
+type EventGapError struct {
+	AggregateId Guid
+	Expected    int // the version the projection is waiting for
+	Buffered    int // how many later events are held until it arrives
+}
+
+func (e *EventGapError) Error() string {
+	return fmt.Sprintf("aggregate %v is missing version %v, %v later events are held back", e.AggregateId, e.Expected, e.Buffered)
+}
+
+// how many out of order events are held per aggregate before each new one is reported as a gap
+const maxHeldEvents = 16
+
+// how long events may be held before they are reported, and how often
+const heldReportInterval = 10 * time.Second
+
+// projectionProgress remembers the last version of each aggregate a
+// projection has processed, so readers can wait for it to catch up and
+// events are applied exactly once and in version order
+type projectionProgress struct {
+	versions  map[Guid]int
+	held      map[Guid]map[int]func() error // events that arrived ahead of an earlier one
+	heldSince map[Guid]time.Time            // when each aggregate's first held event arrived
+	reported  time.Time                     // when held events were last reported
+	touched   map[Guid]bool                 // aggregates processed since the last takeTouched
+	notify    func(id Guid, version int)    // told about each version as it is processed, must not block
+	changed   chan struct{}                 // closed and replaced whenever a version moves on
+	s         sync.Mutex
+}
+
+func newProjectionProgress() *projectionProgress {
+	return &projectionProgress{
+		versions:  make(map[Guid]int),
+		held:      make(map[Guid]map[int]func() error),
+		heldSince: make(map[Guid]time.Time),
+		touched:   make(map[Guid]bool),
+		changed:   make(chan struct{}),
+	}
+}
+
+// apply runs change for the event at version, unless it has been applied
+// already. An event that arrives before the one ahead of it is held and run
+// once the gap is filled, an *EventGapError is returned when too many are
+// held, and events held for long are printed as events arrive. Callers must
+// not apply events for the same aggregate concurrently.
+func (p *projectionProgress) apply(id Guid, version int, change func() error) error {
+	p.s.Lock()
+	defer p.reportHeld()
+	last := p.last(id)
+	if version > last+1 {
+		if p.held[id] == nil {
+			p.held[id] = make(map[int]func() error)
+			p.heldSince[id] = time.Now()
+		}
+		p.held[id][version] = change
+		held := len(p.held[id])
+		p.s.Unlock()
+		if held > maxHeldEvents {
+			return &EventGapError{id, last + 1, held}
+		}
+		return nil
+	}
+	p.s.Unlock()
+
+	if version > last {
+		if err := change(); err != nil {
+			return err
+		}
+		p.processed(id, version)
+	}
+	return p.applyHeld(id)
+}
+
+// applyHeld runs the held events that the gap has closed up to. One that
+// fails stays held, to be tried again when the aggregate's next event comes.
+func (p *projectionProgress) applyHeld(id Guid) error {
+	for {
+		p.s.Lock()
+		version := p.last(id) + 1
+		change, ok := p.held[id][version]
+		p.s.Unlock()
+		if !ok {
+			return nil
+		}
+
+		if err := change(); err != nil {
+			return fmt.Errorf("held version %v of %v: %w", version, id, err)
+		}
+		p.processed(id, version)
+
+		p.s.Lock()
+		delete(p.held[id], version)
+		if len(p.held[id]) == 0 {
+			delete(p.held, id)
+			delete(p.heldSince, id)
+		}
+		p.s.Unlock()
+	}
+}
+
+// last is the version of the aggregate processed last, -1 for none
+func (p *projectionProgress) last(id Guid) int {
+	last, ok := p.versions[id]
+	if !ok {
+		return -1
+	}
+	return last
+}
+
+// reportHeld prints the aggregates whose events have been held for too long
+func (p *projectionProgress) reportHeld() {
+	p.s.Lock()
+	defer p.s.Unlock()
+
+	now := time.Now()
+	if len(p.held) == 0 || now.Sub(p.reported) < heldReportInterval {
+		return
+	}
+	for id, since := range p.heldSince {
+		if now.Sub(since) >= heldReportInterval {
+			p.reported = now
+			Logger.Println("Holding", len(p.held[id]), "events for", id, "since", since.Format(time.RFC3339), "waiting for version", p.last(id)+1)
+		}
+	}
+}
+
+func (p *projectionProgress) processed(id Guid, version int) {
+	p.s.Lock()
+	defer p.s.Unlock()
+
+	if last, ok := p.versions[id]; ok && last >= version {
+		return
+	}
+	p.versions[id] = version
+	p.touched[id] = true
+	if p.notify != nil {
+		p.notify(id, version)
+	}
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (p *projectionProgress) notifyTo(notify func(id Guid, version int)) {
+	p.s.Lock()
+	defer p.s.Unlock()
+
+	p.notify = notify
+}
+
+// takeTouched returns the aggregates processed since it was last called
+func (p *projectionProgress) takeTouched() []Guid {
+	p.s.Lock()
+	defer p.s.Unlock()
+
+	ids := make([]Guid, 0, len(p.touched))
+	for id := range p.touched {
+		ids = append(ids, id)
+	}
+	p.touched = make(map[Guid]bool)
+	return ids
+}
+
+// touch gives back aggregates taken by takeTouched that were not saved after all
+func (p *projectionProgress) touch(ids []Guid) {
+	p.s.Lock()
+	defer p.s.Unlock()
+
+	for _, id := range ids {
+		p.touched[id] = true
+	}
+}
+
+func (p *projectionProgress) MarshalJSON() ([]byte, error) {
+	p.s.Lock()
+	defer p.s.Unlock()
+
+	return json.Marshal(p.versions)
+}
+
+func (p *projectionProgress) UnmarshalJSON(data []byte) error {
+	p.s.Lock()
+	defer p.s.Unlock()
+
+	return json.Unmarshal(data, &p.versions)
+}
+
+// wait returns once the token has been processed, or ErrProjectionBehind when ctx ends first
+func (p *projectionProgress) wait(ctx context.Context, token ConsistencyToken) error {
+	for {
+		p.s.Lock()
+		last, ok := p.versions[token.AggregateId]
+		changed := p.changed
+		p.s.Unlock()
+
+		if ok && last >= token.Version {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ErrProjectionBehind
+		}
+	}
+}
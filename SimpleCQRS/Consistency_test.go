@@ -0,0 +1,82 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestProjectionProgressAppliesEachVersionOnceAndInOrder(t *testing.T) {
+	p := newProjectionProgress()
+	applied := make([]int, 0)
+	apply := func(version int) error {
+		return p.apply("a", version, func() error {
+			applied = append(applied, version)
+			return nil
+		})
+	}
+
+	for _, version := range []int{0, 2, 3, 0, 1, 2, 4} {
+		if err := apply(version); err != nil {
+			t.Fatal(version, err)
+		}
+	}
+	if !reflect.DeepEqual(applied, []int{0, 1, 2, 3, 4}) {
+		t.Fatal(applied)
+	}
+	if p.last("a") != 4 || len(p.held) != 0 || len(p.heldSince) != 0 {
+		t.Fatal(p.versions, p.held)
+	}
+}
+
+func TestProjectionProgressReportsAGapOnceTooManyAreHeld(t *testing.T) {
+	p := newProjectionProgress()
+	for version := 1; version <= maxHeldEvents; version++ {
+		if err := p.apply("a", version, func() error { return nil }); err != nil {
+			t.Fatal(version, err)
+		}
+	}
+	var gap *EventGapError
+	if err := p.apply("a", maxHeldEvents+1, func() error { return nil }); !errors.As(err, &gap) {
+		t.Fatal(err)
+	}
+	if gap.Expected != 0 || gap.Buffered != maxHeldEvents+1 {
+		t.Fatalf("%+v", gap)
+	}
+
+	if err := p.apply("a", 0, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if p.last("a") != maxHeldEvents+1 || len(p.held) != 0 {
+		t.Fatal(p.versions, p.held)
+	}
+}
+
+func TestProjectionProgressKeepsAFailedHeldEventToTryAgain(t *testing.T) {
+	p := newProjectionProgress()
+	fail := true
+	applied := make([]int, 0)
+	p.apply("a", 1, func() error {
+		if fail {
+			return errors.New("boom")
+		}
+		applied = append(applied, 1)
+		return nil
+	})
+
+	if err := p.apply("a", 0, func() error { applied = append(applied, 0); return nil }); err == nil {
+		t.Fatal("held version 1 failed without an error")
+	}
+	if p.last("a") != 0 || len(p.held["a"]) != 1 {
+		t.Fatal(p.versions, p.held)
+	}
+
+	// the next delivery of any version of the aggregate tries it again
+	fail = false
+	if err := p.apply("a", 0, func() error { t.Fatal("applied version 0 twice"); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(applied, []int{0, 1}) || p.last("a") != 1 || len(p.held) != 0 {
+		t.Fatal(applied, p.versions, p.held)
+	}
+}
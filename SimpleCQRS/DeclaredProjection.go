@@ -0,0 +1,173 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// DeclaredProjection is a projection of state S that only declares how each
+// event it handles changes that state, e.g.
+//
+//	view := NewDeclaredProjection(counts, nil)
+//	ProjectWith(view, func(counts map[Guid]int, evt ItemsCheckedInToInventory) error {
+//		counts[evt.Id()] += evt.Count()
+//		return nil
+//	})
+//
+// It does the rest. Each event is applied under the lock, once, and in
+// version order for its aggregate. It is a Projection, so a ProjectionRunner
+// can checkpoint and replay it, or it can be fed straight from the bus
+// through Subscribe.
+type DeclaredProjection[S any] struct {
+	state    S
+	handlers map[reflect.Type]func(state S, evt Event) error
+	lock     sync.Locker
+	progress *projectionProgress
+}
+
+// NewDeclaredProjection projects onto state. Projections sharing a state
+// share its lock, a nil lock gives the projection its own.
+func NewDeclaredProjection[S any](state S, lock sync.Locker) *DeclaredProjection[S] {
+	return newDeclaredProjection(state, lock, nil)
+}
+
+// newDeclaredProjection is NewDeclaredProjection tracking versions in
+// progress, so views of one state can share it. A nil progress gives the
+// projection its own.
+func newDeclaredProjection[S any](state S, lock sync.Locker, progress *projectionProgress) *DeclaredProjection[S] {
+	if lock == nil {
+		lock = &sync.Mutex{}
+	}
+	if progress == nil {
+		progress = newProjectionProgress()
+	}
+	return &DeclaredProjection[S]{
+		state:    state,
+		handlers: make(map[reflect.Type]func(state S, evt Event) error),
+		lock:     lock,
+		progress: progress,
+	}
+}
+
+// ProjectWith declares how an event of type E changes the state
+func ProjectWith[E AggregateEvent, S any](p *DeclaredProjection[S], apply func(state S, evt E) error) {
+	p.handlers[typeOf[E]()] = func(state S, evt Event) error {
+		return apply(state, evt.(E))
+	}
+}
+
+// Subscribe feeds the projection every event, not only those it declares,
+// so it sees each aggregate's versions without gaps
+func (p *DeclaredProjection[S]) Subscribe(s EventSubscriber) (func(), error) {
+	return s.SubscribeEvents(EventFilter{}, p.Process)
+}
+
+// Process counts events the projection has not declared towards their
+// aggregate's version, without changing the state
+func (p *DeclaredProjection[S]) Process(evt Event) error {
+	ae, ok := evt.(AggregateEvent)
+	if !ok {
+		return nil
+	}
+	apply, ok := p.handlers[reflect.TypeOf(evt)]
+	if !ok {
+		apply = func(state S, evt Event) error { return nil }
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.progress.apply(ae.Id(), ae.Version(), func() error {
+		return apply(p.state, evt)
+	})
+}
+
+// Skip counts an event that could not be applied towards its aggregate's
+// version, so the events after it are not held back waiting for it
+func (p *DeclaredProjection[S]) Skip(evt Event) error {
+	ae, ok := evt.(AggregateEvent)
+	if !ok {
+		return nil
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.progress.apply(ae.Id(), ae.Version(), func() error { return nil })
+}
+
+func (p *DeclaredProjection[S]) State() S {
+	return p.state
+}
+
+// WaitFor blocks until the projection has applied the event token stands
+// for, or ctx ends
+func (p *DeclaredProjection[S]) WaitFor(ctx context.Context, token ConsistencyToken) error {
+	if token.IsZero() {
+		return nil
+	}
+	return p.progress.wait(ctx, token)
+}
+
+// View is a Projection readers can wait on
+type View interface {
+	Projection
+	WaitFor(ctx context.Context, token ConsistencyToken) error
+}
+
+// Swappable is what readers see a view through, a rebuild swaps the view
+// underneath it
+type Swappable[V View] struct {
+	name    string
+	newView func() V
+	view    atomic.Value
+	swapped func(old, view V)
+}
+
+// NewSwappable starts with an empty view from newView, and is added to a
+// ProjectionRunner as name through Definition
+func NewSwappable[V View](name string, newView func() V) *Swappable[V] {
+	sw := &Swappable[V]{name: name, newView: newView}
+	sw.view.Store(newView())
+	return sw
+}
+
+// OnSwap calls swapped with the view in use and the one replacing it each
+// time a view is put in use, the view in use now included
+func (sw *Swappable[V]) OnSwap(swapped func(old, view V)) {
+	sw.swapped = swapped
+	swapped(sw.Load(), sw.Load())
+}
+
+// Use answers every later read from view
+func (sw *Swappable[V]) Use(view V) {
+	old := sw.view.Swap(view).(V)
+	if sw.swapped != nil {
+		sw.swapped(old, view)
+	}
+}
+
+// Load is the view in use
+func (sw *Swappable[V]) Load() V {
+	return sw.view.Load().(V)
+}
+
+func (sw *Swappable[V]) WaitFor(ctx context.Context, token ConsistencyToken) error {
+	return sw.Load().WaitFor(ctx, token)
+}
+
+// Definition builds a new view for each rebuild and puts it in use once
+// it has caught up
+func (sw *Swappable[V]) Definition() ProjectionDefinition {
+	return ProjectionDefinition{
+		Name: sw.name,
+		New: func() (Projection, error) {
+			return sw.newView(), nil
+		},
+		Activate: func(p Projection) {
+			sw.Use(p.(V))
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func versioned(evt AggregateEvent, version int) AggregateEvent {
+	evt.SaveVersion(version)
+	return evt
+}
+
+func countsProjection() *DeclaredProjection[map[Guid]int] {
+	view := NewDeclaredProjection(make(map[Guid]int), nil)
+	ProjectWith(view, func(counts map[Guid]int, evt ItemsCheckedInToInventory) error {
+		counts[evt.Id()] += evt.Count()
+		return nil
+	})
+	ProjectWith(view, func(counts map[Guid]int, evt ItemsRemovedFromInventory) error {
+		counts[evt.Id()] -= evt.Count()
+		return nil
+	})
+	return view
+}
+
+func TestDeclaredProjectionRoutesEachEventToItsDeclaration(t *testing.T) {
+	view := countsProjection()
+	events := []AggregateEvent{
+		versioned(NewInventoryItemCreated("a", "bolts"), 0),
+		versioned(NewItemsCheckedInToInventory("a", 5), 1),
+		versioned(NewInventoryItemRenamed("a", "nuts"), 2),
+		versioned(NewItemsRemovedFromInventory("a", 2), 3),
+	}
+	// the undeclared rename still counts, so version 3 is not held back
+	for _, evt := range events {
+		if err := view.Process(evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if view.State()["a"] != 3 {
+		t.Fatal(view.State())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := view.WaitFor(ctx, ConsistencyToken{"a", 3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := view.WaitFor(ctx, ConsistencyToken{"a", 4}); err == nil {
+		t.Fatal("waited for a version not yet applied")
+	}
+}
+
+func TestSwappableAnswersFromTheViewInUse(t *testing.T) {
+	sw := NewSwappable("counts", countsProjection)
+	swaps := 0
+	sw.OnSwap(func(old, view *DeclaredProjection[map[Guid]int]) { swaps++ })
+	first := sw.Load()
+	first.Process(versioned(NewItemsCheckedInToInventory("a", 5), 0))
+
+	def := sw.Definition()
+	rebuilt, _ := def.New()
+	if rebuilt == first || sw.Load() != first {
+		t.Fatal("rebuild in use before it was activated")
+	}
+	rebuilt.Process(versioned(NewItemsCheckedInToInventory("a", 7), 0))
+	def.Activate(rebuilt)
+	if sw.Load().State()["a"] != 7 || swaps != 2 {
+		t.Fatal(sw.Load().State(), swaps)
+	}
+	if err := sw.WaitFor(context.Background(), ConsistencyToken{"a", 0}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -117,6 +117,17 @@ func (ii *InventoryItem) CheckIn(count int) error {
 	return nil
 }
 
+func (ii *InventoryItem) SetReorderPoint(reorderPoint int) error {
+	if reorderPoint < 0 {
+		return errors.New("reorder point cannot be negative")
+	}
+	if !ii.activated {
+		return errors.New("cannot set the reorder point of a deactivated item")
+	}
+	ii.ApplyChange(NewReorderPointSet(ii.id, reorderPoint))
+	return nil
+}
+
 func (ii *InventoryItem) Deactivate() error {
 	if !ii.activated {
 		return errors.New("already deactivated")
@@ -137,7 +148,7 @@ func (ii *InventoryItem) handleEvent(event Event) error {
 }
 
 type Repository interface {
-	Save(ar AggregateRoot, expectedVersion int) error
+	Save(ar AggregateRoot, expectedVersion int) (Commit, error)
 	GetById(id Guid) (AggregateRoot, error)
 }
 
@@ -145,7 +156,7 @@ type InventoryItemRepository struct {
 	Storage EventStore
 }
 
-func (repo *InventoryItemRepository) Save(ar AggregateRoot, expectedVersion int) error {
+func (repo *InventoryItemRepository) Save(ar AggregateRoot, expectedVersion int) (Commit, error) {
 	return repo.Storage.SaveEvents(ar.Id(),
 		ar.GetUncommittedChanges(),
 		expectedVersion)
@@ -0,0 +1,161 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// EventCodec turns events into bytes and back. Events keep their fields
+// private, so each type is registered with a conversion to and from a plain
+// data struct that can be marshalled.
+type EventCodec struct {
+	types map[string]eventCoding
+	s     sync.RWMutex
+}
+
+type eventCoding struct {
+	encode func(evt Event) (interface{}, error)
+	decode func(data []byte) (Event, error)
+}
+
+type encodedEvent struct {
+	Version  int
+	Position int64 `json:",omitempty"`
+	Time     time.Time
+	User     string `json:",omitempty"`
+	Data     json.RawMessage
+}
+
+func NewEventCodec() *EventCodec {
+	return &EventCodec{types: make(map[string]eventCoding)}
+}
+
+type inventoryEventData struct {
+	Id           Guid
+	Name         string `json:",omitempty"`
+	Count        int    `json:",omitempty"`
+	ReorderPoint int    `json:",omitempty"`
+}
+
+// NewInventoryEventCodec knows about every inventory event
+func NewInventoryEventCodec() *EventCodec {
+	codec := NewEventCodec()
+	RegisterEventType(codec,
+		func(e InventoryItemCreated) inventoryEventData { return inventoryEventData{Id: e.Id(), Name: e.Name()} },
+		func(d inventoryEventData) InventoryItemCreated { return NewInventoryItemCreated(d.Id, d.Name) })
+	RegisterEventType(codec,
+		func(e InventoryItemDeactivated) inventoryEventData { return inventoryEventData{Id: e.Id()} },
+		func(d inventoryEventData) InventoryItemDeactivated { return NewInventoryItemDeactivated(d.Id) })
+	RegisterEventType(codec,
+		func(e InventoryItemRenamed) inventoryEventData {
+			return inventoryEventData{Id: e.Id(), Name: e.NewName()}
+		},
+		func(d inventoryEventData) InventoryItemRenamed { return NewInventoryItemRenamed(d.Id, d.Name) })
+	RegisterEventType(codec,
+		func(e ItemsCheckedInToInventory) inventoryEventData {
+			return inventoryEventData{Id: e.Id(), Count: e.Count()}
+		},
+		func(d inventoryEventData) ItemsCheckedInToInventory {
+			return NewItemsCheckedInToInventory(d.Id, d.Count)
+		})
+	RegisterEventType(codec,
+		func(e ItemsRemovedFromInventory) inventoryEventData {
+			return inventoryEventData{Id: e.Id(), Count: e.Count()}
+		},
+		func(d inventoryEventData) ItemsRemovedFromInventory {
+			return NewItemsRemovedFromInventory(d.Id, d.Count)
+		})
+	RegisterEventType(codec,
+		func(e ReorderPointSet) inventoryEventData {
+			return inventoryEventData{Id: e.Id(), ReorderPoint: e.ReorderPoint()}
+		},
+		func(d inventoryEventData) ReorderPointSet {
+			return NewReorderPointSet(d.Id, d.ReorderPoint)
+		})
+	return codec
+}
+
+// RegisterEventType teaches the codec about E, using D as its wire format.
+// The event's version, position, time and user travel alongside D.
+func RegisterEventType[E Event, D any](codec *EventCodec, toData func(evt E) D, fromData func(data D) E) {
+	codec.s.Lock()
+	defer codec.s.Unlock()
+
+	codec.types[typeOf[E]().Name()] = eventCoding{
+		encode: func(evt Event) (interface{}, error) {
+			return toData(evt.(E)), nil
+		},
+		decode: func(data []byte) (Event, error) {
+			var d D
+			if err := json.Unmarshal(data, &d); err != nil {
+				return nil, err
+			}
+			return fromData(d), nil
+		},
+	}
+}
+
+func (codec *EventCodec) Encode(evt Event) (string, []byte, error) {
+	name := reflect.TypeOf(evt).Name()
+	codec.s.RLock()
+	coding, ok := codec.types[name]
+	codec.s.RUnlock()
+	if !ok {
+		return "", nil, fmt.Errorf("event type %T not registered", evt)
+	}
+
+	d, err := coding.encode(evt)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		return "", nil, err
+	}
+	var position int64
+	if pe, ok := evt.(PositionedEvent); ok {
+		position = pe.Position()
+	}
+	var t time.Time
+	if te, ok := evt.(TimedEvent); ok {
+		t = te.Time()
+	}
+	var user string
+	if ae, ok := evt.(AttributedEvent); ok {
+		user = ae.User()
+	}
+	encoded, err := json.Marshal(encodedEvent{evt.Version(), position, t, user, data})
+	return name, encoded, err
+}
+
+func (codec *EventCodec) Decode(name string, data []byte) (Event, error) {
+	codec.s.RLock()
+	coding, ok := codec.types[name]
+	codec.s.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("event type %v not registered", name)
+	}
+
+	var encoded encodedEvent
+	if err := json.Unmarshal(data, &encoded); err != nil {
+		return nil, err
+	}
+	evt, err := coding.decode(encoded.Data)
+	if err != nil {
+		return nil, err
+	}
+	evt.SaveVersion(encoded.Version)
+	if pe, ok := evt.(PositionedEvent); ok {
+		pe.SavePosition(encoded.Position)
+	}
+	if te, ok := evt.(TimedEvent); ok {
+		te.SaveTime(encoded.Time)
+	}
+	if ae, ok := evt.(AttributedEvent); ok {
+		ae.SaveUser(encoded.User)
+	}
+	return evt, nil
+}
@@ -2,63 +2,133 @@ package SimpleCQRS
 
 import (
 	"fmt"
+	"sync"
 )
 
 type EventStore interface {
-	SaveEvents(aggregateId Guid, events []Event, expectedVersion int) error
+	SaveEvents(aggregateId Guid, events []Event, expectedVersion int) (Commit, error)
 	GetEventsForAggregate(aggregateId Guid) ([]Event, error)
+	// Head is the position of the last event saved, 0 before any are
+	Head() int64
+	// ReadAll returns up to max events saved after the given position, in the order they were saved
+	ReadAll(after int64, max int) ([]Event, error)
+}
+
+// Commit describes events saved together for one aggregate
+type Commit struct {
+	AggregateId Guid
+	Version     int     // the aggregate's version after the commit
+	Position    int64   // the store wide position of the last event, positions start at 1
+	Events      []Event // with their versions set
 }
 
 type es struct {
 	publisher EventPublisher
 	current   map[Guid][]EventDescriptor
+	all       []EventDescriptor // every event, in position order
+	position  int64
+	clock     Clock
+	s         sync.RWMutex
 }
 
 func NewEventStore(p EventPublisher) EventStore {
-	return &es{p, make(map[Guid][]EventDescriptor)}
+	return NewEventStoreWithClock(p, SystemClock)
+}
+
+// NewEventStoreWithClock stamps events with the time on clock as they are saved
+func NewEventStoreWithClock(p EventPublisher, clock Clock) EventStore {
+	return &es{publisher: p, current: make(map[Guid][]EventDescriptor), all: make([]EventDescriptor, 0), clock: clock}
 }
 
 type EventDescriptor struct {
-	data    Event
-	id      Guid
-	version int
+	data     Event
+	id       Guid
+	version  int
+	position int64
 }
 
-func (e *es) SaveEvents(aggregateId Guid, events []Event, expectedVersion int) error {
-	eventDescriptors, ok := e.current[aggregateId]
+func (e *es) SaveEvents(aggregateId Guid, events []Event, expectedVersion int) (Commit, error) {
+	commit, err := e.save(aggregateId, events, expectedVersion, nil)
+	if err != nil {
+		return Commit{}, err
+	}
 
-	if !ok {
-		eventDescriptors = make([]EventDescriptor, 0)
-		e.current[aggregateId] = eventDescriptors
-	} else if expectedVersion != -1 {
+	// publish the committed events to the bus for further processing by subscribers,
+	// anything reacting to them can already read them back from the store
+	for _, event := range events {
+		e.publisher.Publish(event)
+	}
+
+	return commit, nil
+}
+
+// save checks the expected version and numbers the events, then keeps them
+// once write, if there is one, has stored them
+func (e *es) save(aggregateId Guid, events []Event, expectedVersion int, write func(eds []EventDescriptor) error) (Commit, error) {
+	e.s.Lock()
+	defer e.s.Unlock()
+
+	eventDescriptors, ok := e.current[aggregateId]
+	if ok && expectedVersion != -1 {
 		lastEvent := eventDescriptors[len(eventDescriptors)-1]
 		if lastEvent.data.Version() != expectedVersion {
-			return fmt.Errorf("concurrency error, expected version %v, but found %v", expectedVersion, lastEvent.data.Version())
+			return Commit{}, fmt.Errorf("concurrency error, expected version %v, but found %v", expectedVersion, lastEvent.data.Version())
 		}
 	}
 
 	i := expectedVersion
+	position := e.position
+	now := e.clock.Now()
 
 	// iterate through current aggregate events increasing version with each processed even
+	saved := make([]EventDescriptor, 0, len(events))
 	for _, event := range events {
 		i++
+		position++
 		event.SaveVersion(i)
+		if pe, ok := event.(PositionedEvent); ok {
+			pe.SavePosition(position)
+		}
+		if te, ok := event.(TimedEvent); ok {
+			te.SaveTime(now)
+		}
+		saved = append(saved, EventDescriptor{data: event, id: aggregateId, version: i, position: position})
+	}
+	if write != nil {
+		if err := write(saved); err != nil {
+			return Commit{}, err
+		}
+	}
 
-		ed := EventDescriptor{data: event, id: aggregateId, version: i}
-		// push event to the event descriptors list for current aggregate
-		eventDescriptors = append(eventDescriptors, ed)
+	// push the events to the event descriptors list for current aggregate
+	e.current[aggregateId] = append(eventDescriptors, saved...)
+	e.all = append(e.all, saved...)
+	e.position = position
+	return Commit{AggregateId: aggregateId, Version: i, Position: position, Events: events}, nil
+}
 
-		// publish current event to the bus for further processing by subscribers
-		e.publisher.Publish(event)
-	}
-	e.current[aggregateId] = eventDescriptors
+// load keeps an event that was saved already, with its version and position
+func (e *es) load(aggregateId Guid, event Event) error {
+	e.s.Lock()
+	defer e.s.Unlock()
 
+	pe, ok := event.(PositionedEvent)
+	if !ok || pe.Position() != e.position+1 {
+		return fmt.Errorf("event %T for %v is out of order after position %v", event, aggregateId, e.position)
+	}
+	ed := EventDescriptor{data: event, id: aggregateId, version: event.Version(), position: pe.Position()}
+	e.current[aggregateId] = append(e.current[aggregateId], ed)
+	e.all = append(e.all, ed)
+	e.position = ed.position
 	return nil
 }
 
 // collect all processed events for given aggregate and return them as a list
 // used to build up an aggregate from its history (Domain.LoadsFromHistory)
 func (e *es) GetEventsForAggregate(aggregateId Guid) ([]Event, error) {
+	e.s.RLock()
+	defer e.s.RUnlock()
+
 	eventDescriptors, ok := e.current[aggregateId]
 
 	if !ok {
@@ -72,3 +142,25 @@ func (e *es) GetEventsForAggregate(aggregateId Guid) ([]Event, error) {
 
 	return events, nil
 }
+
+func (e *es) Head() int64 {
+	e.s.RLock()
+	defer e.s.RUnlock()
+
+	return e.position
+}
+
+func (e *es) ReadAll(after int64, max int) ([]Event, error) {
+	e.s.RLock()
+	defer e.s.RUnlock()
+
+	// positions start at 1 and have no gaps, so the position is the index of the next event
+	if after < 0 {
+		after = 0
+	}
+	events := make([]Event, 0)
+	for i := after; i < int64(len(e.all)) && len(events) < max; i++ {
+		events = append(events, e.all[i].data)
+	}
+	return events, nil
+}
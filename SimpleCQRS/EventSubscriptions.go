@@ -0,0 +1,108 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+var ErrAlreadySubscribed = errors.New("processor already registered for those events")
+
+// EventFilter picks the events a subscription receives. Every field that is
+// set has to match, so the zero EventFilter receives every event, e.g.
+//
+//	EventFilter{}                                     everything, for an audit log
+//	EventFilter{Names: "Items*"}                      ItemsCheckedInToInventory and ItemsRemovedFromInventory
+//	EventFilter{Category: InventoryItemCategory}      every inventory item event
+//	EventFilter{Aggregate: id}                        everything that happens to one item
+type EventFilter struct {
+	Types     []reflect.Type
+	Names     string // a path.Match pattern for the event type's name
+	Category  string // see CategorizedEvent
+	Aggregate Guid   // see AggregateEvent
+}
+
+func (f EventFilter) validate() error {
+	if _, err := path.Match(f.Names, ""); err != nil {
+		return fmt.Errorf("event name pattern %q: %v", f.Names, err)
+	}
+	return nil
+}
+
+func (f EventFilter) Matches(evt Event) bool {
+	t := reflect.TypeOf(evt)
+	if len(f.Types) > 0 {
+		found := false
+		for _, ft := range f.Types {
+			found = found || ft == t
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Names != "" {
+		if ok, _ := path.Match(f.Names, t.Name()); !ok {
+			return false
+		}
+	}
+	if f.Category != "" {
+		ce, ok := evt.(CategorizedEvent)
+		if !ok || ce.Category() != f.Category {
+			return false
+		}
+	}
+	if f.Aggregate != "" {
+		ae, ok := evt.(AggregateEvent)
+		if !ok || ae.Id() != f.Aggregate {
+			return false
+		}
+	}
+	return true
+}
+
+func (f EventFilter) String() string {
+	parts := make([]string, 0)
+	for _, t := range f.Types {
+		parts = append(parts, t.Name())
+	}
+	if f.Names != "" {
+		parts = append(parts, f.Names)
+	}
+	if f.Category != "" {
+		parts = append(parts, "category "+f.Category)
+	}
+	if f.Aggregate != "" {
+		parts = append(parts, "aggregate "+string(f.Aggregate))
+	}
+	if len(parts) == 0 {
+		return "*"
+	}
+	return strings.Join(parts, ",")
+}
+
+// sameProcessor is true when a and b are the same top level function, such
+// as a handler subscribed twice. Funcs cannot be compared in Go, and
+// closures and method values made from the same code can still be different
+// processors, so those are never taken to be the same.
+func sameProcessor(a, b EventProcessor) bool {
+	pc := reflect.ValueOf(a).Pointer()
+	if pc != reflect.ValueOf(b).Pointer() {
+		return false
+	}
+	fn := runtime.FuncForPC(pc)
+	return fn != nil && !closureName.MatchString(fn.Name())
+}
+
+// closureName matches the names the runtime gives closures and method values
+var closureName = regexp.MustCompile(`\.func\d+|-fm$`)
+
+// EventSubscriber subscribes processors to whatever events match a filter.
+// Calling unsubscribe stops further deliveries, events already on their way
+// to the processor are discarded.
+type EventSubscriber interface {
+	SubscribeEvents(filter EventFilter, processor EventProcessor) (unsubscribe func(), err error)
+}
@@ -0,0 +1,56 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func countRenames(evt Event) error { return nil }
+
+func TestSubscribingTheSameProcessorTwiceFails(t *testing.T) {
+	renamed := reflect.TypeOf(InventoryItemRenamed{})
+	broker := listenTestBroker(t)
+	remote, err := DialBroker("unix", broker.Addr().String(), "test", NewInventoryCommandCodec(), NewInventoryEventCodec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Stop(context.Background())
+	buses := map[string]interface {
+		EventProcessorRegistry
+		EventSubscriber
+	}{
+		"fake":      NewFakeBus(false),
+		"simulated": NewSimulatedBus(1, FaultProfile{}, NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))),
+		"remote":    remote,
+	}
+	for name, bus := range buses {
+		if err := bus.AddEventProcessor(renamed, countRenames); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := bus.AddEventProcessor(renamed, countRenames); !errors.Is(err, ErrAlreadySubscribed) {
+			t.Fatalf("%v: subscribed twice, %v", name, err)
+		}
+		// the same processor for other events, and other processors for the same ones, are fine
+		if _, err := bus.SubscribeEvents(EventFilter{Names: "Items*"}, countRenames); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := bus.AddEventProcessor(renamed, func(evt Event) error { return nil }); err != nil {
+			t.Fatal(name, err)
+		}
+		if err := RegisterEventProcessor(bus, func(evt InventoryItemRenamed) error { return nil }); err != nil {
+			t.Fatal(name, err)
+		}
+		// closures made from the same code are told apart by what they
+		// capture, which cannot be compared, so they are never taken to be
+		// the same
+		for i := 0; i < 2; i++ {
+			counted := 0
+			if err := bus.AddEventProcessor(renamed, func(evt Event) error { counted++; return nil }); err != nil {
+				t.Fatal(name, i, err)
+			}
+		}
+	}
+}
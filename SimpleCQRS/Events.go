@@ -1,12 +1,54 @@
 package SimpleCQRS
 
+import "time"
+
 type Event interface {
 	Version() int
 	SaveVersion(v int)
 }
 
+// AggregateEvent is an Event raised by the aggregate identified by Id
+type AggregateEvent interface {
+	Event
+	Id() Guid
+}
+
+// CategorizedEvent is an Event that belongs to a stream category, usually
+// the kind of aggregate that raised it
+type CategorizedEvent interface {
+	Event
+	Category() string
+}
+
+const InventoryItemCategory = "InventoryItem"
+
+// PositionedEvent is an Event that knows where it was saved in the event
+// store, positions increase across all aggregates
+type PositionedEvent interface {
+	Event
+	Position() int64
+	SavePosition(p int64)
+}
+
+// AttributedEvent is an Event that knows which user caused it, if anyone did
+type AttributedEvent interface {
+	Event
+	User() string
+	SaveUser(u string)
+}
+
+// TimedEvent is an Event that knows when it was saved in the event store
+type TimedEvent interface {
+	Event
+	Time() time.Time
+	SaveTime(t time.Time)
+}
+
 type BaseEvent struct {
-	version int
+	version  int
+	position int64
+	time     time.Time
+	user     string
 }
 
 func (e *BaseEvent) Version() int {
@@ -17,6 +59,30 @@ func (e *BaseEvent) SaveVersion(v int) {
 	e.version = v
 }
 
+func (e *BaseEvent) Position() int64 {
+	return e.position
+}
+
+func (e *BaseEvent) SavePosition(p int64) {
+	e.position = p
+}
+
+func (e *BaseEvent) Time() time.Time {
+	return e.time
+}
+
+func (e *BaseEvent) SaveTime(t time.Time) {
+	e.time = t
+}
+
+func (e *BaseEvent) User() string {
+	return e.user
+}
+
+func (e *BaseEvent) SaveUser(u string) {
+	e.user = u
+}
+
 type InventoryItemCreated struct {
 	*BaseEvent
 	id   Guid
@@ -30,6 +96,9 @@ func NewInventoryItemCreated(id Guid, name string) InventoryItemCreated {
 func (o InventoryItemCreated) Id() Guid {
 	return o.id
 }
+func (o InventoryItemCreated) Category() string {
+	return InventoryItemCategory
+}
 func (o InventoryItemCreated) Name() string {
 	return o.name
 }
@@ -46,6 +115,9 @@ func NewInventoryItemDeactivated(id Guid) InventoryItemDeactivated {
 func (o InventoryItemDeactivated) Id() Guid {
 	return o.id
 }
+func (o InventoryItemDeactivated) Category() string {
+	return InventoryItemCategory
+}
 
 type InventoryItemRenamed struct {
 	*BaseEvent
@@ -60,6 +132,9 @@ func NewInventoryItemRenamed(id Guid, newName string) InventoryItemRenamed {
 func (o InventoryItemRenamed) Id() Guid {
 	return o.id
 }
+func (o InventoryItemRenamed) Category() string {
+	return InventoryItemCategory
+}
 func (o InventoryItemRenamed) NewName() string {
 	return o.newName
 }
@@ -77,6 +152,9 @@ func NewItemsCheckedInToInventory(id Guid, count int) ItemsCheckedInToInventory
 func (o ItemsCheckedInToInventory) Id() Guid {
 	return o.id
 }
+func (o ItemsCheckedInToInventory) Category() string {
+	return InventoryItemCategory
+}
 func (o ItemsCheckedInToInventory) Count() int {
 	return o.count
 }
@@ -94,6 +172,31 @@ func NewItemsRemovedFromInventory(id Guid, count int) ItemsRemovedFromInventory
 func (o ItemsRemovedFromInventory) Id() Guid {
 	return o.id
 }
+func (o ItemsRemovedFromInventory) Category() string {
+	return InventoryItemCategory
+}
 func (o ItemsRemovedFromInventory) Count() int {
 	return o.count
 }
+
+// ReorderPointSet says the item is low on stock once its count falls below
+// the reorder point, 0 means it never is
+type ReorderPointSet struct {
+	*BaseEvent
+	id           Guid
+	reorderPoint int
+}
+
+func NewReorderPointSet(id Guid, reorderPoint int) ReorderPointSet {
+	be := BaseEvent{}
+	return ReorderPointSet{id: id, reorderPoint: reorderPoint, BaseEvent: &be}
+}
+func (o ReorderPointSet) Id() Guid {
+	return o.id
+}
+func (o ReorderPointSet) Category() string {
+	return InventoryItemCategory
+}
+func (o ReorderPointSet) ReorderPoint() int {
+	return o.reorderPoint
+}
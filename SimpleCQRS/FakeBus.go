@@ -1,64 +1,240 @@
 package SimpleCQRS
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"math/rand"
 	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type CommandHandler func(cmd Command) error
+type CommandHandler func(ctx context.Context, cmd Command) (Commit, error)
 type EventProcessor func(cmd Event) error
 
+type BusOptions struct {
+	// Faults delays, duplicates and drops messages, its random choices come
+	// from Seed and its delays are waited out on Clock
+	Faults               FaultProfile
+	Seed                 int64
+	Clock                Clock
+	CommandQueueCapacity int
+	CommandQueuePolicy   BackpressurePolicy
+	// each subscription has its own queue and worker goroutines,
+	// ProcessorConcurrency of them unless it was given its own number
+	EventQueueCapacity   int
+	EventQueuePolicy     BackpressurePolicy
+	ProcessorConcurrency int
+}
+
+// DefaultBusOptions never lose an event, and so must not let both queues
+// block. A command handler waits for room in the event queues while its
+// events are published, so a processor dispatching to a full command queue
+// is turned away with a *BusOverloadedError instead of waiting on it.
+func DefaultBusOptions() BusOptions {
+	return BusOptions{
+		Clock:                SystemClock,
+		CommandQueueCapacity: 100,
+		CommandQueuePolicy:   FailWhenFull,
+		EventQueueCapacity:   1000,
+		EventQueuePolicy:     BlockWhenFull,
+		ProcessorConcurrency: 1,
+	}
+}
+
 type FakeBus struct {
-	commandQueue    chan queuedCommand
+	options         BusOptions
+	commandQueue    *boundedQueue[queuedCommand]
 	commandHandlers map[reflect.Type]CommandHandler
-	eventProcessors map[reflect.Type][]EventProcessor
-	induceDelay     bool
+	subscriptions   []*eventSubscription
+	faults          *faults
+	idempotency     IdempotencyStore
+	s               sync.RWMutex
+
+	// lifecycle, see BusLifecycle.go
+	lifecycle     sync.Mutex
+	started       bool
+	stopped       bool
+	ctx           context.Context
+	abandon       context.CancelFunc
+	commandIntake gate
+	eventIntake   gate
+	commandsDone  chan struct{}
+	deliveries    sync.WaitGroup
+	inFlight      atomic.Int64
 }
 
 type queuedCommand struct {
 	cmd                 Command
-	synchronousResponse chan CommandProcessingError
+	synchronousResponse chan CommandResult
+}
+
+type eventSubscription struct {
+	filter       EventFilter
+	processor    EventProcessor
+	concurrency  int
+	queue        *boundedQueue[Event]
+	intake       gate
+	closing      sync.Once
+	unsubscribed atomic.Bool
+}
+
+// close stops the subscription taking events, its workers finish what is queued
+func (sub *eventSubscription) close() {
+	sub.closing.Do(func() {
+		sub.intake.close()
+		close(sub.queue.items)
+	})
+}
+
+type BusStats struct {
+	Commands QueueStats
+	Events   []QueueStats
 }
 
 func NewFakeBus(induceDelay bool) *FakeBus {
+	options := DefaultBusOptions()
+	if induceDelay {
+		options.Faults = InducedDelayFaults()
+		options.Seed = time.Now().UnixNano()
+		options.ProcessorConcurrency = 10 // let delayed events overtake each other
+		Logger.Println("Inducing delays with seed:", options.Seed)
+	}
+	return NewFakeBusWithOptions(options)
+}
+
+func NewFakeBusWithOptions(options BusOptions) *FakeBus {
+	if options.ProcessorConcurrency < 1 {
+		options.ProcessorConcurrency = 1
+	}
+	if options.Clock == nil {
+		options.Clock = SystemClock
+	}
 	fb := &FakeBus{
-		commandQueue:    make(chan queuedCommand),
+		options:         options,
 		commandHandlers: make(map[reflect.Type]CommandHandler),
-		eventProcessors: make(map[reflect.Type][]EventProcessor),
-		induceDelay:     induceDelay,
+		subscriptions:   make([]*eventSubscription, 0),
+		faults:          newFaults(options.Faults, options.Seed),
+		commandsDone:    make(chan struct{}),
 	}
+	fb.ctx, fb.abandon = context.WithCancel(context.Background())
+	fb.commandQueue = newBoundedQueue("commands", options.CommandQueueCapacity, options.CommandQueuePolicy,
+		func(dropped queuedCommand) {
+			select {
+			case dropped.synchronousResponse <- CommandResult{Err: &BusOverloadedError{"commands", options.CommandQueueCapacity}}:
+			default:
+			}
+		})
 
-	go fb.processCommands()
 	return fb
 }
 
+// processCommands runs until the command queue is closed and empty, or the
+// bus gives up on a shutdown
 func (fb *FakeBus) processCommands() {
+	defer close(fb.commandsDone)
 	for {
 		select {
-		case cmdReq := <-fb.commandQueue:
-			cmd := cmdReq.cmd
-			fmt.Println("Processing command:", cmd)
-			resp := cmdReq.synchronousResponse
-			handler, _ := fb.commandHandlers[reflect.TypeOf(cmd)]
-
-			if fb.induceDelay {
-				time.Sleep(time.Duration(1+rand.Intn(3)) * time.Second) // Have possible command race conditions too
+		case cmdReq, ok := <-fb.commandQueue.items:
+			if !ok {
+				return
 			}
+			fb.inFlight.Add(1)
+			fb.processCommand(cmdReq)
+			fb.inFlight.Add(-1)
+		case <-fb.ctx.Done():
+			return
+		}
+	}
+}
 
-			result := handler(cmd)
-			fmt.Println("Processed command, result:", result)
-			select {
-			case resp <- result:
-			default:
+func (fb *FakeBus) processCommand(cmdReq queuedCommand) {
+	cmd := cmdReq.cmd
+	Logger.Println("Processing command:", cmd)
+	resp := cmdReq.synchronousResponse
+	fb.s.RLock()
+	handler, _ := fb.commandHandlers[reflect.TypeOf(cmd)]
+	fb.s.RUnlock()
+
+	key := idempotencyKey(fb.idempotency, cmd)
+	if processed, ok := alreadyProcessed(fb.idempotency, key); ok {
+		Logger.Println("Duplicate command, original result:", processed.Error)
+		select {
+		case resp <- processed.Result():
+		default:
+		}
+		return
+	}
+
+	fb.sleep(fb.faults.commandDelay()) // Have possible command race conditions too
+
+	commit, err := handler(fb.ctx, cmd)
+	Logger.Println("Processed command, result:", err)
+	result := CommandResult{commit, err}
+	recordProcessed(fb.idempotency, key, result)
+	select {
+	case resp <- result:
+	default:
+	}
+}
+
+// UseIdempotencyStore turns on deduplication of commands that carry an idempotency key
+func (fb *FakeBus) UseIdempotencyStore(store IdempotencyStore) {
+	fb.idempotency = store
+}
+
+// deliverEvents runs until the processor's queue is closed and empty, or the
+// bus gives up on a shutdown
+func (fb *FakeBus) deliverEvents(sub *eventSubscription) {
+	defer fb.deliveries.Done()
+	for {
+		select {
+		case evt, ok := <-sub.queue.items:
+			if !ok {
+				return
 			}
+			if sub.unsubscribed.Load() {
+				continue
+			}
+			fb.inFlight.Add(1)
+			fb.sleep(fb.faults.eventDelay()) // Have a variable degree of eventual consistency
+			if err := sub.processor(evt); err != nil {
+				Logger.Println("Event processor failed on", evt, ":", err)
+			}
+			fb.inFlight.Add(-1)
+		case <-fb.ctx.Done():
+			return
 		}
 	}
 }
 
+// sleep is cut short if the bus gives up on a shutdown
+func (fb *FakeBus) sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	select {
+	case <-fb.options.Clock.After(d):
+	case <-fb.ctx.Done():
+	}
+}
+
+func (fb *FakeBus) Stats() BusStats {
+	fb.s.RLock()
+	defer fb.s.RUnlock()
+
+	stats := BusStats{Commands: fb.commandQueue.stats(), Events: make([]QueueStats, 0)}
+	for _, sub := range fb.subscriptions {
+		stats.Events = append(stats.Events, sub.queue.stats())
+	}
+	return stats
+}
+
 func (fb *FakeBus) SetCommandHandler(cmdType reflect.Type, handler CommandHandler) error {
+	fb.s.Lock()
+	defer fb.s.Unlock()
+
 	if _, ok := fb.commandHandlers[cmdType]; ok {
 		return errors.New("command handler already registered")
 	}
@@ -67,52 +243,151 @@ func (fb *FakeBus) SetCommandHandler(cmdType reflect.Type, handler CommandHandle
 }
 
 func (fb *FakeBus) AddEventProcessor(eventType reflect.Type, processor EventProcessor) error {
-	processors, ok := fb.eventProcessors[eventType]
-	if !ok {
-		processors = make([]EventProcessor, 0)
+	_, err := fb.SubscribeEvents(EventFilter{Types: []reflect.Type{eventType}}, processor)
+	return err
+}
+
+func (fb *FakeBus) SubscribeEvents(filter EventFilter, processor EventProcessor) (func(), error) {
+	return fb.SubscribeEventsConcurrently(filter, processor, fb.options.ProcessorConcurrency)
+}
+
+// SubscribeEventsConcurrently subscribes with concurrency workers rather than
+// the bus's ProcessorConcurrency, e.g. 1 for a processor that cannot run
+// alongside itself on a bus that lets others overtake each other
+func (fb *FakeBus) SubscribeEventsConcurrently(filter EventFilter, processor EventProcessor, concurrency int) (func(), error) {
+	if concurrency < 1 {
+		return nil, errors.New("a subscription needs at least one worker")
 	}
-	for _, p := range processors {
-		if reflect.DeepEqual(p, processor) {
-			return errors.New("processor already registered")
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+
+	fb.lifecycle.Lock()
+	defer fb.lifecycle.Unlock()
+	fb.s.Lock()
+	defer fb.s.Unlock()
+
+	if fb.stopped {
+		return nil, ErrBusStopped
+	}
+
+	same := 0
+	for _, sub := range fb.subscriptions {
+		if reflect.DeepEqual(sub.filter, filter) {
+			if sameProcessor(sub.processor, processor) {
+				return nil, ErrAlreadySubscribed
+			}
+			same++
 		}
 	}
-	processors = append(processors, processor)
-	fb.eventProcessors[eventType] = processors
-	return nil
+	sub := &eventSubscription{
+		filter:      filter,
+		processor:   processor,
+		concurrency: concurrency,
+		queue: newBoundedQueue[Event](fmt.Sprintf("%v[%v]", filter, same),
+			fb.options.EventQueueCapacity, fb.options.EventQueuePolicy, nil),
+	}
+	if fb.started {
+		fb.startDeliveries(sub)
+	}
+	fb.subscriptions = append(fb.subscriptions, sub)
+	return func() { fb.unsubscribe(sub) }, nil
+}
+
+func (fb *FakeBus) unsubscribe(sub *eventSubscription) {
+	fb.s.Lock()
+	for i, s := range fb.subscriptions {
+		if s == sub {
+			fb.subscriptions = append(fb.subscriptions[:i:i], fb.subscriptions[i+1:]...)
+			break
+		}
+	}
+	fb.s.Unlock()
+
+	sub.unsubscribed.Store(true)
+	sub.close()
 }
 
-func (fb *FakeBus) Dispatch(cmd Command, syncResp chan CommandProcessingError) CommandSubmissionError {
-	if _, ok := fb.commandHandlers[reflect.TypeOf(cmd)]; ok {
-		fmt.Println("Queuing command:", cmd)
-		fb.commandQueue <- queuedCommand{cmd, syncResp}
-		return nil
+func (fb *FakeBus) Dispatch(cmd Command, syncResp chan CommandResult) CommandSubmissionError {
+	fb.s.RLock()
+	_, ok := fb.commandHandlers[reflect.TypeOf(cmd)]
+	fb.s.RUnlock()
+
+	if !ok {
+		return errors.New("no handler registered")
 	}
-	return errors.New("no handler registered")
+	if !fb.commandIntake.enter() {
+		return ErrBusStopped
+	}
+	defer fb.commandIntake.leave()
+
+	Logger.Println("Queuing command:", cmd)
+	return fb.commandQueue.push(queuedCommand{cmd, syncResp})
 }
 
+// Publish queues the event for every subscription whose filter it matches,
+// an event nobody is interested in is not an error. If any subscription's
+// queue rejects it the overload error is returned once the others have been
+// given the event.
 func (fb *FakeBus) Publish(evt Event) error {
-	if processors, ok := fb.eventProcessors[reflect.TypeOf(evt)]; ok {
-		for _, processor := range processors {
-			go func(p EventProcessor) {
-				if fb.induceDelay {
-					time.Sleep(time.Duration(rand.Intn(10)) * time.Second) // Have a variable degree of eventual consistency
-				}
-				p(evt)
-			}(processor)
+	if !fb.eventIntake.enter() {
+		return ErrBusStopped
+	}
+	defer fb.eventIntake.leave()
+
+	fb.s.RLock()
+	subs := fb.subscriptions
+	fb.s.RUnlock()
+
+	var result error
+	for _, sub := range subs {
+		if !sub.filter.Matches(evt) || !sub.intake.enter() {
+			continue
 		}
-		return nil
+		for i := fb.faults.deliveries(); i > 0; i-- {
+			if err := sub.queue.push(evt); err != nil && result == nil {
+				result = err
+			}
+		}
+		sub.intake.leave()
 	}
-	return errors.New("no processor registered")
+	return result
 }
 
 type CommandProcessingError error
 type CommandSubmissionError error
 
+// CommandResult is sent on Dispatch's synchronous response channel once the
+// command has been handled. The commit is empty if the handler failed.
+type CommandResult struct {
+	Commit
+	Err CommandProcessingError
+}
+
 type CommandDispatcher interface {
 	Dispatch(e Command,
-		synchronousResponse chan CommandProcessingError) CommandSubmissionError
+		synchronousResponse chan CommandResult) CommandSubmissionError
 }
 
 type EventPublisher interface {
 	Publish(e Event) error
 }
+
+type CommandHandlerRegistry interface {
+	SetCommandHandler(cmdType reflect.Type, handler CommandHandler) error
+}
+
+type EventProcessorRegistry interface {
+	AddEventProcessor(eventType reflect.Type, processor EventProcessor) error
+}
+
+// Bus is everything a transport offers, FakeBus in process and RemoteBus through a Broker
+type Bus interface {
+	CommandDispatcher
+	EventPublisher
+	CommandHandlerRegistry
+	EventProcessorRegistry
+	EventSubscriber
+	Start() error
+	Stop(ctx context.Context) error
+}
@@ -0,0 +1,167 @@
+package SimpleCQRS
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// storedEvent is a line of an event store file
+type storedEvent struct {
+	Aggregate Guid
+	Type      string
+	Event     json.RawMessage
+}
+
+// fileEventStore keeps events in a file, one JSON line each, so they outlive
+// the process. Processes on one machine can share the file: each save locks
+// it and reads what the others have appended before checking the version,
+// and reads pick up whatever has been appended since, so every process sees
+// the same history with the same positions. Events are only published by
+// the process that saved them, so processes sharing a file need to share a
+// bus through a broker too.
+type fileEventStore struct {
+	*es
+	codec  *EventCodec
+	file   *os.File
+	offset int64 // how far the file has been read
+	s      sync.Mutex
+}
+
+func NewFileEventStore(path string, codec *EventCodec, p EventPublisher) (EventStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store := &fileEventStore{
+		es:    NewEventStore(p).(*es),
+		codec: codec,
+		file:  file,
+	}
+	if err := store.refresh(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *fileEventStore) SaveEvents(aggregateId Guid, events []Event, expectedVersion int) (Commit, error) {
+	commit, err := store.saveShared(aggregateId, events, expectedVersion)
+	if err != nil {
+		return Commit{}, err
+	}
+	for _, event := range events {
+		store.publisher.Publish(event)
+	}
+	return commit, nil
+}
+
+func (store *fileEventStore) saveShared(aggregateId Guid, events []Event, expectedVersion int) (Commit, error) {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	if err := lockFile(store.file); err != nil {
+		return Commit{}, err
+	}
+	defer unlockFile(store.file)
+
+	if err := store.read(); err != nil {
+		return Commit{}, err
+	}
+	// a save that was cut short by a crash leaves part of a line behind
+	if err := store.file.Truncate(store.offset); err != nil {
+		return Commit{}, err
+	}
+	return store.save(aggregateId, events, expectedVersion, store.write)
+}
+
+// write appends the events in one write, so others never read half a commit
+func (store *fileEventStore) write(eds []EventDescriptor) error {
+	var buf bytes.Buffer
+	for _, ed := range eds {
+		name, data, err := store.codec.Encode(ed.data)
+		if err != nil {
+			return err
+		}
+		line, err := json.Marshal(storedEvent{ed.id, name, data})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	n, err := store.file.Write(buf.Bytes())
+	if err != nil {
+		store.file.Truncate(store.offset)
+		return err
+	}
+	store.offset += int64(n)
+	return nil
+}
+
+// refresh reads whatever other processes have appended
+func (store *fileEventStore) refresh() error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	return store.read()
+}
+
+// read keeps every whole line after offset
+func (store *fileEventStore) read() error {
+	info, err := store.file.Stat()
+	if err != nil || info.Size() <= store.offset {
+		return err
+	}
+	data := make([]byte, info.Size()-store.offset)
+	if _, err := store.file.ReadAt(data, store.offset); err != nil && err != io.EOF {
+		return err
+	}
+	for {
+		end := bytes.IndexByte(data, '\n')
+		if end < 0 {
+			return nil
+		}
+		var stored storedEvent
+		if err := json.Unmarshal(data[:end], &stored); err != nil {
+			return fmt.Errorf("event store %v at byte %v: %v", store.file.Name(), store.offset, err)
+		}
+		evt, err := store.codec.Decode(stored.Type, stored.Event)
+		if err != nil {
+			return fmt.Errorf("event store %v at byte %v: %v", store.file.Name(), store.offset, err)
+		}
+		if err := store.load(stored.Aggregate, evt); err != nil {
+			return err
+		}
+		store.offset += int64(end + 1)
+		data = data[end+1:]
+	}
+}
+
+func (store *fileEventStore) GetEventsForAggregate(aggregateId Guid) ([]Event, error) {
+	if err := store.refresh(); err != nil {
+		return nil, err
+	}
+	return store.es.GetEventsForAggregate(aggregateId)
+}
+
+func (store *fileEventStore) Head() int64 {
+	if err := store.refresh(); err != nil {
+		Logger.Println("Reading event store failed:", err)
+	}
+	return store.es.Head()
+}
+
+func (store *fileEventStore) ReadAll(after int64, max int) ([]Event, error) {
+	if err := store.refresh(); err != nil {
+		return nil, err
+	}
+	return store.es.ReadAll(after, max)
+}
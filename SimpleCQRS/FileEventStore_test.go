@@ -0,0 +1,51 @@
+package SimpleCQRS
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func openFileEventStore(t *testing.T, path string) EventStore {
+	store, err := NewFileEventStore(path, NewInventoryEventCodec(), discardEvents{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFileEventStoreIsSharedThroughItsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	a := openFileEventStore(t, path)
+	b := openFileEventStore(t, path)
+
+	if _, err := a.SaveEvents("a", []Event{NewInventoryItemCreated("a", "widget")}, -1); err != nil {
+		t.Fatal(err)
+	}
+	if b.Head() != 1 {
+		t.Fatal("saved by one store, unseen by the other", b.Head())
+	}
+	if _, err := b.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", 3)}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", 4)}, 0); err == nil {
+		t.Fatal("saved over the other store's event", err)
+	}
+
+	// a write cut short leaves a torn line, which is ignored then overwritten
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"Name":"ItemsCheckedInToInven`)
+	file.Close()
+	c := openFileEventStore(t, path)
+	if _, err := c.SaveEvents("a", []Event{NewItemsRemovedFromInventory("a", 1)}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := openFileEventStore(t, path).GetEventsForAggregate("a")
+	if err != nil || len(events) != 3 {
+		t.Fatal(events, err)
+	}
+	if events[1].(ItemsCheckedInToInventory).Count() != 3 || events[2].(PositionedEvent).Position() != 3 {
+		t.Fatal(events)
+	}
+}
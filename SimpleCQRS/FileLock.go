@@ -0,0 +1,17 @@
+//go:build unix
+
+package SimpleCQRS
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile waits until no other process has file locked, then locks it
+func lockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,16 @@
+//go:build !unix
+
+package SimpleCQRS
+
+import (
+	"os"
+)
+
+// without file locks only one process can use a file at a time
+func lockFile(file *os.File) error {
+	return nil
+}
+
+func unlockFile(file *os.File) error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ProcessedCommand records the outcome of a command that carried an idempotency key
+type ProcessedCommand struct {
+	Key         string
+	Error       string
+	AggregateId Guid
+	Version     int
+	Position    int64
+	ProcessedAt time.Time
+}
+
+// Result repeats the original outcome, without the events it committed
+func (pc ProcessedCommand) Result() CommandResult {
+	result := CommandResult{Commit: Commit{AggregateId: pc.AggregateId, Version: pc.Version, Position: pc.Position}}
+	if pc.Error != "" {
+		result.Err = errors.New(pc.Error)
+	}
+	return result
+}
+
+type IdempotencyStore interface {
+	Get(key string) (ProcessedCommand, bool, error)
+	Put(pc ProcessedCommand) error
+}
+
+// idempotencyKey is what cmd is recorded under in store, or "" when there is
+// no store or the command carries no key
+func idempotencyKey(store IdempotencyStore, cmd Command) string {
+	ic, ok := cmd.(IdempotentCommand)
+	if store == nil || !ok || ic.IdempotencyKey() == "" {
+		return ""
+	}
+	return reflect.TypeOf(cmd).Name() + ":" + ic.IdempotencyKey()
+}
+
+func alreadyProcessed(store IdempotencyStore, key string) (ProcessedCommand, bool) {
+	if key == "" {
+		return ProcessedCommand{}, false
+	}
+	processed, ok, err := store.Get(key)
+	if err != nil {
+		Logger.Println("Idempotency store error:", err)
+		return processed, false
+	}
+	return processed, ok
+}
+
+func recordProcessed(store IdempotencyStore, key string, result CommandResult) {
+	if key == "" {
+		return
+	}
+	processed := ProcessedCommand{
+		Key:         key,
+		AggregateId: result.AggregateId,
+		Version:     result.Version,
+		Position:    result.Position,
+	}
+	if result.Err != nil {
+		processed.Error = result.Err.Error()
+	}
+	if err := store.Put(processed); err != nil {
+		Logger.Println("Idempotency store error:", err)
+	}
+}
+
+// inMemoryIdempotencyStore remembers at most capacity keys, each for at most ttl
+type inMemoryIdempotencyStore struct {
+	capacity  int
+	ttl       time.Duration
+	clock     Clock
+	processed map[string]ProcessedCommand
+	order     []string
+	s         sync.Mutex
+}
+
+func NewInMemoryIdempotencyStore(capacity int, ttl time.Duration, clock Clock) IdempotencyStore {
+	return newInMemoryIdempotencyStore(capacity, ttl, clock)
+}
+
+func newInMemoryIdempotencyStore(capacity int, ttl time.Duration, clock Clock) *inMemoryIdempotencyStore {
+	return &inMemoryIdempotencyStore{
+		capacity:  capacity,
+		ttl:       ttl,
+		clock:     clock,
+		processed: make(map[string]ProcessedCommand),
+		order:     make([]string, 0),
+	}
+}
+
+func (store *inMemoryIdempotencyStore) Get(key string) (ProcessedCommand, bool, error) {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	store.expire()
+	pc, ok := store.processed[key]
+	return pc, ok, nil
+}
+
+func (store *inMemoryIdempotencyStore) Put(pc ProcessedCommand) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	store.put(pc)
+	return nil
+}
+
+func (store *inMemoryIdempotencyStore) put(pc ProcessedCommand) {
+	if pc.ProcessedAt.IsZero() {
+		pc.ProcessedAt = store.clock.Now()
+	}
+	if _, ok := store.processed[pc.Key]; !ok {
+		store.order = append(store.order, pc.Key)
+	}
+	store.processed[pc.Key] = pc
+	store.expire()
+}
+
+// expire drops keys past their ttl and the oldest keys beyond capacity
+func (store *inMemoryIdempotencyStore) expire() {
+	cutoff := store.clock.Now().Add(-store.ttl)
+	drop := 0
+	for _, key := range store.order {
+		if len(store.order)-drop <= store.capacity && store.processed[key].ProcessedAt.After(cutoff) {
+			break
+		}
+		delete(store.processed, key)
+		drop++
+	}
+	store.order = store.order[drop:]
+}
+
+// fileIdempotencyStore keeps the in memory record and writes it to path after
+// every change, so it can be shared by the next process to start
+type fileIdempotencyStore struct {
+	*inMemoryIdempotencyStore
+	path string
+}
+
+func NewFileIdempotencyStore(path string, capacity int, ttl time.Duration, clock Clock) (IdempotencyStore, error) {
+	store := &fileIdempotencyStore{newInMemoryIdempotencyStore(capacity, ttl, clock), path}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+	saved := make([]ProcessedCommand, 0)
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, err
+	}
+	for _, pc := range saved {
+		store.put(pc)
+	}
+	return store, nil
+}
+
+func (store *fileIdempotencyStore) Put(pc ProcessedCommand) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	store.put(pc)
+	saved := make([]ProcessedCommand, 0, len(store.order))
+	for _, key := range store.order {
+		saved = append(saved, store.processed[key])
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	tmp := store.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, store.path)
+}
@@ -0,0 +1,56 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFakeBusAnswersARepeatedKeyWithTheOriginalResult(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus := NewFakeBus(false)
+	bus.UseIdempotencyStore(NewInMemoryIdempotencyStore(10, time.Hour, clock))
+	handled := 0
+	RegisterCommandHandler(bus, func(ctx context.Context, cmd CheckInItemsToInventory) (Commit, error) {
+		handled++
+		if cmd.Count < 0 {
+			return Commit{}, errors.New("negative count")
+		}
+		return Commit{AggregateId: cmd.InventoryItemId, Version: handled}, nil
+	})
+	bus.Start()
+	defer bus.Stop(context.Background())
+	dispatch := func(key string, count int) CommandResult {
+		result := make(chan CommandResult, 1)
+		if err := bus.Dispatch(CheckInItemsToInventory{Idempotent: Idempotent{key}, InventoryItemId: "a", Count: count}, result); err != nil {
+			t.Fatal(err)
+		}
+		return <-result
+	}
+
+	if first := dispatch("k", 1); first.Err != nil || first.Version != 1 {
+		t.Fatalf("%+v", first)
+	}
+	if again := dispatch("k", 1); again.Err != nil || again.Version != 1 || handled != 1 {
+		t.Fatalf("%+v handled %v times", again, handled)
+	}
+	// a failure is remembered too
+	if failed := dispatch("bad", -1); failed.Err == nil {
+		t.Fatal("no error")
+	}
+	if again := dispatch("bad", -1); again.Err == nil || again.Err.Error() != "negative count" || handled != 2 {
+		t.Fatalf("%+v handled %v times", again, handled)
+	}
+	// no key, no deduplication
+	dispatch("", 1)
+	dispatch("", 1)
+	if handled != 4 {
+		t.Fatal(handled)
+	}
+
+	clock.Advance(2 * time.Hour)
+	if expired := dispatch("k", 1); expired.Version != 5 {
+		t.Fatalf("%+v", expired)
+	}
+}
@@ -0,0 +1,119 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// InventoryItemHistoryEntry is one event in an item's history, with the
+// name and count either side of it
+type InventoryItemHistoryEntry struct {
+	Event       string
+	Version     int
+	Time        time.Time
+	User        string // empty when no user caused it
+	NameBefore  string
+	NameAfter   string
+	CountBefore int
+	CountAfter  int
+}
+
+// InventoryHistoryView keeps every event of every item, deactivated ones
+// included, as a Projection
+type InventoryHistoryView struct {
+	entries    map[Guid][]InventoryItemHistoryEntry
+	projection *DeclaredProjection[*InventoryHistoryView]
+	s          sync.RWMutex
+}
+
+func NewInventoryHistoryView() *InventoryHistoryView {
+	view := &InventoryHistoryView{entries: make(map[Guid][]InventoryItemHistoryEntry)}
+	p := NewDeclaredProjection(view, &view.s)
+	ProjectWith(p, func(view *InventoryHistoryView, evt InventoryItemCreated) error {
+		view.record(evt, func(entry *InventoryItemHistoryEntry) { entry.NameAfter = evt.Name() })
+		return nil
+	})
+	ProjectWith(p, func(view *InventoryHistoryView, evt InventoryItemRenamed) error {
+		view.record(evt, func(entry *InventoryItemHistoryEntry) { entry.NameAfter = evt.NewName() })
+		return nil
+	})
+	ProjectWith(p, func(view *InventoryHistoryView, evt InventoryItemDeactivated) error {
+		view.record(evt, func(entry *InventoryItemHistoryEntry) {})
+		return nil
+	})
+	ProjectWith(p, func(view *InventoryHistoryView, evt ItemsCheckedInToInventory) error {
+		view.record(evt, func(entry *InventoryItemHistoryEntry) { entry.CountAfter += evt.Count() })
+		return nil
+	})
+	ProjectWith(p, func(view *InventoryHistoryView, evt ItemsRemovedFromInventory) error {
+		view.record(evt, func(entry *InventoryItemHistoryEntry) { entry.CountAfter -= evt.Count() })
+		return nil
+	})
+	ProjectWith(p, func(view *InventoryHistoryView, evt ReorderPointSet) error {
+		view.record(evt, func(entry *InventoryItemHistoryEntry) {})
+		return nil
+	})
+	view.projection = p
+	return view
+}
+
+func (view *InventoryHistoryView) Process(evt Event) error {
+	return view.projection.Process(evt)
+}
+
+func (view *InventoryHistoryView) Skip(evt Event) error {
+	return view.projection.Skip(evt)
+}
+
+// record adds an entry for evt that carries on from the item's last one, as
+// changed by change
+func (view *InventoryHistoryView) record(evt AggregateEvent, change func(entry *InventoryItemHistoryEntry)) {
+	entries := view.entries[evt.Id()]
+	var last InventoryItemHistoryEntry
+	if len(entries) > 0 {
+		last = entries[len(entries)-1]
+	}
+	entry := InventoryItemHistoryEntry{
+		Event:       reflect.TypeOf(evt).Name(),
+		Version:     evt.Version(),
+		NameBefore:  last.NameAfter,
+		NameAfter:   last.NameAfter,
+		CountBefore: last.CountAfter,
+		CountAfter:  last.CountAfter,
+	}
+	if te, ok := evt.(TimedEvent); ok {
+		entry.Time = te.Time()
+	}
+	if ue, ok := evt.(AttributedEvent); ok {
+		entry.User = ue.User()
+	}
+	change(&entry)
+	view.entries[evt.Id()] = append(entries, entry)
+}
+
+// History lists the item's events, oldest first
+func (view *InventoryHistoryView) History(id Guid) ([]InventoryItemHistoryEntry, error) {
+	view.s.RLock()
+	defer view.s.RUnlock()
+
+	entries, ok := view.entries[id]
+	if !ok {
+		return nil, fmt.Errorf("no history for item %v", id)
+	}
+	tmp := make([]InventoryItemHistoryEntry, len(entries))
+	copy(tmp, entries)
+	return tmp, nil
+}
+
+func (view *InventoryHistoryView) WaitFor(ctx context.Context, token ConsistencyToken) error {
+	return view.projection.WaitFor(ctx, token)
+}
+
+// NewInventoryHistory is the history readers see, as the InventoryHistory
+// projection
+func NewInventoryHistory() *Swappable[*InventoryHistoryView] {
+	return NewSwappable("InventoryHistory", NewInventoryHistoryView)
+}
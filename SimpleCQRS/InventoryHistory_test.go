@@ -0,0 +1,48 @@
+package SimpleCQRS
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInventoryHistoryRecordsEachEventWithTheItemEitherSideOfIt(t *testing.T) {
+	start := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewVirtualClock(start)
+	store := NewEventStoreWithClock(discardEvents{}, clock)
+	history := NewInventoryHistory()
+	runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+	if err := runner.Add(history.Definition()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "bolts"), NewItemsCheckedInToInventory("a", 10)}, -1)
+	clock.Advance(time.Hour)
+	removed := NewItemsRemovedFromInventory("a", 4)
+	removed.SaveUser("sam")
+	store.SaveEvents("a", []Event{removed, NewInventoryItemRenamed("a", "nuts"), NewInventoryItemDeactivated("a")}, 1)
+	runner.CatchUp(nil)
+
+	entries, err := history.Load().History("a")
+	if err != nil || len(entries) != 5 {
+		t.Fatal(entries, err)
+	}
+	want := []InventoryItemHistoryEntry{
+		{Event: "InventoryItemCreated", Version: 0, Time: start, NameAfter: "bolts"},
+		{Event: "ItemsCheckedInToInventory", Version: 1, Time: start, NameBefore: "bolts", NameAfter: "bolts", CountAfter: 10},
+		{Event: "ItemsRemovedFromInventory", Version: 2, Time: start.Add(time.Hour), User: "sam", NameBefore: "bolts", NameAfter: "bolts", CountBefore: 10, CountAfter: 6},
+		{Event: "InventoryItemRenamed", Version: 3, Time: start.Add(time.Hour), NameBefore: "bolts", NameAfter: "nuts", CountBefore: 6, CountAfter: 6},
+		{Event: "InventoryItemDeactivated", Version: 4, Time: start.Add(time.Hour), NameBefore: "nuts", NameAfter: "nuts", CountBefore: 6, CountAfter: 6},
+	}
+	for i := range want {
+		if !entries[i].Time.Equal(want[i].Time) {
+			t.Fatalf("entry %v at %v, want %v", i, entries[i].Time, want[i].Time)
+		}
+		entries[i].Time = want[i].Time
+		if entries[i] != want[i] {
+			t.Fatalf("entry %v\n%+v\nwant\n%+v", i, entries[i], want[i])
+		}
+	}
+	if _, err := history.Load().History("b"); err == nil {
+		t.Fatal("history of an item that was never created")
+	}
+}
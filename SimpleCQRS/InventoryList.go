@@ -0,0 +1,314 @@
+package SimpleCQRS
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type InventoryItemSort string
+
+const (
+	SortByName        InventoryItemSort = "name"
+	SortByCount       InventoryItemSort = "count"
+	SortByLastUpdated InventoryItemSort = "updated"
+)
+
+// InventoryItemStatus picks items by whether they have been deactivated
+type InventoryItemStatus string
+
+const (
+	ActiveItems   InventoryItemStatus = "active"
+	InactiveItems InventoryItemStatus = "inactive"
+	AllItems      InventoryItemStatus = "all"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+var (
+	ErrBadCursor          = errors.New("cursor is not from this listing")
+	ErrInvalidListOptions = errors.New("invalid list options")
+)
+
+// InventoryItemListOptions picks a page of the inventory list, the zero
+// value is the first page of active items sorted by name
+type InventoryItemListOptions struct {
+	Sort       InventoryItemSort
+	Descending bool
+	Status     InventoryItemStatus // ActiveItems if empty
+	NamePrefix string              // case insensitive
+	MinCount   *int
+	MaxCount   *int
+	Cursor     string // Next from the previous page
+	Limit      int    // DefaultPageSize if 0, never more than MaxPageSize
+}
+
+type InventoryItemPage struct {
+	Items []InventoryItemListDto
+	Next  string // the cursor for the page after this one, empty on the last page
+}
+
+// listIndex keeps items sorted by one key, ties are broken by id so every
+// item has exactly one place
+type listIndex struct {
+	less    func(a, b InventoryItemListDto) bool
+	entries []InventoryItemListDto
+}
+
+// search returns where dto is, or would go
+func (ix *listIndex) search(dto InventoryItemListDto) int {
+	return sort.Search(len(ix.entries), func(i int) bool { return !ix.less(ix.entries[i], dto) })
+}
+
+func (ix *listIndex) insert(dto InventoryItemListDto) {
+	i := ix.search(dto)
+	ix.entries = append(ix.entries, InventoryItemListDto{})
+	copy(ix.entries[i+1:], ix.entries[i:])
+	ix.entries[i] = dto
+}
+
+func (ix *listIndex) remove(dto InventoryItemListDto) {
+	i := ix.search(dto)
+	if i < len(ix.entries) && ix.entries[i].Id == dto.Id {
+		ix.entries = append(ix.entries[:i], ix.entries[i+1:]...)
+	}
+}
+
+func sortKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// inventoryList holds the list view's items with an index for each way
+// they can be sorted, kept apart for active and inactive items
+type inventoryList struct {
+	items   map[Guid]InventoryItemListDto
+	indexes map[InventoryItemStatus]map[InventoryItemSort]*listIndex
+}
+
+func newInventoryList() *inventoryList {
+	return &inventoryList{
+		items: make(map[Guid]InventoryItemListDto),
+		indexes: map[InventoryItemStatus]map[InventoryItemSort]*listIndex{
+			ActiveItems:   newListIndexes(),
+			InactiveItems: newListIndexes(),
+		},
+	}
+}
+
+func newListIndexes() map[InventoryItemSort]*listIndex {
+	return map[InventoryItemSort]*listIndex{
+		SortByName: {less: func(a, b InventoryItemListDto) bool {
+			if ka, kb := sortKey(a.Name), sortKey(b.Name); ka != kb {
+				return ka < kb
+			}
+			return a.Id < b.Id
+		}},
+		SortByCount: {less: func(a, b InventoryItemListDto) bool {
+			if a.CurrentCount != b.CurrentCount {
+				return a.CurrentCount < b.CurrentCount
+			}
+			return a.Id < b.Id
+		}},
+		SortByLastUpdated: {less: func(a, b InventoryItemListDto) bool {
+			if !a.LastUpdated.Equal(b.LastUpdated) {
+				return a.LastUpdated.Before(b.LastUpdated)
+			}
+			return a.Id < b.Id
+		}},
+	}
+}
+
+func statusOf(dto InventoryItemListDto) InventoryItemStatus {
+	if dto.Active {
+		return ActiveItems
+	}
+	return InactiveItems
+}
+
+func (l *inventoryList) get(id Guid) (InventoryItemListDto, bool) {
+	dto, ok := l.items[id]
+	return dto, ok
+}
+
+func (l *inventoryList) put(dto InventoryItemListDto) {
+	l.remove(dto.Id)
+	l.items[dto.Id] = dto
+	for _, ix := range l.indexes[statusOf(dto)] {
+		ix.insert(dto)
+	}
+}
+
+func (l *inventoryList) remove(id Guid) {
+	old, ok := l.items[id]
+	if !ok {
+		return
+	}
+	delete(l.items, id)
+	for _, ix := range l.indexes[statusOf(old)] {
+		ix.remove(old)
+	}
+}
+
+type listCursor struct {
+	Sort       InventoryItemSort
+	Descending bool
+	Last       InventoryItemListDto
+}
+
+// listRange is the part of an index a page is read from
+type listRange struct {
+	ix     *listIndex
+	lo, hi int
+}
+
+func (l *inventoryList) page(opts InventoryItemListOptions) (InventoryItemPage, error) {
+	if opts.Sort == "" {
+		opts.Sort = SortByName
+	}
+	if _, ok := l.indexes[ActiveItems][opts.Sort]; !ok {
+		return InventoryItemPage{}, fmt.Errorf("%w: cannot sort by %q", ErrInvalidListOptions, opts.Sort)
+	}
+	limit := opts.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	} else if limit > MaxPageSize {
+		limit = MaxPageSize
+	}
+	prefix := sortKey(opts.NamePrefix)
+	statuses := []InventoryItemStatus{opts.Status}
+	switch opts.Status {
+	case "":
+		statuses[0] = ActiveItems
+	case AllItems:
+		statuses = []InventoryItemStatus{ActiveItems, InactiveItems}
+	case ActiveItems, InactiveItems:
+	default:
+		return InventoryItemPage{}, fmt.Errorf("%w: no %q items, only %q, %q and %q", ErrInvalidListOptions, opts.Status, ActiveItems, InactiveItems, AllItems)
+	}
+	var cursor *listCursor
+	if opts.Cursor != "" {
+		c, err := decodeListCursor(opts.Cursor)
+		if err != nil || c.Sort != opts.Sort || c.Descending != opts.Descending {
+			return InventoryItemPage{}, ErrBadCursor
+		}
+		cursor = &c
+	}
+
+	ranges := make([]*listRange, 0, len(statuses))
+	for _, status := range statuses {
+		ranges = append(ranges, narrow(l.indexes[status][opts.Sort], opts, prefix, cursor))
+	}
+	less := ranges[0].ix.less
+	// next takes the next item in order from whichever range has it
+	next := func() (InventoryItemListDto, bool) {
+		var best *listRange
+		for _, r := range ranges {
+			if r.lo >= r.hi {
+				continue
+			}
+			if best == nil ||
+				(!opts.Descending && less(r.ix.entries[r.lo], best.ix.entries[best.lo])) ||
+				(opts.Descending && less(best.ix.entries[best.hi-1], r.ix.entries[r.hi-1])) {
+				best = r
+			}
+		}
+		if best == nil {
+			return InventoryItemListDto{}, false
+		}
+		if opts.Descending {
+			best.hi--
+			return best.ix.entries[best.hi], true
+		}
+		best.lo++
+		return best.ix.entries[best.lo-1], true
+	}
+
+	matches := func(dto InventoryItemListDto) bool {
+		return strings.HasPrefix(sortKey(dto.Name), prefix) &&
+			(opts.MinCount == nil || dto.CurrentCount >= *opts.MinCount) &&
+			(opts.MaxCount == nil || dto.CurrentCount <= *opts.MaxCount)
+	}
+	page := InventoryItemPage{Items: make([]InventoryItemListDto, 0)}
+	for dto, ok := next(); ok; dto, ok = next() {
+		if !matches(dto) {
+			continue
+		}
+		if len(page.Items) == limit {
+			page.Next = encodeListCursor(listCursor{opts.Sort, opts.Descending, page.Items[limit-1]})
+			break
+		}
+		page.Items = append(page.Items, dto)
+	}
+	return page, nil
+}
+
+// narrow picks the range of ix the index can answer the options from, then
+// skips what the cursor has already returned
+func narrow(ix *listIndex, opts InventoryItemListOptions, prefix string, cursor *listCursor) *listRange {
+	lo, hi := 0, len(ix.entries)
+	if opts.Sort == SortByName && prefix != "" {
+		lo = ix.search(InventoryItemListDto{Name: prefix})
+		hi = lo + sort.Search(hi-lo, func(i int) bool { return !strings.HasPrefix(sortKey(ix.entries[lo+i].Name), prefix) })
+	}
+	if opts.Sort == SortByCount && opts.MinCount != nil {
+		lo = ix.search(InventoryItemListDto{CurrentCount: *opts.MinCount})
+	}
+	if opts.Sort == SortByCount && opts.MaxCount != nil {
+		hi = sort.Search(len(ix.entries), func(i int) bool { return ix.entries[i].CurrentCount > *opts.MaxCount })
+	}
+	if cursor != nil {
+		at := ix.search(cursor.Last)
+		if opts.Descending && at < hi {
+			hi = at
+		} else if !opts.Descending {
+			if at < len(ix.entries) && ix.entries[at].Id == cursor.Last.Id {
+				at++
+			}
+			if at > lo {
+				lo = at
+			}
+		}
+	}
+	return &listRange{ix, lo, hi}
+}
+
+func encodeListCursor(c listCursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(s string) (listCursor, error) {
+	var c listCursor
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal(data, &c)
+}
+
+// the list is saved as its items, the indexes are rebuilt when it is loaded
+func (l *inventoryList) MarshalJSON() ([]byte, error) {
+	items := make([]InventoryItemListDto, 0, len(l.items))
+	for _, dto := range l.items {
+		items = append(items, dto)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Id < items[j].Id })
+	return json.Marshal(items)
+}
+
+func (l *inventoryList) UnmarshalJSON(data []byte) error {
+	var items []InventoryItemListDto
+	if err := json.Unmarshal(data, &items); err != nil {
+		return err
+	}
+	for _, dto := range items {
+		l.put(dto)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func randomInventoryList(seed int64, n int) *inventoryList {
+	l := newInventoryList()
+	rnd := rand.New(rand.NewSource(seed))
+	for i := 0; i < n; i++ {
+		l.put(InventoryItemListDto{
+			Id:           Guid(fmt.Sprintf("id%03d", i)),
+			Name:         fmt.Sprintf("Item %v", rnd.Intn(50)),
+			CurrentCount: rnd.Intn(20),
+			LastUpdated:  time.Unix(int64(rnd.Intn(100)), 0),
+			Active:       rnd.Intn(3) > 0,
+		})
+	}
+	return l
+}
+
+// allPages follows the cursors from the first page to the last
+func allPages(t *testing.T, l *inventoryList, opts InventoryItemListOptions) []InventoryItemListDto {
+	items := make([]InventoryItemListDto, 0)
+	for {
+		page, err := l.page(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) > opts.Limit {
+			t.Fatalf("page of %v, limit %v", len(page.Items), opts.Limit)
+		}
+		items = append(items, page.Items...)
+		if page.Next == "" {
+			return items
+		}
+		opts.Cursor = page.Next
+	}
+}
+
+func TestInventoryListPagesThroughEveryMatchInOrder(t *testing.T) {
+	l := randomInventoryList(1, 200)
+	min, max := 5, 12
+	filters := map[string]InventoryItemListOptions{
+		"none":   {},
+		"prefix": {NamePrefix: "item 1"},
+		"count":  {MinCount: &min, MaxCount: &max},
+	}
+	for filter, base := range filters {
+		for _, by := range []InventoryItemSort{SortByName, SortByCount, SortByLastUpdated} {
+			for _, descending := range []bool{false, true} {
+				for _, status := range []InventoryItemStatus{ActiveItems, InactiveItems, AllItems} {
+					opts := base
+					opts.Sort, opts.Descending, opts.Status, opts.Limit = by, descending, status, 7
+
+					want := make([]InventoryItemListDto, 0)
+					for _, dto := range l.items {
+						if (status == AllItems || statusOf(dto) == status) &&
+							strings.HasPrefix(sortKey(dto.Name), sortKey(opts.NamePrefix)) &&
+							(opts.MinCount == nil || dto.CurrentCount >= min) &&
+							(opts.MaxCount == nil || dto.CurrentCount <= max) {
+							want = append(want, dto)
+						}
+					}
+					less := l.indexes[ActiveItems][by].less
+					sort.Slice(want, func(i, j int) bool { return less(want[i], want[j]) != descending })
+
+					got := allPages(t, l, opts)
+					if len(got) != len(want) {
+						t.Fatalf("%v filter by %v desc %v %v: %v items, want %v", filter, by, descending, status, len(got), len(want))
+					}
+					for i := range got {
+						if got[i].Id != want[i].Id {
+							t.Fatalf("%v filter by %v desc %v %v: item %v is %v, want %v", filter, by, descending, status, i, got[i].Id, want[i].Id)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestInventoryListCursorCarriesOnAfterEdits(t *testing.T) {
+	l := newInventoryList()
+	for _, name := range []string{"a", "c", "e", "g"} {
+		l.put(InventoryItemListDto{Id: Guid(name), Name: name, Active: true})
+	}
+	first, _ := l.page(InventoryItemListOptions{Limit: 2})
+	if len(first.Items) != 2 || first.Items[1].Name != "c" || first.Next == "" {
+		t.Fatalf("%+v", first)
+	}
+
+	// the item the cursor ends on goes, one is added before it and one after
+	l.remove("c")
+	l.put(InventoryItemListDto{Id: "b", Name: "b", Active: true})
+	l.put(InventoryItemListDto{Id: "d", Name: "d", Active: true})
+	second, _ := l.page(InventoryItemListOptions{Limit: 2, Cursor: first.Next})
+	if len(second.Items) != 2 || second.Items[0].Name != "d" || second.Items[1].Name != "e" {
+		t.Fatalf("%+v", second)
+	}
+
+	if _, err := l.page(InventoryItemListOptions{Sort: SortByCount, Cursor: first.Next}); err != ErrBadCursor {
+		t.Fatal("cursor used for another sort", err)
+	}
+	if _, err := l.page(InventoryItemListOptions{Cursor: "not a cursor"}); err != ErrBadCursor {
+		t.Fatal(err)
+	}
+	if _, err := l.page(InventoryItemListOptions{Status: "deleted"}); !errors.Is(err, ErrInvalidListOptions) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,212 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+type InventorySearchResult struct {
+	Id    Guid
+	Name  string
+	Score float64
+}
+
+// how much a query word counts for, by how well it matched
+const (
+	exactMatchScore  = 1.0
+	prefixMatchScore = 0.75
+	fuzzyMatchScore  = 0.5
+)
+
+// tokenize splits text into lower case words of letters and digits
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// InventorySearchIndex is an inverted index of the words in the names of
+// active inventory items, as a Projection
+type InventorySearchIndex struct {
+	names      map[Guid]string
+	postings   map[string]map[Guid]bool // the items each word appears in
+	terms      []string                 // every word in postings, sorted for prefix matching
+	projection *DeclaredProjection[*InventorySearchIndex]
+	s          sync.RWMutex
+}
+
+func NewInventorySearchIndex() *InventorySearchIndex {
+	ix := &InventorySearchIndex{
+		names:    make(map[Guid]string),
+		postings: make(map[string]map[Guid]bool),
+		terms:    make([]string, 0),
+	}
+	p := NewDeclaredProjection(ix, &ix.s)
+	ProjectWith(p, func(ix *InventorySearchIndex, evt InventoryItemCreated) error {
+		ix.index(evt.Id(), evt.Name())
+		return nil
+	})
+	ProjectWith(p, func(ix *InventorySearchIndex, evt InventoryItemRenamed) error {
+		ix.index(evt.Id(), evt.NewName())
+		return nil
+	})
+	ProjectWith(p, func(ix *InventorySearchIndex, evt InventoryItemDeactivated) error {
+		ix.unindex(evt.Id())
+		return nil
+	})
+	ix.projection = p
+	return ix
+}
+
+func (ix *InventorySearchIndex) Process(evt Event) error {
+	return ix.projection.Process(evt)
+}
+
+func (ix *InventorySearchIndex) Skip(evt Event) error {
+	return ix.projection.Skip(evt)
+}
+
+func (ix *InventorySearchIndex) index(id Guid, name string) {
+	ix.unindex(id)
+	ix.names[id] = name
+	for _, term := range tokenize(name) {
+		items, ok := ix.postings[term]
+		if !ok {
+			items = make(map[Guid]bool)
+			ix.postings[term] = items
+			i := sort.SearchStrings(ix.terms, term)
+			ix.terms = append(ix.terms, "")
+			copy(ix.terms[i+1:], ix.terms[i:])
+			ix.terms[i] = term
+		}
+		items[id] = true
+	}
+}
+
+func (ix *InventorySearchIndex) unindex(id Guid) {
+	name, ok := ix.names[id]
+	if !ok {
+		return
+	}
+	delete(ix.names, id)
+	for _, term := range tokenize(name) {
+		items := ix.postings[term]
+		delete(items, id)
+		if len(items) == 0 {
+			delete(ix.postings, term)
+			if i := sort.SearchStrings(ix.terms, term); i < len(ix.terms) && ix.terms[i] == term {
+				ix.terms = append(ix.terms[:i], ix.terms[i+1:]...)
+			}
+		}
+	}
+}
+
+// Search ranks items by how well their names match the words in text. Each
+// word scores for the best way it matches a word in the name: exactly, as
+// the start of it, or with a typo or two.
+func (ix *InventorySearchIndex) Search(text string, limit int) []InventorySearchResult {
+	ix.s.RLock()
+	defer ix.s.RUnlock()
+
+	scores := make(map[Guid]float64)
+	for _, word := range tokenize(text) {
+		best := make(map[Guid]float64)
+		match := func(term string, score float64) {
+			for id := range ix.postings[term] {
+				if score > best[id] {
+					best[id] = score
+				}
+			}
+		}
+		for i := sort.SearchStrings(ix.terms, word); i < len(ix.terms) && strings.HasPrefix(ix.terms[i], word); i++ {
+			if ix.terms[i] == word {
+				match(ix.terms[i], exactMatchScore)
+			} else {
+				match(ix.terms[i], prefixMatchScore)
+			}
+		}
+		if edits := allowedEdits(word); edits > 0 {
+			for _, term := range ix.terms {
+				if withinEdits(word, term, edits) {
+					match(term, fuzzyMatchScore)
+				}
+			}
+		}
+		for id, score := range best {
+			scores[id] += score
+		}
+	}
+
+	results := make([]InventorySearchResult, 0, len(scores))
+	for id, score := range scores {
+		results = append(results, InventorySearchResult{id, ix.names[id], score})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		if results[i].Name != results[j].Name {
+			return results[i].Name < results[j].Name
+		}
+		return results[i].Id < results[j].Id
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// allowedEdits is how many typos a word may have, short words have to be spelt right
+func allowedEdits(word string) int {
+	switch n := len([]rune(word)); {
+	case n >= 8:
+		return 2
+	case n >= 4:
+		return 1
+	}
+	return 0
+}
+
+// withinEdits reports whether a can be turned into b with at most max
+// insertions, deletions or substitutions
+func withinEdits(a, b string, max int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if d := len(ra) - len(rb); d > max || -d > max {
+		return false
+	}
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		lowest := cur[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			lowest = min(lowest, cur[j])
+		}
+		if lowest > max {
+			return false
+		}
+		prev = cur
+	}
+	return prev[len(rb)] <= max
+}
+
+func (ix *InventorySearchIndex) WaitFor(ctx context.Context, token ConsistencyToken) error {
+	return ix.projection.WaitFor(ctx, token)
+}
+
+// NewInventorySearch is the index readers search, as the InventorySearch
+// projection
+func NewInventorySearch() *Swappable[*InventorySearchIndex] {
+	return NewSwappable("InventorySearch", NewInventorySearchIndex)
+}
@@ -0,0 +1,61 @@
+package SimpleCQRS
+
+import "testing"
+
+func TestWithinEdits(t *testing.T) {
+	cases := []struct {
+		a, b string
+		max  int
+		want bool
+	}{
+		{"widget", "widget", 0, true},
+		{"widget", "widgte", 1, false}, // a transposition is two edits
+		{"widget", "widgte", 2, true},
+		{"widget", "widgt", 1, true},
+		{"widget", "widgets", 1, true},
+		{"widget", "gadget", 1, false},
+		{"widget", "gadget", 2, true},
+		{"screwdriver", "scrwdrivr", 2, true},
+		{"screwdriver", "scrwdrvr", 2, false},
+		{"", "ab", 2, true},
+		{"", "abc", 2, false},
+		{"café", "cafe", 1, true}, // runes, not bytes
+	}
+	for _, c := range cases {
+		if got := withinEdits(c.a, c.b, c.max); got != c.want {
+			t.Errorf("withinEdits(%q, %q, %v) = %v, want %v", c.a, c.b, c.max, got, c.want)
+		}
+		if got := withinEdits(c.b, c.a, c.max); got != c.want {
+			t.Errorf("withinEdits(%q, %q, %v) = %v, want %v", c.b, c.a, c.max, got, c.want)
+		}
+	}
+}
+
+func TestSearchMatchesTyposInLongEnoughWords(t *testing.T) {
+	store := NewEventStore(discardEvents{})
+	store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "Blue Widget"), NewItemsCheckedInToInventory("a", 3)}, -1)
+	store.SaveEvents("b", []Event{NewInventoryItemCreated("b", "Red widgets")}, -1)
+	store.SaveEvents("c", []Event{NewInventoryItemCreated("c", "Screwdriver set")}, -1)
+	store.SaveEvents("d", []Event{NewInventoryItemCreated("d", "Old thing"), NewInventoryItemDeactivated("d")}, -1)
+	search := NewInventorySearch()
+	runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+	if err := runner.Add(search.Definition()); err != nil {
+		t.Fatal(err)
+	}
+
+	if results := search.Load().Search("widget", 0); len(results) != 2 || results[0].Id != "a" || results[1].Id != "b" {
+		t.Fatal(results)
+	}
+	if results := search.Load().Search("scrwdriver", 0); len(results) != 1 || results[0].Id != "c" {
+		t.Fatal(results)
+	}
+	if results := search.Load().Search("rde", 0); len(results) != 0 {
+		t.Fatal("short words have to be spelt right", results)
+	}
+	if results := search.Load().Search("old", 0); len(results) != 0 {
+		t.Fatal("deactivated items are not found", results)
+	}
+	if results := search.Load().Search("widget", 1); len(results) != 1 {
+		t.Fatal(results)
+	}
+}
@@ -0,0 +1,11 @@
+package SimpleCQRS
+
+import (
+	"log"
+	"os"
+)
+
+// Logger is told what the package is doing and what went wrong along the
+// way, commands handled, projections rebuilt and the like. Set it before
+// anything starts, to log.New(io.Discard, "", 0) to hear nothing.
+var Logger = log.New(os.Stdout, "", 0)
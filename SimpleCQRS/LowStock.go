@@ -0,0 +1,277 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LowStockAlert is raised once each time an item's count falls below its
+// reorder point, and resolved when the count is back up to it
+type LowStockAlert struct {
+	Id           Guid
+	Name         string
+	Count        int
+	ReorderPoint int
+	Position     int64 // of the event that took the item below
+	Raised       time.Time
+	Resolved     time.Time // zero while the item is still low
+}
+
+func (alert LowStockAlert) String() string {
+	return fmt.Sprintf("%v is down to %v, below its reorder point of %v", alert.Name, alert.Count, alert.ReorderPoint)
+}
+
+// LowStockItemDto is an item that is below its reorder point
+type LowStockItemDto struct {
+	Id           Guid
+	Name         string
+	Count        int
+	ReorderPoint int
+	Since        time.Time
+}
+
+type lowStockItem struct {
+	name         string
+	count        int
+	reorderPoint int
+	active       bool
+	alert        int // of the open alert in alerts, -1 if there is none
+}
+
+// LowStockView tracks which items are below their reorder points and every
+// alert raised for them, as a Projection
+type LowStockView struct {
+	items      map[Guid]*lowStockItem
+	alerts     []LowStockAlert // oldest first
+	notify     func(alert LowStockAlert)
+	projection *DeclaredProjection[*LowStockView]
+	s          sync.RWMutex
+}
+
+func NewLowStockView() *LowStockView {
+	view := &LowStockView{items: make(map[Guid]*lowStockItem), alerts: make([]LowStockAlert, 0)}
+	p := NewDeclaredProjection(view, &view.s)
+	ProjectWith(p, func(view *LowStockView, evt InventoryItemCreated) error {
+		view.items[evt.Id()] = &lowStockItem{name: evt.Name(), active: true, alert: -1}
+		return nil
+	})
+	ProjectWith(p, func(view *LowStockView, evt InventoryItemRenamed) error {
+		return view.update(evt, func(item *lowStockItem) { item.name = evt.NewName() })
+	})
+	ProjectWith(p, func(view *LowStockView, evt InventoryItemDeactivated) error {
+		return view.update(evt, func(item *lowStockItem) { item.active = false })
+	})
+	ProjectWith(p, func(view *LowStockView, evt ItemsCheckedInToInventory) error {
+		return view.update(evt, func(item *lowStockItem) { item.count += evt.Count() })
+	})
+	ProjectWith(p, func(view *LowStockView, evt ItemsRemovedFromInventory) error {
+		return view.update(evt, func(item *lowStockItem) { item.count -= evt.Count() })
+	})
+	ProjectWith(p, func(view *LowStockView, evt ReorderPointSet) error {
+		return view.update(evt, func(item *lowStockItem) { item.reorderPoint = evt.ReorderPoint() })
+	})
+	view.projection = p
+	return view
+}
+
+func (view *LowStockView) Process(evt Event) error {
+	return view.projection.Process(evt)
+}
+
+func (view *LowStockView) Skip(evt Event) error {
+	return view.projection.Skip(evt)
+}
+
+// update changes an item, then raises an alert if it has just gone low or
+// resolves the open one if it no longer is
+func (view *LowStockView) update(evt AggregateEvent, change func(item *lowStockItem)) error {
+	item, ok := view.items[evt.Id()]
+	if !ok {
+		return fmt.Errorf("no stock level for item %v", evt.Id())
+	}
+	change(item)
+
+	var at time.Time
+	if te, ok := evt.(TimedEvent); ok {
+		at = te.Time()
+	}
+	low := item.active && item.reorderPoint > 0 && item.count < item.reorderPoint
+	switch {
+	case low && item.alert < 0:
+		alert := LowStockAlert{Id: evt.Id(), Name: item.name, Count: item.count, ReorderPoint: item.reorderPoint, Raised: at}
+		if pe, ok := evt.(PositionedEvent); ok {
+			alert.Position = pe.Position()
+		}
+		item.alert = len(view.alerts)
+		view.alerts = append(view.alerts, alert)
+		if view.notify != nil {
+			view.notify(alert)
+		}
+	case !low && item.alert >= 0:
+		view.alerts[item.alert].Resolved = at
+		item.alert = -1
+	}
+	return nil
+}
+
+// notifyTo passes every alert raised from now on to notify, or stops if it is nil
+func (view *LowStockView) notifyTo(notify func(alert LowStockAlert)) {
+	view.s.Lock()
+	defer view.s.Unlock()
+
+	view.notify = notify
+}
+
+// LowStockItems lists the items below their reorder points, longest low first
+func (view *LowStockView) LowStockItems() []LowStockItemDto {
+	view.s.RLock()
+	defer view.s.RUnlock()
+
+	items := make([]LowStockItemDto, 0)
+	for id, item := range view.items {
+		if item.alert >= 0 {
+			items = append(items, LowStockItemDto{id, item.name, item.count, item.reorderPoint, view.alerts[item.alert].Raised})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool {
+		if !items[i].Since.Equal(items[j].Since) {
+			return items[i].Since.Before(items[j].Since)
+		}
+		return items[i].Id < items[j].Id
+	})
+	return items
+}
+
+// Alerts lists the alerts raised, newest first, every one if limit is 0
+func (view *LowStockView) Alerts(limit int) []LowStockAlert {
+	view.s.RLock()
+	defer view.s.RUnlock()
+
+	n := len(view.alerts)
+	if limit > 0 && limit < n {
+		n = limit
+	}
+	alerts := make([]LowStockAlert, 0, n)
+	for i := len(view.alerts) - 1; i >= 0 && len(alerts) < n; i-- {
+		alerts = append(alerts, view.alerts[i])
+	}
+	return alerts
+}
+
+func (view *LowStockView) WaitFor(ctx context.Context, token ConsistencyToken) error {
+	return view.projection.WaitFor(ctx, token)
+}
+
+// AlertNotifier tells someone who can restock an item that it is low
+type AlertNotifier interface {
+	Notify(alert LowStockAlert) error
+}
+
+// how many alerts can wait for each notifier before more are dropped
+const alertQueueSize = 64
+
+// LowStockAlerter sends each alert to every notifier, in the background so
+// a slow one cannot hold up the projection. Each notifier has a queue of its
+// own, an alert that finds it full is dropped. The position of the last
+// alert sent is kept in a CheckpointStore, an alert raised again when the
+// view is built again, after a restart too, is no later than it and is
+// dropped too.
+type LowStockAlerter struct {
+	queues      []chan LowStockAlert
+	workers     sync.WaitGroup
+	checkpoints CheckpointStore
+	sent        int64 // the position of the last alert sent
+	stopped     bool
+	s           sync.Mutex
+}
+
+// the checkpoint the position of the last alert sent is saved as
+const alertedCheckpoint = "LowStockAlerter"
+
+func NewLowStockAlerter(checkpoints CheckpointStore, notifiers ...AlertNotifier) (*LowStockAlerter, error) {
+	sent, err := checkpoints.Load(alertedCheckpoint)
+	if err != nil {
+		return nil, err
+	}
+	alerter := &LowStockAlerter{queues: make([]chan LowStockAlert, 0, len(notifiers)), checkpoints: checkpoints, sent: sent}
+	for _, notifier := range notifiers {
+		queue := make(chan LowStockAlert, alertQueueSize)
+		alerter.queues = append(alerter.queues, queue)
+		alerter.workers.Add(1)
+		go alerter.notify(notifier, queue)
+	}
+	return alerter, nil
+}
+
+func (alerter *LowStockAlerter) notify(notifier AlertNotifier, queue chan LowStockAlert) {
+	defer alerter.workers.Done()
+
+	for alert := range queue {
+		if err := notifier.Notify(alert); err != nil {
+			Logger.Printf("Low stock alert for %v not sent by %T: %v", alert.Id, notifier, err)
+		}
+	}
+}
+
+func (alerter *LowStockAlerter) Alert(alert LowStockAlert) {
+	alerter.s.Lock()
+	defer alerter.s.Unlock()
+
+	if alerter.stopped || alert.Position <= alerter.sent {
+		return
+	}
+	alerter.sent = alert.Position
+	if err := alerter.checkpoints.Save(alertedCheckpoint, alert.Position); err != nil {
+		Logger.Println("Low stock alert for", alert.Id, "may be sent again, saving its position failed:", err)
+	}
+	for _, queue := range alerter.queues {
+		select {
+		case queue <- alert:
+		default:
+			Logger.Println("Low stock alert queue full, dropping alert for", alert.Id)
+		}
+	}
+}
+
+// Stop drops any later alerts and waits for those queued to be sent, or
+// for ctx to end
+func (alerter *LowStockAlerter) Stop(ctx context.Context) error {
+	alerter.s.Lock()
+	if !alerter.stopped {
+		alerter.stopped = true
+		for _, queue := range alerter.queues {
+			close(queue)
+		}
+	}
+	alerter.s.Unlock()
+
+	sent := make(chan struct{})
+	go func() {
+		alerter.workers.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("low stock alerts still being sent: %w", ctx.Err())
+	}
+}
+
+// NewLowStockAlerts is the low stock readers see, as the LowStock
+// projection. Only the view in use raises alerts with the alerter.
+func NewLowStockAlerts(alerter *LowStockAlerter) *Swappable[*LowStockView] {
+	alerts := NewSwappable("LowStock", NewLowStockView)
+	if alerter != nil {
+		alerts.OnSwap(func(old, view *LowStockView) {
+			if old != view {
+				old.notifyTo(nil)
+			}
+			view.notifyTo(alerter.Alert)
+		})
+	}
+	return alerts
+}
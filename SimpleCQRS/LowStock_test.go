@@ -0,0 +1,162 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type recordingNotifier chan LowStockAlert
+
+func (rn recordingNotifier) Notify(alert LowStockAlert) error {
+	rn <- alert
+	return nil
+}
+
+func TestLowStockViewRaisesOneAlertPerBreach(t *testing.T) {
+	store := NewEventStore(discardEvents{})
+	save := func(events ...Event) {
+		version, _ := store.GetEventsForAggregate("a")
+		if _, err := store.SaveEvents("a", events, len(version)-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := make(recordingNotifier, 10)
+	alerter, _ := NewLowStockAlerter(NewInMemoryCheckpointStore(), sent)
+	alerts := NewLowStockAlerts(alerter)
+	runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+	if err := runner.Add(alerts.Definition()); err != nil {
+		t.Fatal(err)
+	}
+
+	save(NewInventoryItemCreated("a", "bolts"), NewItemsCheckedInToInventory("a", 10), NewReorderPointSet("a", 5))
+	// staying low, and going lower, is the same breach
+	save(NewItemsRemovedFromInventory("a", 6), NewItemsRemovedFromInventory("a", 1), NewItemsRemovedFromInventory("a", 2))
+	runner.CatchUp(nil)
+	first := <-sent
+	if first.Count != 4 || first.ReorderPoint != 5 || first.Position != 4 {
+		t.Fatalf("%+v", first)
+	}
+	if low := alerts.Load().LowStockItems(); len(low) != 1 || low[0].Count != 1 {
+		t.Fatalf("%+v", low)
+	}
+
+	// back up to the reorder point resolves it, down again is a new breach
+	save(NewItemsCheckedInToInventory("a", 4), NewItemsRemovedFromInventory("a", 1))
+	runner.CatchUp(nil)
+	if second := <-sent; second.Count != 4 || second.Position != 8 {
+		t.Fatalf("%+v", second)
+	}
+	raised := alerts.Load().Alerts(0)
+	if len(raised) != 2 || !raised[0].Resolved.IsZero() || raised[1].Resolved.IsZero() {
+		t.Fatalf("%+v", raised)
+	}
+
+	// a rebuild raises the same alerts again, but they are not sent again
+	if err := runner.Rebuild("LowStock"); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts.Load().Alerts(0)) != 2 {
+		t.Fatalf("%+v", alerts.Load().Alerts(0))
+	}
+	select {
+	case alert := <-sent:
+		t.Fatalf("sent again %+v", alert)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	save(NewInventoryItemDeactivated("a"))
+	runner.CatchUp(nil)
+	if low := alerts.Load().LowStockItems(); len(low) != 0 {
+		t.Fatalf("deactivated but still low %+v", low)
+	}
+}
+
+func TestLowStockAlertsAreNotSentAgainAfterARestart(t *testing.T) {
+	store := NewEventStore(discardEvents{})
+	store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "bolts"), NewReorderPointSet("a", 5), NewItemsCheckedInToInventory("a", 2)}, -1)
+	path := filepath.Join(t.TempDir(), "alerted.json")
+	checkpoints, err := NewFileCheckpointStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := func() (recordingNotifier, *ProjectionRunner) {
+		sent := make(recordingNotifier, 10)
+		alerter, err := NewLowStockAlerter(checkpoints, sent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		alerts := NewLowStockAlerts(alerter)
+		runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+		if err := runner.Add(alerts.Definition()); err != nil {
+			t.Fatal(err)
+		}
+		alerter.Stop(context.Background())
+		return sent, runner
+	}
+
+	if sent, _ := start(); len(sent) != 1 {
+		t.Fatalf("%v alerts sent, want 1", len(sent))
+	}
+	// the view is built again from every event, but the alert has been sent
+	checkpoints, _ = NewFileCheckpointStore(path)
+	if sent, _ := start(); len(sent) != 0 {
+		t.Fatalf("%v alerts sent again", len(sent))
+	}
+}
+
+type blockingNotifier struct {
+	taken   chan struct{}
+	release chan struct{}
+	sent    chan LowStockAlert
+}
+
+func newBlockingNotifier() blockingNotifier {
+	return blockingNotifier{make(chan struct{}, 2*alertQueueSize), make(chan struct{}), make(chan LowStockAlert, 2*alertQueueSize)}
+}
+
+func (bn blockingNotifier) Notify(alert LowStockAlert) error {
+	bn.taken <- struct{}{}
+	<-bn.release
+	bn.sent <- alert
+	return nil
+}
+
+func TestLowStockAlerterDropsAlertsOnceAQueueIsFull(t *testing.T) {
+	slow := newBlockingNotifier()
+	alerter, _ := NewLowStockAlerter(NewInMemoryCheckpointStore(), slow)
+	alerter.Alert(LowStockAlert{Id: "a", Position: 1})
+	<-slow.taken
+	for position := int64(2); position <= alertQueueSize+10; position++ {
+		alerter.Alert(LowStockAlert{Id: "a", Position: position})
+	}
+	close(slow.release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := alerter.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the notifier was sending one alert and had a full queue behind it
+	if len(slow.sent) != alertQueueSize+1 {
+		t.Fatal(len(slow.sent))
+	}
+	alerter.Alert(LowStockAlert{Id: "a", Position: 1000})
+	if len(slow.sent) != alertQueueSize+1 {
+		t.Fatal("sent after Stop")
+	}
+}
+
+func TestLowStockAlerterStopGivesUpWhenCtxEnds(t *testing.T) {
+	stuck := newBlockingNotifier()
+	defer close(stuck.release)
+	alerter, _ := NewLowStockAlerter(NewInMemoryCheckpointStore(), stuck)
+	alerter.Alert(LowStockAlert{Id: "a", Position: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := alerter.Stop(ctx); err == nil {
+		t.Fatal("stopped while an alert was still being sent")
+	}
+}
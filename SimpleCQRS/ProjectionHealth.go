@@ -0,0 +1,290 @@
+package SimpleCQRS
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProjectionThresholds decide when a projection counts as degraded, a zero
+// threshold is not checked
+type ProjectionThresholds struct {
+	MaxLag               int64         // events behind the event store head
+	MaxStaleness         time.Duration // how long it may be behind without processing anything
+	MaxConsecutiveErrors int
+}
+
+func DefaultProjectionThresholds() ProjectionThresholds {
+	return ProjectionThresholds{
+		MaxLag:               100,
+		MaxStaleness:         30 * time.Second,
+		MaxConsecutiveErrors: 3,
+	}
+}
+
+type ProjectionStatus struct {
+	Name              string
+	LastPosition      int64 // the furthest event processed
+	LastProcessedAt   time.Time
+	Processed         uint64
+	Errors            uint64
+	ConsecutiveErrors int
+	LastError         string
+	Skipped           uint64 // events given up on, the projection is wrong until it is rebuilt
+	LastSkipped       string
+	Head              int64 // the last event the projection is interested in
+	Lag               int64
+	Degraded          bool
+	Reasons           []string
+}
+
+type projectionHealth struct {
+	status ProjectionStatus
+	since  time.Time // when tracking began
+	all    bool      // processes every event, rather than only types
+	types  map[reflect.Type]bool
+	head   int64 // the position of the last event of types seen by Watch
+}
+
+// ProjectionMonitor tracks how far each projection has got through the event
+// store. Projections are tracked by registering their processors through
+// Track, e.g.
+//
+//	auditBus := monitor.Track("DeactivationAudit", bus)
+//	RegisterEventProcessor(auditBus, func(evt InventoryItemDeactivated) error {
+//		fmt.Println("Deactivated", evt.Id(), "by", evt.User())
+//		return nil
+//	})
+//
+// A ProjectionRunner reports each of its projections under its own name
+// once it has been given the monitor through ReportTo.
+//
+// Events are processed concurrently, so the lag is measured from the
+// furthest event processed. A projection registered through Track only sees
+// the event types it registered for, so once the monitor has been given the
+// bus through Watch its lag is measured to the last event of those types
+// rather than to the event store head.
+type ProjectionMonitor struct {
+	store       EventStore
+	clock       Clock
+	thresholds  ProjectionThresholds
+	projections map[string]*projectionHealth
+	watching    bool
+	s           sync.Mutex
+}
+
+func NewProjectionMonitor(store EventStore, clock Clock, thresholds ProjectionThresholds) *ProjectionMonitor {
+	return &ProjectionMonitor{
+		store:       store,
+		clock:       clock,
+		thresholds:  thresholds,
+		projections: make(map[string]*projectionHealth),
+	}
+}
+
+// Track returns a registry that records every event the named projection processes
+func (m *ProjectionMonitor) Track(name string, r EventProcessorRegistry) EventProcessorRegistry {
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	m.track(name)
+	return &trackedRegistry{m, name, r}
+}
+
+func (m *ProjectionMonitor) track(name string) *projectionHealth {
+	health, ok := m.projections[name]
+	if !ok {
+		health = &projectionHealth{status: ProjectionStatus{Name: name}, since: m.clock.Now(), types: make(map[reflect.Type]bool)}
+		m.projections[name] = health
+	}
+	return health
+}
+
+// Watch has the monitor see every event published, to know the last event
+// each projection registered through Track is interested in
+func (m *ProjectionMonitor) Watch(s EventSubscriber) (func(), error) {
+	m.s.Lock()
+	m.watching = true
+	m.s.Unlock()
+
+	return s.SubscribeEvents(EventFilter{}, func(evt Event) error {
+		pe, ok := evt.(PositionedEvent)
+		if !ok {
+			return nil
+		}
+		m.s.Lock()
+		defer m.s.Unlock()
+
+		for _, health := range m.projections {
+			if health.types[reflect.TypeOf(evt)] && pe.Position() > health.head {
+				health.head = pe.Position()
+			}
+		}
+		return nil
+	})
+}
+
+type trackedRegistry struct {
+	monitor *ProjectionMonitor
+	name    string
+	next    EventProcessorRegistry
+}
+
+func (tr *trackedRegistry) AddEventProcessor(eventType reflect.Type, processor EventProcessor) error {
+	tr.monitor.s.Lock()
+	tr.monitor.track(tr.name).types[eventType] = true
+	tr.monitor.s.Unlock()
+
+	return tr.next.AddEventProcessor(eventType, tr.monitor.processor(tr.name, processor))
+}
+
+// Processor records every event processor handles against the named
+// projection, which is expected to process every event
+func (m *ProjectionMonitor) Processor(name string, processor EventProcessor) EventProcessor {
+	m.trackAll(name)
+	return m.processor(name, processor)
+}
+
+// trackAll tracks the named projection, which is expected to process every event
+func (m *ProjectionMonitor) trackAll(name string) {
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	m.track(name).all = true
+}
+
+// restart tracks the named projection, which is expected to process every
+// event, from scratch
+func (m *ProjectionMonitor) restart(name string) {
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	delete(m.projections, name)
+	m.track(name).all = true
+}
+
+// rename reports what has been tracked under from under to, in place of
+// what to had
+func (m *ProjectionMonitor) rename(from, to string) {
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	health, ok := m.projections[from]
+	if !ok {
+		return
+	}
+	delete(m.projections, from)
+	health.status.Name = to
+	m.projections[to] = health
+}
+
+func (m *ProjectionMonitor) processor(name string, processor EventProcessor) EventProcessor {
+	return func(evt Event) error {
+		err := processor(evt)
+		m.processed(name, evt, err)
+		return err
+	}
+}
+
+func (m *ProjectionMonitor) processed(name string, evt Event, err error) {
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	status := &m.track(name).status
+	if err != nil {
+		status.Errors++
+		status.ConsecutiveErrors++
+		status.LastError = err.Error()
+		return
+	}
+	status.Processed++
+	status.ConsecutiveErrors = 0
+	status.LastProcessedAt = m.clock.Now()
+	if pe, ok := evt.(PositionedEvent); ok && pe.Position() > status.LastPosition {
+		status.LastPosition = pe.Position()
+	}
+}
+
+// skipped records an event the named projection has given up on
+func (m *ProjectionMonitor) skipped(name string, position int64, err error) {
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	status := &m.track(name).status
+	status.Skipped++
+	status.LastSkipped = fmt.Sprintf("position %v: %v", position, err)
+}
+
+func (m *ProjectionMonitor) Status(name string) (ProjectionStatus, error) {
+	head := m.store.Head()
+
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	health, ok := m.projections[name]
+	if !ok {
+		return ProjectionStatus{}, fmt.Errorf("projection %v is not tracked", name)
+	}
+	return m.evaluate(health, head), nil
+}
+
+// Statuses lists every tracked projection by name
+func (m *ProjectionMonitor) Statuses() []ProjectionStatus {
+	head := m.store.Head()
+
+	m.s.Lock()
+	defer m.s.Unlock()
+
+	statuses := make([]ProjectionStatus, 0, len(m.projections))
+	for _, health := range m.projections {
+		statuses = append(statuses, m.evaluate(health, head))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (m *ProjectionMonitor) Degraded() bool {
+	for _, status := range m.Statuses() {
+		if status.Degraded {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ProjectionMonitor) evaluate(health *projectionHealth, head int64) ProjectionStatus {
+	status := health.status
+	if m.watching && !health.all {
+		head = health.head
+	}
+	status.Head = head
+	status.Lag = head - status.LastPosition
+	if status.Lag < 0 {
+		status.Lag = 0
+	}
+	status.Reasons = make([]string, 0)
+
+	t := m.thresholds
+	if t.MaxLag > 0 && status.Lag > t.MaxLag {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("%v events behind", status.Lag))
+	}
+	if t.MaxStaleness > 0 && status.Lag > 0 {
+		last := status.LastProcessedAt
+		if last.IsZero() {
+			last = health.since
+		}
+		if idle := m.clock.Now().Sub(last); idle > t.MaxStaleness {
+			status.Reasons = append(status.Reasons, fmt.Sprintf("behind and idle for %v", idle.Round(time.Second)))
+		}
+	}
+	if t.MaxConsecutiveErrors > 0 && status.ConsecutiveErrors >= t.MaxConsecutiveErrors {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("%v errors in a row", status.ConsecutiveErrors))
+	}
+	if status.Skipped > 0 {
+		status.Reasons = append(status.Reasons, fmt.Sprintf("%v events skipped", status.Skipped))
+	}
+	status.Degraded = len(status.Reasons) > 0
+	return status
+}
@@ -0,0 +1,74 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestProjectionMonitorDegradesOnLagStalenessAndErrors(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus := NewSimulatedBus(1, FaultProfile{}, clock)
+	store := NewEventStore(bus)
+	monitor := NewProjectionMonitor(store, clock, ProjectionThresholds{MaxLag: 2, MaxStaleness: time.Minute, MaxConsecutiveErrors: 2})
+	fail := false
+	RegisterEventProcessor(monitor.Track("created", bus), func(evt InventoryItemCreated) error {
+		if fail {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "widget")}, -1)
+	bus.RunUntilIdle(100)
+	if status, _ := monitor.Status("created"); status.Lag != 0 || status.Degraded || status.LastPosition != 1 {
+		t.Fatalf("%+v", status)
+	}
+
+	for _, id := range []Guid{"b", "c", "d"} {
+		store.SaveEvents(id, []Event{NewInventoryItemCreated(id, "widget")}, -1)
+	}
+	if status, _ := monitor.Status("created"); status.Lag != 3 || !status.Degraded {
+		t.Fatalf("%+v", status)
+	}
+
+	fail = true
+	bus.RunUntilIdle(100)
+	clock.Advance(2 * time.Minute)
+	status, _ := monitor.Status("created")
+	if len(status.Reasons) != 3 || status.Errors != 3 {
+		t.Fatalf("%+v", status)
+	}
+}
+
+func TestProjectionMonitorIsNotBehindOnEventsAProjectionIgnores(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus := NewSimulatedBus(1, FaultProfile{}, clock)
+	store := NewEventStore(bus)
+	monitor := NewProjectionMonitor(store, clock, ProjectionThresholds{MaxLag: 1})
+	if _, err := monitor.Watch(bus); err != nil {
+		t.Fatal(err)
+	}
+	RegisterEventProcessor(monitor.Track("created", bus), func(evt InventoryItemCreated) error { return nil })
+	everything := monitor.Processor("everything", func(evt Event) error { return nil })
+	bus.SubscribeEvents(EventFilter{}, everything)
+
+	store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "widget")}, -1)
+	for v := 0; v < 5; v++ {
+		store.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", 1)}, v)
+	}
+	if status, _ := monitor.Status("everything"); status.Lag != 6 || !status.Degraded {
+		t.Fatalf("before delivery %+v", status)
+	}
+	bus.RunUntilIdle(100)
+
+	for _, name := range []string{"created", "everything"} {
+		status, _ := monitor.Status(name)
+		if status.Lag != 0 || status.Degraded {
+			t.Fatalf("%+v", status)
+		}
+	}
+	if status, _ := monitor.Status("created"); status.Head != 1 {
+		t.Fatalf("created is interested up to %v, want 1", status.Head)
+	}
+}
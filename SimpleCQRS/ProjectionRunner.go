@@ -0,0 +1,336 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Projection builds a read model from events, in the order they were saved.
+// Process is passed every event and ignores the ones it has no use for.
+type Projection interface {
+	Process(evt Event) error
+}
+
+// PersistentProjection keeps its own checkpoint, saved in the same write as
+// its state, so the two can never disagree after a crash. The runner uses it
+// in place of the CheckpointStore.
+type PersistentProjection interface {
+	Projection
+	Checkpoint() int64
+	Commit(position int64) error
+}
+
+type ProjectionDefinition struct {
+	Name string
+	// New makes an empty instance, for the first build and for rebuilds
+	New func() (Projection, error)
+	// Open, if set, returns the instance that matches the stored checkpoint,
+	// or that was saved with its own if it is a PersistentProjection
+	Open func() (Projection, error)
+	// Activate makes an instance the one readers see, it has to swap atomically
+	Activate func(p Projection)
+}
+
+// EventSkipper is a Projection that has to be told about events the runner
+// gives up on, so that it does not wait for them
+type EventSkipper interface {
+	Skip(evt Event) error
+}
+
+var ErrRebuildRunning = errors.New("projection is already being rebuilt")
+
+type runningProjection struct {
+	def        ProjectionDefinition
+	current    Projection
+	checkpoint int64
+	rebuilding bool
+	s          sync.Mutex
+}
+
+// ProjectionRunner feeds projections from the event store rather than the
+// bus, so each sees every event exactly once and in order, and records how
+// far each has got in a CheckpointStore. Events published on the bus only
+// nudge it to catch up, e.g.
+//
+//	runner.Add(InventoryReadModelProjection(&facade))
+//	bus.SubscribeEvents(EventFilter{}, runner.CatchUp)
+//
+// Checkpoints are saved once a projection has caught up, so a projection
+// that keeps its state elsewhere may be given some events again after a
+// crash, unless it is a PersistentProjection.
+//
+// Each projection's progress is reported under its name to the monitor given
+// to ReportTo. An event a projection fails on is tried MaxAttempts times in
+// a row, then skipped so the projection can carry on, and reported too. The
+// projection is wrong from then on until it is rebuilt. A rebuild is reported
+// as "<name> (rebuild)" until it is activated, when its progress becomes the
+// projection's.
+type ProjectionRunner struct {
+	BatchSize   int
+	MaxAttempts int
+
+	store       EventStore
+	checkpoints CheckpointStore
+	monitor     *ProjectionMonitor
+	projections map[string]*runningProjection
+	s           sync.RWMutex
+}
+
+func NewProjectionRunner(store EventStore, checkpoints CheckpointStore) *ProjectionRunner {
+	return &ProjectionRunner{
+		store:       store,
+		checkpoints: checkpoints,
+		BatchSize:   500,
+		MaxAttempts: 3,
+		projections: make(map[string]*runningProjection),
+	}
+}
+
+// ReportTo has every projection, those added already and those added later,
+// tracked by monitor
+func (pr *ProjectionRunner) ReportTo(monitor *ProjectionMonitor) {
+	pr.s.Lock()
+	defer pr.s.Unlock()
+
+	pr.monitor = monitor
+	for name := range pr.projections {
+		monitor.trackAll(name)
+	}
+}
+
+func (pr *ProjectionRunner) reporter() *ProjectionMonitor {
+	pr.s.RLock()
+	defer pr.s.RUnlock()
+
+	return pr.monitor
+}
+
+// Add activates the projection from its checkpoint and catches it up
+func (pr *ProjectionRunner) Add(def ProjectionDefinition) error {
+	current, checkpoint, err := pr.open(def)
+	if err != nil {
+		return err
+	}
+
+	pr.s.Lock()
+	if _, ok := pr.projections[def.Name]; ok {
+		pr.s.Unlock()
+		return fmt.Errorf("projection %v already added", def.Name)
+	}
+	rp := &runningProjection{def: def, current: current, checkpoint: checkpoint}
+	pr.projections[def.Name] = rp
+	if pr.monitor != nil {
+		pr.monitor.trackAll(def.Name)
+	}
+	pr.s.Unlock()
+
+	def.Activate(current)
+	return pr.catchUp(rp)
+}
+
+// open resumes the projection from where it got to, or starts a new one
+func (pr *ProjectionRunner) open(def ProjectionDefinition) (Projection, int64, error) {
+	if def.Open != nil {
+		p, err := def.Open()
+		if err != nil {
+			return nil, 0, err
+		}
+		var checkpoint int64
+		if pp, ok := p.(PersistentProjection); ok {
+			checkpoint = pp.Checkpoint()
+		} else if checkpoint, err = pr.checkpoints.Load(def.Name); err != nil {
+			return nil, 0, err
+		}
+		if head := pr.store.Head(); checkpoint > head {
+			Logger.Println("Projection", def.Name, "is at position", checkpoint, "but the event store ends at", head, "so it starts again")
+		} else if checkpoint > 0 {
+			return p, checkpoint, nil
+		}
+	}
+	p, err := def.New()
+	return p, 0, err
+}
+
+// save records how far p has got
+func (pr *ProjectionRunner) save(name string, p Projection, checkpoint int64) error {
+	if pp, ok := p.(PersistentProjection); ok {
+		return pp.Commit(checkpoint)
+	}
+	return pr.checkpoints.Save(name, checkpoint)
+}
+
+func (pr *ProjectionRunner) projection(name string) (*runningProjection, error) {
+	pr.s.RLock()
+	defer pr.s.RUnlock()
+
+	rp, ok := pr.projections[name]
+	if !ok {
+		return nil, fmt.Errorf("projection %v not added", name)
+	}
+	return rp, nil
+}
+
+// CatchUp brings every projection up to the head of the event store. It is
+// an EventProcessor so the bus can call it whenever an event is saved.
+func (pr *ProjectionRunner) CatchUp(evt Event) error {
+	pr.s.RLock()
+	running := make([]*runningProjection, 0, len(pr.projections))
+	for _, rp := range pr.projections {
+		running = append(running, rp)
+	}
+	pr.s.RUnlock()
+
+	var result error
+	for _, rp := range running {
+		if err := pr.catchUp(rp); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (pr *ProjectionRunner) catchUp(rp *runningProjection) error {
+	rp.s.Lock()
+	defer rp.s.Unlock()
+
+	checkpoint, err := pr.replay(rp.def.Name, rp.current, rp.checkpoint)
+	if checkpoint != rp.checkpoint {
+		rp.checkpoint = checkpoint
+		if saveErr := pr.save(rp.def.Name, rp.current, checkpoint); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	}
+	return err
+}
+
+// replay feeds p the events after checkpoint until it reaches the head, and
+// returns the position it got to
+func (pr *ProjectionRunner) replay(name string, p Projection, checkpoint int64) (int64, error) {
+	for {
+		events, err := pr.store.ReadAll(checkpoint, pr.BatchSize)
+		if err != nil || len(events) == 0 {
+			return checkpoint, err
+		}
+		for _, evt := range events {
+			checkpoint++
+			if err := pr.process(name, p, evt); err != nil {
+				pr.skip(name, p, evt, checkpoint, err)
+			}
+		}
+	}
+}
+
+func (pr *ProjectionRunner) process(name string, p Projection, evt Event) error {
+	monitor := pr.reporter()
+	try := func() error {
+		err := p.Process(evt)
+		if monitor != nil {
+			monitor.processed(name, evt, err)
+		}
+		return err
+	}
+	err := try()
+	for attempt := 1; err != nil && attempt < pr.MaxAttempts; attempt++ {
+		err = try()
+	}
+	return err
+}
+
+// skip gives up on an event p keeps failing on
+func (pr *ProjectionRunner) skip(name string, p Projection, evt Event, position int64, err error) {
+	Logger.Println("Projection", name, "skipped the event at position", position, "after", pr.MaxAttempts, "attempts:", err)
+	if skipper, ok := p.(EventSkipper); ok {
+		if err := skipper.Skip(evt); err != nil {
+			Logger.Println("Projection", name, "could not skip the event at position", position, ":", err)
+		}
+	}
+	if monitor := pr.reporter(); monitor != nil {
+		monitor.skipped(name, position, err)
+	}
+}
+
+func (pr *ProjectionRunner) Checkpoint(name string) (int64, error) {
+	rp, err := pr.projection(name)
+	if err != nil {
+		return 0, err
+	}
+	rp.s.Lock()
+	defer rp.s.Unlock()
+
+	return rp.checkpoint, nil
+}
+
+// Rebuild builds the projection again from the start of the event store,
+// see Replace
+func (pr *ProjectionRunner) Rebuild(name string) error {
+	rp, err := pr.projection(name)
+	if err != nil {
+		return err
+	}
+	rp.s.Lock()
+	def := rp.def
+	rp.s.Unlock()
+
+	return pr.Replace(def)
+}
+
+// Replace builds a new version of a running projection alongside the old
+// one, which carries on serving readers. Once the new version has caught up
+// it is activated and the old one is dropped.
+func (pr *ProjectionRunner) Replace(def ProjectionDefinition) error {
+	rp, err := pr.projection(def.Name)
+	if err != nil {
+		return err
+	}
+	rp.s.Lock()
+	if rp.rebuilding {
+		rp.s.Unlock()
+		return ErrRebuildRunning
+	}
+	rp.rebuilding = true
+	rp.s.Unlock()
+	defer func() {
+		rp.s.Lock()
+		rp.rebuilding = false
+		rp.s.Unlock()
+	}()
+
+	green, err := def.New()
+	if err != nil {
+		return err
+	}
+	// the new version is reported apart from the one readers still see
+	// until it is activated
+	rebuild := def.Name + " (rebuild)"
+	monitor := pr.reporter()
+	if monitor != nil {
+		monitor.restart(rebuild)
+	}
+	Logger.Println("Rebuilding projection:", def.Name)
+	checkpoint, err := pr.replay(rebuild, green, 0)
+	if err != nil {
+		return err
+	}
+
+	// the old version is held still for the last few events and the swap
+	rp.s.Lock()
+	defer rp.s.Unlock()
+
+	checkpoint, err = pr.replay(rebuild, green, checkpoint)
+	if err != nil {
+		return err
+	}
+	if err := pr.save(def.Name, green, checkpoint); err != nil {
+		return err
+	}
+	def.Activate(green)
+	if monitor != nil {
+		monitor.rename(rebuild, def.Name)
+	}
+	rp.def = def
+	rp.current = green
+	rp.checkpoint = checkpoint
+	Logger.Println("Rebuilt projection:", def.Name, "at position", checkpoint)
+	return nil
+}
@@ -0,0 +1,176 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingProjection counts the items checked in, failing on any count of
+// poison
+type countingProjection struct {
+	total   int
+	tries   int
+	skipped []Event
+	poison  int
+}
+
+func (cp *countingProjection) Process(evt Event) error {
+	checkedIn, ok := evt.(ItemsCheckedInToInventory)
+	if !ok {
+		return nil
+	}
+	cp.tries++
+	if cp.poison != 0 && checkedIn.Count() == cp.poison {
+		return errors.New("poison")
+	}
+	cp.total += checkedIn.Count()
+	return nil
+}
+
+func (cp *countingProjection) Skip(evt Event) error {
+	cp.skipped = append(cp.skipped, evt)
+	return nil
+}
+
+func countingDefinition(active *atomic.Pointer[countingProjection], poison int) ProjectionDefinition {
+	return ProjectionDefinition{
+		Name: "Counts",
+		New: func() (Projection, error) {
+			return &countingProjection{poison: poison}, nil
+		},
+		Activate: func(p Projection) {
+			active.Store(p.(*countingProjection))
+		},
+	}
+}
+
+func checkedInStore(t *testing.T, counts ...int) EventStore {
+	store := NewEventStore(discardEvents{})
+	if _, err := store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "widget")}, -1); err != nil {
+		t.Fatal(err)
+	}
+	for i, count := range counts {
+		if _, err := store.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", count)}, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return store
+}
+
+func TestProjectionRunnerReplaceActivatesTheNewVersionOnceCaughtUp(t *testing.T) {
+	store := checkedInStore(t, 1, 2, 3)
+	var active atomic.Pointer[countingProjection]
+	runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+	runner.BatchSize = 2
+	if err := runner.Add(countingDefinition(&active, 0)); err != nil {
+		t.Fatal(err)
+	}
+	blue := active.Load()
+	if blue.total != 6 {
+		t.Fatal(blue.total)
+	}
+
+	store.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", 4)}, 3)
+	replacement := countingDefinition(&active, 0)
+	newDef := replacement.New
+	replacement.New = func() (Projection, error) {
+		// a second rebuild is turned away while this one runs
+		if err := runner.Replace(countingDefinition(&active, 0)); err != ErrRebuildRunning {
+			t.Error("replaced twice at once", err)
+		}
+		return newDef()
+	}
+	if err := runner.Replace(replacement); err != nil {
+		t.Fatal(err)
+	}
+	green := active.Load()
+	if green == blue || green.total != 10 || blue.total != 6 {
+		t.Fatal(green.total, blue.total)
+	}
+	if checkpoint, _ := runner.Checkpoint("Counts"); checkpoint != 5 {
+		t.Fatal(checkpoint)
+	}
+
+	// later events go to the new version
+	store.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", 5)}, 4)
+	runner.CatchUp(nil)
+	if green.total != 15 || blue.total != 6 {
+		t.Fatal(green.total, blue.total)
+	}
+	if err := runner.Rebuild("Counts"); err != nil || active.Load() == green || active.Load().total != 15 {
+		t.Fatal(err)
+	}
+	if err := runner.Replace(ProjectionDefinition{Name: "Other"}); err == nil {
+		t.Fatal("replaced a projection that was never added")
+	}
+}
+
+func TestProjectionRunnerSkipsAnEventAfterMaxAttempts(t *testing.T) {
+	store := checkedInStore(t, 1, 13, 2)
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	monitor := NewProjectionMonitor(store, clock, ProjectionThresholds{})
+	var active atomic.Pointer[countingProjection]
+	runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+	runner.ReportTo(monitor)
+	if err := runner.Add(countingDefinition(&active, 13)); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := active.Load()
+	if counts.total != 3 || counts.tries != 2+runner.MaxAttempts {
+		t.Fatal(counts.total, counts.tries)
+	}
+	if len(counts.skipped) != 1 || counts.skipped[0].(ItemsCheckedInToInventory).Count() != 13 {
+		t.Fatal(counts.skipped)
+	}
+	if checkpoint, _ := runner.Checkpoint("Counts"); checkpoint != 4 {
+		t.Fatal(checkpoint)
+	}
+	status, err := monitor.Status("Counts")
+	if err != nil || status.Skipped != 1 || status.LastSkipped != "position 3: poison" || !status.Degraded {
+		t.Fatalf("%+v", status)
+	}
+}
+
+func TestProjectionRunnerReportsARebuildApartUntilItIsActivated(t *testing.T) {
+	store := checkedInStore(t, 1, 2)
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	monitor := NewProjectionMonitor(store, clock, ProjectionThresholds{})
+	var active atomic.Pointer[countingProjection]
+	runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+	runner.ReportTo(monitor)
+	if err := runner.Add(countingDefinition(&active, 0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rebuild skips an event the live version got past
+	replacement := countingDefinition(&active, 2)
+	activate := replacement.Activate
+	replacement.Activate = func(p Projection) {
+		live, _ := monitor.Status("Counts")
+		rebuild, err := monitor.Status("Counts (rebuild)")
+		if live.Skipped != 0 || err != nil || rebuild.Skipped != 1 {
+			t.Errorf("%+v %+v %v", live, rebuild, err)
+		}
+		activate(p)
+	}
+	if err := runner.Replace(replacement); err != nil {
+		t.Fatal(err)
+	}
+	status, err := monitor.Status("Counts")
+	if err != nil || status.Skipped != 1 || status.Name != "Counts" {
+		t.Fatalf("%+v %v", status, err)
+	}
+	if _, err := monitor.Status("Counts (rebuild)"); err == nil {
+		t.Fatal("rebuild still reported once activated")
+	}
+
+	if err := runner.Replace(countingDefinition(&active, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := monitor.Status("Counts"); status.Skipped != 0 || status.LastPosition != 3 {
+		t.Fatalf("%+v", status)
+	}
+}
@@ -0,0 +1,95 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+type QueryHandler func(ctx context.Context, q Query) (interface{}, error)
+type QueryMiddleware func(next QueryHandler) QueryHandler
+
+type QueryBus struct {
+	handlers   map[reflect.Type]QueryHandler
+	middleware []QueryMiddleware
+	s          sync.RWMutex
+}
+
+func NewQueryBus(middleware ...QueryMiddleware) *QueryBus {
+	return &QueryBus{
+		handlers:   make(map[reflect.Type]QueryHandler),
+		middleware: middleware,
+	}
+}
+
+func (qb *QueryBus) SetQueryHandler(queryType reflect.Type, handler QueryHandler) error {
+	qb.s.Lock()
+	defer qb.s.Unlock()
+
+	if _, ok := qb.handlers[queryType]; ok {
+		return errors.New("query handler already registered")
+	}
+	qb.handlers[queryType] = handler
+	return nil
+}
+
+// Use appends middleware, the first middleware added is the outermost
+func (qb *QueryBus) Use(middleware ...QueryMiddleware) {
+	qb.s.Lock()
+	defer qb.s.Unlock()
+
+	qb.middleware = append(qb.middleware, middleware...)
+}
+
+func (qb *QueryBus) Ask(ctx context.Context, q Query) (interface{}, error) {
+	qb.s.RLock()
+	handler, ok := qb.handlers[reflect.TypeOf(q)]
+	middleware := qb.middleware
+	qb.s.RUnlock()
+
+	if !ok {
+		return nil, errors.New("no query handler registered")
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler(ctx, q)
+}
+
+type QueryDispatcher interface {
+	Ask(ctx context.Context, q Query) (interface{}, error)
+}
+
+type QueryHandlerRegistry interface {
+	SetQueryHandler(queryType reflect.Type, handler QueryHandler) error
+}
+
+// RegisterQueryHandler wires a handler for queries of type Q, the result type
+// R comes from the query's QueryFor declaration
+func RegisterQueryHandler[Q TypedQuery[R], R any](r QueryHandlerRegistry, handler func(ctx context.Context, q Q) (R, error)) error {
+	return r.SetQueryHandler(typeOf[Q](), func(ctx context.Context, q Query) (interface{}, error) {
+		typed, ok := q.(Q)
+		if !ok {
+			return nil, fmt.Errorf("handler for %v passed %T", typeOf[Q](), q)
+		}
+		return handler(ctx, typed)
+	})
+}
+
+// Ask sends a query and returns its result typed by the query's QueryFor declaration, e.g.
+//
+//	items, err := Ask(ctx, queries, GetInventoryItems{})
+func Ask[Q TypedQuery[R], R any](ctx context.Context, d QueryDispatcher, q Q) (R, error) {
+	var result R
+	untyped, err := d.Ask(ctx, q)
+	if err != nil {
+		return result, err
+	}
+	result, ok := untyped.(R)
+	if !ok {
+		return result, fmt.Errorf("query %T returned %T", q, untyped)
+	}
+	return result, nil
+}
@@ -0,0 +1,118 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type countedVersion struct {
+	Asked   int
+	Version int
+}
+
+func (cv countedVersion) ProjectionVersion() int {
+	return cv.Version
+}
+
+// countQuery is answered with how many times it has been asked
+type countQuery struct {
+	QueryFor[countedVersion]
+	Name string
+	Min  int
+}
+
+func (q countQuery) MinimumVersion() int {
+	return q.Min
+}
+
+func countingQueries(t *testing.T, middleware ...QueryMiddleware) (*QueryBus, *int) {
+	queries := NewQueryBus(middleware...)
+	asked := 0
+	err := RegisterQueryHandler(queries, func(ctx context.Context, q countQuery) (countedVersion, error) {
+		asked++
+		if q.Name == "fail" {
+			return countedVersion{}, errors.New("failed")
+		}
+		return countedVersion{asked, asked}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return queries, &asked
+}
+
+func TestQueryBusRunsMiddlewareInTheOrderAdded(t *testing.T) {
+	order := make([]string, 0)
+	named := func(name string) QueryMiddleware {
+		return func(next QueryHandler) QueryHandler {
+			return func(ctx context.Context, q Query) (interface{}, error) {
+				order = append(order, name)
+				return next(ctx, q)
+			}
+		}
+	}
+	queries, _ := countingQueries(t, named("first"))
+	queries.Use(named("second"))
+
+	result, err := Ask(context.Background(), queries, countQuery{})
+	if err != nil || result.Asked != 1 {
+		t.Fatal(result, err)
+	}
+	if !reflect.DeepEqual(order, []string{"first", "second"}) {
+		t.Fatal(order)
+	}
+	if err := queries.SetQueryHandler(typeOf[countQuery](), nil); err == nil {
+		t.Fatal("registered a second handler")
+	}
+	if _, err := queries.Ask(context.Background(), struct{}{}); err == nil {
+		t.Fatal("answered a query with no handler")
+	}
+}
+
+func TestCachingQueryMiddlewareAnswersEqualQueriesUntilTheyExpire(t *testing.T) {
+	queries, asked := countingQueries(t, CachingQueryMiddleware(50*time.Millisecond, 2))
+	ask := func(q countQuery) (countedVersion, error) {
+		return Ask(context.Background(), queries, q)
+	}
+
+	ask(countQuery{Name: "a"})
+	time.Sleep(time.Millisecond)
+	if result, _ := ask(countQuery{Name: "a"}); result.Asked != 1 {
+		t.Fatal("equal query asked again", result)
+	}
+	if result, _ := ask(countQuery{Name: "b"}); result.Asked != 2 {
+		t.Fatal("other query answered from the cache", result)
+	}
+	// errors are not cached
+	ask(countQuery{Name: "fail"})
+	ask(countQuery{Name: "fail"})
+	if *asked != 4 {
+		t.Fatal(*asked)
+	}
+
+	// a third query pushes out the oldest
+	ask(countQuery{Name: "c"})
+	if result, _ := ask(countQuery{Name: "a"}); result.Asked != 6 {
+		t.Fatal("evicted query answered from the cache", result)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if result, _ := ask(countQuery{Name: "a"}); result.Asked != 7 {
+		t.Fatal("expired query answered from the cache", result)
+	}
+}
+
+func TestMinimumVersionQueryMiddlewareAsksAgainUntilCaughtUp(t *testing.T) {
+	queries, _ := countingQueries(t, MinimumVersionQueryMiddleware(time.Second, time.Millisecond))
+	result, err := Ask(context.Background(), queries, countQuery{Min: 3})
+	if err != nil || result.Version != 3 {
+		t.Fatal(result, err)
+	}
+
+	queries, _ = countingQueries(t, MinimumVersionQueryMiddleware(20*time.Millisecond, 5*time.Millisecond))
+	if _, err := Ask(context.Background(), queries, countQuery{Min: 1000}); err != ErrProjectionBehind {
+		t.Fatal(err)
+	}
+}
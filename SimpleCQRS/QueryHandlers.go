@@ -0,0 +1,130 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+)
+
+type ReadModelQueryHandlers struct {
+	rm   ReadModel
+	past *TimeTravel
+}
+
+// NewReadModelQueryHandlers answers AsOf queries from past, they fail if it is nil
+func NewReadModelQueryHandlers(rm ReadModel, past *TimeTravel) ReadModelQueryHandlers {
+	return ReadModelQueryHandlers{rm, past}
+}
+
+func (h *ReadModelQueryHandlers) readModel(asOf PointInTime) (ReadModel, error) {
+	if asOf.IsZero() {
+		return h.rm, nil
+	}
+	if h.past == nil {
+		return nil, errors.New("the read model cannot go back in time")
+	}
+	return h.past.At(asOf)
+}
+
+func (h *ReadModelQueryHandlers) HandleGetInventoryItems(ctx context.Context, q GetInventoryItems) (InventoryItemPage, error) {
+	rm, err := h.readModel(q.AsOf)
+	if err != nil {
+		return InventoryItemPage{}, err
+	}
+	if err := rm.WaitFor(ctx, q.After); err != nil {
+		return InventoryItemPage{}, err
+	}
+	return rm.GetInventoryItems(q.InventoryItemListOptions)
+}
+
+func (h *ReadModelQueryHandlers) HandleGetInventoryItemDetails(ctx context.Context, q GetInventoryItemDetails) (InventoryItemDetailsDto, error) {
+	rm, err := h.readModel(q.AsOf)
+	if err != nil {
+		return InventoryItemDetailsDto{}, err
+	}
+	return rm.GetInventoryItemDetails(q.Id)
+}
+
+type SearchQueryHandlers struct {
+	search *Swappable[*InventorySearchIndex]
+}
+
+func NewSearchQueryHandlers(search *Swappable[*InventorySearchIndex]) SearchQueryHandlers {
+	return SearchQueryHandlers{search}
+}
+
+func (h *SearchQueryHandlers) HandleSearchInventoryItems(ctx context.Context, q SearchInventoryItems) ([]InventorySearchResult, error) {
+	if err := h.search.WaitFor(ctx, q.After); err != nil {
+		return nil, err
+	}
+	return h.search.Load().Search(q.Text, q.Limit), nil
+}
+
+type HistoryQueryHandlers struct {
+	history *Swappable[*InventoryHistoryView]
+}
+
+func NewHistoryQueryHandlers(history *Swappable[*InventoryHistoryView]) HistoryQueryHandlers {
+	return HistoryQueryHandlers{history}
+}
+
+func (h *HistoryQueryHandlers) HandleGetInventoryItemHistory(ctx context.Context, q GetInventoryItemHistory) ([]InventoryItemHistoryEntry, error) {
+	if err := h.history.WaitFor(ctx, q.After); err != nil {
+		return nil, err
+	}
+	return h.history.Load().History(q.Id)
+}
+
+type StockReportQueryHandlers struct {
+	ledger *Swappable[*StockLedgerView]
+	clock  Clock
+}
+
+func NewStockReportQueryHandlers(ledger *Swappable[*StockLedgerView], clock Clock) StockReportQueryHandlers {
+	return StockReportQueryHandlers{ledger, clock}
+}
+
+func (h *StockReportQueryHandlers) HandleGetStockMovements(ctx context.Context, q GetStockMovements) ([]StockMovementDto, error) {
+	if err := h.ledger.WaitFor(ctx, q.After); err != nil {
+		return nil, err
+	}
+	return h.ledger.Load().GetStockMovements(q.Id)
+}
+
+func (h *StockReportQueryHandlers) HandleGetStockTotals(ctx context.Context, q GetStockTotals) ([]StockMovementTotals, error) {
+	to := q.To
+	if to.IsZero() {
+		to = h.clock.Now()
+	}
+	return h.ledger.Load().GetStockTotals(q.Id, q.Period, q.From, to)
+}
+
+func (h *StockReportQueryHandlers) HandleGetTopMovers(ctx context.Context, q GetTopMovers) ([]StockMoverDto, error) {
+	now := h.clock.Now()
+	return h.ledger.Load().GetTopMovers(now.AddDate(0, 0, -q.Days), now, q.Limit), nil
+}
+
+func (h *StockReportQueryHandlers) HandleGetIdleItems(ctx context.Context, q GetIdleItems) ([]IdleItemDto, error) {
+	return h.ledger.Load().GetIdleItems(h.clock.Now().AddDate(0, 0, -q.Days)), nil
+}
+
+type LowStockQueryHandlers struct {
+	alerts *Swappable[*LowStockView]
+}
+
+func NewLowStockQueryHandlers(alerts *Swappable[*LowStockView]) LowStockQueryHandlers {
+	return LowStockQueryHandlers{alerts}
+}
+
+func (h *LowStockQueryHandlers) HandleGetLowStockItems(ctx context.Context, q GetLowStockItems) ([]LowStockItemDto, error) {
+	if err := h.alerts.WaitFor(ctx, q.After); err != nil {
+		return nil, err
+	}
+	return h.alerts.Load().LowStockItems(), nil
+}
+
+func (h *LowStockQueryHandlers) HandleGetLowStockAlerts(ctx context.Context, q GetLowStockAlerts) ([]LowStockAlert, error) {
+	if err := h.alerts.WaitFor(ctx, q.After); err != nil {
+		return nil, err
+	}
+	return h.alerts.Load().Alerts(q.Limit), nil
+}
@@ -0,0 +1,143 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var ErrProjectionBehind = errors.New("projection has not reached the required version")
+
+type cachedResult struct {
+	result  interface{}
+	expires time.Time
+}
+
+// CachingQueryMiddleware remembers successful results for ttl. Queries are
+// keyed on their type and JSON encoding, so equal queries share a result
+// even when their fields hold pointers, and queries that cannot be encoded
+// are not cached. At most capacity results are kept, when full the expired
+// ones are dropped first and then the oldest.
+func CachingQueryMiddleware(ttl time.Duration, capacity int) QueryMiddleware {
+	cache := make(map[string]cachedResult)
+	var s sync.Mutex
+
+	return func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, q Query) (interface{}, error) {
+			data, err := json.Marshal(q)
+			if err != nil {
+				return next(ctx, q)
+			}
+			key := fmt.Sprintf("%v:%s", reflect.TypeOf(q), data)
+
+			s.Lock()
+			cached, ok := cache[key]
+			if ok && !time.Now().Before(cached.expires) {
+				delete(cache, key)
+				ok = false
+			}
+			s.Unlock()
+			if ok {
+				return cached.result, nil
+			}
+
+			result, err := next(ctx, q)
+			if err != nil {
+				return result, err
+			}
+			s.Lock()
+			defer s.Unlock()
+			now := time.Now()
+			if len(cache) >= capacity {
+				evictExpired(cache, now)
+			}
+			for len(cache) > 0 && len(cache) >= capacity {
+				evictOldest(cache)
+			}
+			cache[key] = cachedResult{result, now.Add(ttl)}
+			return result, nil
+		}
+	}
+}
+
+func evictExpired(cache map[string]cachedResult, now time.Time) {
+	for key, cached := range cache {
+		if !now.Before(cached.expires) {
+			delete(cache, key)
+		}
+	}
+}
+
+// evictOldest drops the result that expires first, which with one ttl for
+// every result is the one cached longest ago
+func evictOldest(cache map[string]cachedResult) {
+	var oldest string
+	var expires time.Time
+	for key, cached := range cache {
+		if expires.IsZero() || cached.expires.Before(expires) {
+			oldest, expires = key, cached.expires
+		}
+	}
+	delete(cache, oldest)
+}
+
+// AuthorizingQueryMiddleware rejects a query when authorize returns an error
+func AuthorizingQueryMiddleware(authorize func(ctx context.Context, q Query) error) QueryMiddleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, q Query) (interface{}, error) {
+			if err := authorize(ctx, q); err != nil {
+				return nil, err
+			}
+			return next(ctx, q)
+		}
+	}
+}
+
+// TimingQueryMiddleware reports how long each query took to answer
+func TimingQueryMiddleware(report func(q Query, took time.Duration, err error)) QueryMiddleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, q Query) (interface{}, error) {
+			start := time.Now()
+			result, err := next(ctx, q)
+			report(q, time.Since(start), err)
+			return result, err
+		}
+	}
+}
+
+// MinimumVersionQueryMiddleware re-asks a VersionedQuery until its result has
+// reached the required version, giving up with ErrProjectionBehind after
+// timeout. Queries with no minimum version go straight through.
+func MinimumVersionQueryMiddleware(timeout, poll time.Duration) QueryMiddleware {
+	return func(next QueryHandler) QueryHandler {
+		return func(ctx context.Context, q Query) (interface{}, error) {
+			vq, ok := q.(VersionedQuery)
+			if !ok || vq.MinimumVersion() <= 0 {
+				return next(ctx, q)
+			}
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			for {
+				result, err := next(ctx, q)
+				if err != nil {
+					return result, err
+				}
+				vr, ok := result.(VersionedResult)
+				if !ok || vr.ProjectionVersion() >= vq.MinimumVersion() {
+					return result, nil
+				}
+
+				select {
+				case <-ctx.Done():
+					return result, ErrProjectionBehind
+				case <-time.After(poll):
+				}
+			}
+		}
+	}
+}
@@ -1,196 +1,446 @@
 package SimpleCQRS
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type InventoryItemDetailsDto struct {
-	Id           Guid
-	Name         string
-	CurrentCount int
-	Version      int
+	Id            Guid
+	Name          string
+	CurrentCount  int
+	Version       int
+	Active        bool
+	DeactivatedAt time.Time // zero while active
+	ReorderPoint  int       // 0 if it has none
+}
+
+func (dto InventoryItemDetailsDto) ProjectionVersion() int {
+	return dto.Version
 }
 
 type InventoryItemListDto struct {
-	Id   Guid
-	Name string
+	Id            Guid
+	Name          string
+	CurrentCount  int
+	LastUpdated   time.Time
+	Active        bool
+	DeactivatedAt time.Time // zero while active
 }
 
 type BSDB struct {
-	list    []InventoryItemListDto
+	list    *inventoryList
 	details map[Guid]InventoryItemDetailsDto
 	s       sync.RWMutex
+
+	// how far each view has got
+	listProgress    *projectionProgress
+	detailsProgress *projectionProgress
+
+	// where it is saved, if anywhere, and the position it was saved at
+	store      KeyValueStore
+	checkpoint int64
+	replace    bool // the first commit replaces everything in store
 }
 
 func NewBSDB() BSDB {
-	return BSDB{list: make([]InventoryItemListDto, 0), details: make(map[Guid]InventoryItemDetailsDto)}
+	return BSDB{
+		list:            newInventoryList(),
+		details:         make(map[Guid]InventoryItemDetailsDto),
+		listProgress:    newProjectionProgress(),
+		detailsProgress: newProjectionProgress(),
+	}
 }
 
-type ReadModel interface {
-	GetInventoryItems() []InventoryItemListDto
-	GetInventoryItemDetails(id Guid) (InventoryItemDetailsDto, error)
+// NewStoredBSDB makes an empty BSDB that is saved in store, replacing
+// whatever is there when it is first committed
+func NewStoredBSDB(store KeyValueStore) *BSDB {
+	db := NewBSDB()
+	db.store = store
+	db.replace = true
+	return &db
 }
 
-type InventoryItemDetailView struct {
-	db *BSDB
+// OpenBSDB loads the BSDB that was last committed to store
+func OpenBSDB(store KeyValueStore) (*BSDB, error) {
+	db := NewStoredBSDB(store)
+	db.replace = false
+	documents := map[string]interface{}{
+		"checkpoint":       &db.checkpoint,
+		"list":             db.list,
+		"versions/list":    db.listProgress,
+		"versions/details": db.detailsProgress,
+	}
+	for key, v := range documents {
+		if err := getDocument(store, key, v); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := store.Keys("details/")
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		var dto InventoryItemDetailsDto
+		if err := getDocument(store, key, &dto); err != nil {
+			return nil, err
+		}
+		db.details[dto.Id] = dto
+	}
+	return db, nil
 }
 
-func NewInventoryItemDetailView(bsdb *BSDB) InventoryItemDetailView {
-	return InventoryItemDetailView{bsdb}
+func getDocument(store KeyValueStore, key string, v interface{}) error {
+	data, ok, err := store.Get(key)
+	if err != nil || !ok {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("read model document %v: %v", key, err)
+	}
+	return nil
 }
 
-func (detail *InventoryItemDetailView) ProcessInventoryItemCreated(e Event) error {
-	evt, ok := e.(InventoryItemCreated)
-	if !ok {
-		return errors.New("passed incorrect event")
-	}
-	detail.db.s.Lock()
-	defer detail.db.s.Unlock()
+// Checkpoint is the position of the last commit
+func (db *BSDB) Checkpoint() int64 {
+	db.s.RLock()
+	defer db.s.RUnlock()
 
-	detail.db.details[evt.Id()] = InventoryItemDetailsDto{evt.Id(), evt.Name(), 0, 0}
-	return nil
+	return db.checkpoint
 }
-func (detail *InventoryItemDetailView) ProcessInventoryItemDeactivated(e Event) error {
-	evt, ok := e.(InventoryItemDeactivated)
-	if !ok {
-		return errors.New("passed incorrect event")
+
+// Commit saves the items that have changed since the last commit along with
+// the position they reflect, in one write. Readers are only held up while
+// the changes are collected, not while they are written. Without a store it
+// only records the position. Commits must not run concurrently.
+func (db *BSDB) Commit(position int64) error {
+	if db.store == nil {
+		db.s.Lock()
+		db.checkpoint = position
+		db.s.Unlock()
+		return nil
+	}
+	db.s.RLock()
+	replace := db.replace
+	ids := db.detailsProgress.takeTouched()
+	batch, err := db.changes(ids, position)
+	db.s.RUnlock()
+
+	if err == nil {
+		err = db.store.Write(batch)
 	}
-	detail.db.s.Lock()
-	defer detail.db.s.Unlock()
+	if err != nil {
+		db.detailsProgress.touch(ids)
+		return err
+	}
+
+	db.s.Lock()
+	defer db.s.Unlock()
 
-	delete(detail.db.details, evt.Id())
+	db.checkpoint = position
+	if replace {
+		db.replace = false
+	}
 	return nil
 }
-func (detail *InventoryItemDetailView) ProcessInventoryItemRenamed(e Event) error {
-	evt, ok := e.(InventoryItemRenamed)
-	if !ok {
-		return errors.New("passed incorrect event")
+
+// changes is the batch that saves the items with ids, or every item when the
+// store is to be replaced
+func (db *BSDB) changes(ids []Guid, position int64) (map[string]json.RawMessage, error) {
+	batch := make(map[string]json.RawMessage)
+	if db.replace {
+		keys, err := db.store.Keys("")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			batch[key] = nil
+		}
+		ids = make([]Guid, 0, len(db.details))
+		for id := range db.details {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		batch["details/"+string(id)] = nil
+		if dto, ok := db.details[id]; ok {
+			if err := putDocument(batch, "details/"+string(id), dto); err != nil {
+				return nil, err
+			}
+		}
+	}
+	documents := map[string]interface{}{
+		"checkpoint":       position,
+		"list":             db.list,
+		"versions/list":    db.listProgress,
+		"versions/details": db.detailsProgress,
+	}
+	for key, v := range documents {
+		if err := putDocument(batch, key, v); err != nil {
+			return nil, err
+		}
 	}
-	detail.db.s.Lock()
-	defer detail.db.s.Unlock()
+	return batch, nil
+}
 
-	original, ok := detail.db.details[evt.Id()]
-	if !ok {
-		return errors.New("this should never happen")
+func putDocument(batch map[string]json.RawMessage, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
 	}
-	original.Name = evt.NewName()
-	original.Version = evt.Version()
-	detail.db.details[evt.Id()] = original
+	batch[key] = data
 	return nil
 }
-func (detail *InventoryItemDetailView) ProcessItemsCheckedInToInventory(e Event) error {
-	evt, ok := e.(ItemsCheckedInToInventory)
-	if !ok {
-		return errors.New("passed incorrect event")
-	}
-	detail.db.s.Lock()
-	defer detail.db.s.Unlock()
 
-	original, ok := detail.db.details[evt.Id()]
+type ReadModel interface {
+	GetInventoryItems(opts InventoryItemListOptions) (InventoryItemPage, error)
+	GetInventoryItemDetails(id Guid) (InventoryItemDetailsDto, error)
+	// WaitFor returns once every view has processed the write behind the
+	// token, or ErrProjectionBehind if ctx ends first
+	WaitFor(ctx context.Context, token ConsistencyToken) error
+}
+
+// NewInventoryItemDetailView keeps the BSDB's details up to date
+func NewInventoryItemDetailView(db *BSDB) *DeclaredProjection[*BSDB] {
+	view := newDeclaredProjection(db, &db.s, db.detailsProgress)
+	ProjectWith(view, func(db *BSDB, evt InventoryItemCreated) error {
+		db.details[evt.Id()] = InventoryItemDetailsDto{evt.Id(), evt.Name(), 0, evt.Version(), true, time.Time{}, 0}
+		return nil
+	})
+	ProjectWith(view, func(db *BSDB, evt InventoryItemDeactivated) error {
+		return db.updateDetails(evt, func(item *InventoryItemDetailsDto) {
+			item.Active = false
+			item.DeactivatedAt = evt.Time()
+		})
+	})
+	ProjectWith(view, func(db *BSDB, evt InventoryItemRenamed) error {
+		return db.updateDetails(evt, func(item *InventoryItemDetailsDto) {
+			item.Name = evt.NewName()
+		})
+	})
+	ProjectWith(view, func(db *BSDB, evt ItemsCheckedInToInventory) error {
+		return db.updateDetails(evt, func(item *InventoryItemDetailsDto) {
+			item.CurrentCount += evt.Count()
+		})
+	})
+	ProjectWith(view, func(db *BSDB, evt ItemsRemovedFromInventory) error {
+		return db.updateDetails(evt, func(item *InventoryItemDetailsDto) {
+			item.CurrentCount -= evt.Count()
+		})
+	})
+	ProjectWith(view, func(db *BSDB, evt ReorderPointSet) error {
+		return db.updateDetails(evt, func(item *InventoryItemDetailsDto) {
+			item.ReorderPoint = evt.ReorderPoint()
+		})
+	})
+	return view
+}
+
+// updateDetails changes an item and brings it up to the event's version
+func (db *BSDB) updateDetails(evt AggregateEvent, change func(item *InventoryItemDetailsDto)) error {
+	item, ok := db.details[evt.Id()]
 	if !ok {
 		return errors.New("this should never happen")
 	}
-	original.CurrentCount += evt.Count()
-	original.Version = evt.Version()
-	detail.db.details[evt.Id()] = original
+	change(&item)
+	item.Version = evt.Version()
+	db.details[evt.Id()] = item
 	return nil
 }
-func (detail *InventoryItemDetailView) ProcessItemsRemovedFromInventory(e Event) error {
-	evt, ok := e.(ItemsRemovedFromInventory)
-	if !ok {
-		return errors.New("passed incorrect event")
-	}
-	detail.db.s.Lock()
-	defer detail.db.s.Unlock()
 
-	original, ok := detail.db.details[evt.Id()]
+// NewInventoryListView keeps the BSDB's list up to date
+func NewInventoryListView(db *BSDB) *DeclaredProjection[*BSDB] {
+	view := newDeclaredProjection(db, &db.s, db.listProgress)
+	ProjectWith(view, func(db *BSDB, evt InventoryItemCreated) error {
+		db.list.put(InventoryItemListDto{evt.Id(), evt.Name(), 0, evt.Time(), true, time.Time{}})
+		return nil
+	})
+	ProjectWith(view, func(db *BSDB, evt InventoryItemRenamed) error {
+		return db.updateListItem(evt, func(item *InventoryItemListDto) {
+			item.Name = evt.NewName()
+		})
+	})
+	ProjectWith(view, func(db *BSDB, evt InventoryItemDeactivated) error {
+		return db.updateListItem(evt, func(item *InventoryItemListDto) {
+			item.Active = false
+			item.DeactivatedAt = evt.Time()
+		})
+	})
+	ProjectWith(view, func(db *BSDB, evt ItemsCheckedInToInventory) error {
+		return db.updateListItem(evt, func(item *InventoryItemListDto) {
+			item.CurrentCount += evt.Count()
+		})
+	})
+	ProjectWith(view, func(db *BSDB, evt ItemsRemovedFromInventory) error {
+		return db.updateListItem(evt, func(item *InventoryItemListDto) {
+			item.CurrentCount -= evt.Count()
+		})
+	})
+	return view
+}
+
+// updateListItem changes an item, stamps it with the event's time and moves it in the indexes
+func (db *BSDB) updateListItem(evt AggregateEvent, change func(item *InventoryItemListDto)) error {
+	item, ok := db.list.get(evt.Id())
 	if !ok {
 		return errors.New("this should never happen")
 	}
-	original.CurrentCount -= evt.Count()
-	original.Version = evt.Version()
-	detail.db.details[evt.Id()] = original
+	change(&item)
+	if te, ok := evt.(TimedEvent); ok {
+		item.LastUpdated = te.Time()
+	}
+	db.list.put(item)
 	return nil
 }
 
-type InventoryItemListView struct {
-	db *BSDB
+// InventoryReadModel is a BSDB built by the detail and list views, as a Projection
+type InventoryReadModel struct {
+	db    *BSDB
+	views []*DeclaredProjection[*BSDB]
 }
 
-func NewInventoryListView(bsdb *BSDB) InventoryItemListView {
-	return InventoryItemListView{bsdb}
+func NewInventoryReadModel() *InventoryReadModel {
+	db := NewBSDB()
+	return newInventoryReadModel(&db)
 }
-func (list *InventoryItemListView) ProcessInventoryItemCreated(e Event) error {
-	evt, ok := e.(InventoryItemCreated)
-	if !ok {
-		return errors.New("passed incorrect event")
-	}
-	list.db.s.Lock()
-	defer list.db.s.Unlock()
 
-	list.db.list = append(list.db.list, InventoryItemListDto{evt.Id(), evt.Name()})
-	return nil
+func newInventoryReadModel(db *BSDB) *InventoryReadModel {
+	return &InventoryReadModel{db, []*DeclaredProjection[*BSDB]{NewInventoryItemDetailView(db), NewInventoryListView(db)}}
 }
 
-func (list *InventoryItemListView) ProcessInventoryItemRenamed(e Event) error {
-	evt, ok := e.(InventoryItemRenamed)
-	if !ok {
-		return errors.New("passed incorrect event")
+func (rm *InventoryReadModel) DB() *BSDB {
+	return rm.db
+}
+
+func (rm *InventoryReadModel) Process(evt Event) error {
+	errs := make([]error, 0, len(rm.views))
+	for _, view := range rm.views {
+		errs = append(errs, view.Process(evt))
 	}
-	list.db.s.Lock()
-	defer list.db.s.Unlock()
+	return errors.Join(errs...)
+}
 
-	for i, item := range list.db.list {
-		if evt.Id() == item.Id {
-			list.db.list[i] = InventoryItemListDto{evt.Id(), evt.NewName()}
-		}
+func (rm *InventoryReadModel) Skip(evt Event) error {
+	errs := make([]error, 0, len(rm.views))
+	for _, view := range rm.views {
+		errs = append(errs, view.Skip(evt))
 	}
-	return nil
+	return errors.Join(errs...)
 }
 
-func (list *InventoryItemListView) ProcessInventoryItemDeactivated(e Event) error {
-	evt, ok := e.(InventoryItemDeactivated)
-	if !ok {
-		return errors.New("passed incorrect event")
+// Checkpoint and Commit make the read model a PersistentProjection, so its
+// items and checkpoint are saved together
+func (rm *InventoryReadModel) Checkpoint() int64 {
+	return rm.db.Checkpoint()
+}
+
+func (rm *InventoryReadModel) Commit(position int64) error {
+	return rm.db.Commit(position)
+}
+
+// InventoryReadModelProjection runs an InventoryReadModel for the facade,
+// rebuilds swap the facade over to the new BSDB. With a store the read
+// model is saved there and picks up where it left off on restart, a nil
+// store keeps it in memory.
+func InventoryReadModelProjection(rmf *ReadModelFacade, store KeyValueStore) ProjectionDefinition {
+	def := ProjectionDefinition{
+		Name: "InventoryReadModel",
+		New: func() (Projection, error) {
+			return NewInventoryReadModel(), nil
+		},
+		Activate: func(p Projection) {
+			rmf.Use(p.(*InventoryReadModel).DB())
+		},
 	}
-	list.db.s.Lock()
-	defer list.db.s.Unlock()
+	if store != nil {
+		def.New = func() (Projection, error) {
+			return newInventoryReadModel(NewStoredBSDB(store)), nil
+		}
+		def.Open = func() (Projection, error) {
+			db, err := OpenBSDB(store)
+			if err != nil {
+				return nil, err
+			}
+			return newInventoryReadModel(db), nil
+		}
+	}
+	return def
+}
 
-	newList := make([]InventoryItemListDto, 0)
-	for _, item := range list.db.list {
-		if evt.Id() != item.Id {
-			newList = append(newList, item)
+// publishTo sends the views' changes to feed, or stops sending them if feed is nil
+func (db *BSDB) publishTo(feed *ChangeFeed) {
+	views := map[string]*projectionProgress{ListView: db.listProgress, DetailsView: db.detailsProgress}
+	for view, progress := range views {
+		if feed == nil {
+			progress.notifyTo(nil)
+			continue
 		}
+		view := view
+		progress.notifyTo(func(id Guid, version int) {
+			feed.Publish(ReadModelChange{view, id, version})
+		})
 	}
-	list.db.list = newList
-	return nil
 }
 
 type ReadModelFacade struct {
-	db *BSDB
+	db      *atomic.Pointer[BSDB]
+	changes *ChangeFeed
 }
 
 func NewReadModelFacade(db *BSDB) ReadModelFacade {
-	return ReadModelFacade{db}
+	rmf := ReadModelFacade{&atomic.Pointer[BSDB]{}, NewChangeFeed()}
+	rmf.Use(db)
+	return rmf
+}
+
+// Use answers every later read from db, and tells the change feed that
+// every view may have changed
+func (rmf *ReadModelFacade) Use(db *BSDB) {
+	db.publishTo(rmf.changes)
+	if old := rmf.db.Swap(db); old != nil && old != db {
+		old.publishTo(nil)
+		rmf.changes.Publish(ReadModelChange{View: ListView})
+		rmf.changes.Publish(ReadModelChange{View: DetailsView})
+	}
+}
+
+// Changes is the feed of changes to whichever BSDB is in use
+func (rmf *ReadModelFacade) Changes() *ChangeFeed {
+	return rmf.changes
 }
 
-func (rmf *ReadModelFacade) GetInventoryItems() []InventoryItemListDto {
-	rmf.db.s.RLock()
-	defer rmf.db.s.RUnlock()
+func (rmf *ReadModelFacade) GetInventoryItems(opts InventoryItemListOptions) (InventoryItemPage, error) {
+	db := rmf.db.Load()
+	db.s.RLock()
+	defer db.s.RUnlock()
 
-	tmp := make([]InventoryItemListDto, len(rmf.db.list))
-	copy(tmp, rmf.db.list)
-	return tmp
+	return db.list.page(opts)
 }
 
 func (rmf *ReadModelFacade) GetInventoryItemDetails(id Guid) (InventoryItemDetailsDto, error) {
-	rmf.db.s.RLock()
-	defer rmf.db.s.RUnlock()
+	db := rmf.db.Load()
+	db.s.RLock()
+	defer db.s.RUnlock()
 
-	item, ok := rmf.db.details[id]
+	item, ok := db.details[id]
 	if !ok {
 		return item, errors.New("No item")
 	}
 	return item, nil
 }
+
+func (rmf *ReadModelFacade) WaitFor(ctx context.Context, token ConsistencyToken) error {
+	if token.IsZero() {
+		return nil
+	}
+	db := rmf.db.Load()
+	if err := db.listProgress.wait(ctx, token); err != nil {
+		return err
+	}
+	return db.detailsProgress.wait(ctx, token)
+}
@@ -0,0 +1,190 @@
+package SimpleCQRS
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyValueStore holds JSON documents for a read model
+type KeyValueStore interface {
+	Get(key string) (json.RawMessage, bool, error)
+	// Keys lists the keys that start with prefix, in order
+	Keys(prefix string) ([]string, error)
+	// Write sets every key in batch, or deletes it when its value is nil, all
+	// at once so that a crash leaves either all of it or none of it
+	Write(batch map[string]json.RawMessage) error
+}
+
+type inMemoryKeyValueStore struct {
+	values map[string]json.RawMessage
+	s      sync.RWMutex
+}
+
+func NewInMemoryKeyValueStore() KeyValueStore {
+	return &inMemoryKeyValueStore{values: make(map[string]json.RawMessage)}
+}
+
+func (store *inMemoryKeyValueStore) Get(key string) (json.RawMessage, bool, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	value, ok := store.values[key]
+	return value, ok, nil
+}
+
+func (store *inMemoryKeyValueStore) Keys(prefix string) ([]string, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	return keysWithPrefix(store.values, prefix), nil
+}
+
+func (store *inMemoryKeyValueStore) Write(batch map[string]json.RawMessage) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	applyBatch(store.values, batch)
+	return nil
+}
+
+func keysWithPrefix(values map[string]json.RawMessage, prefix string) []string {
+	keys := make([]string, 0)
+	for key := range values {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func applyBatch(values map[string]json.RawMessage, batch map[string]json.RawMessage) {
+	for key, value := range batch {
+		if value == nil {
+			delete(values, key)
+		} else {
+			values[key] = value
+		}
+	}
+}
+
+// fileKeyValueStore keeps every document in memory, and each batch as a
+// line appended to a file. The file is written out again from memory once
+// it has grown to several times the size of the documents in it.
+type fileKeyValueStore struct {
+	path      string
+	file      *os.File
+	size      int64 // of the file
+	compacted int64 // the size of the file when it was last written out
+	values    map[string]json.RawMessage
+	s         sync.RWMutex
+}
+
+// files smaller than this are not worth writing out again
+const minCompactSize = 1 << 20
+
+func NewFileKeyValueStore(path string) (KeyValueStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	store := &fileKeyValueStore{path: path, values: make(map[string]json.RawMessage)}
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for len(data) > 0 {
+		line, rest, found := bytes.Cut(data, []byte("\n"))
+		var batch map[string]json.RawMessage
+		if err := json.Unmarshal(line, &batch); err != nil {
+			// only the last batch can have been cut short, by a crash
+			if !found {
+				break
+			}
+			return nil, fmt.Errorf("read model file %v: %v", path, err)
+		}
+		for key, value := range batch {
+			if string(value) == "null" {
+				batch[key] = nil
+			}
+		}
+		applyBatch(store.values, batch)
+		data = rest
+	}
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *fileKeyValueStore) Get(key string) (json.RawMessage, bool, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	value, ok := store.values[key]
+	return value, ok, nil
+}
+
+func (store *fileKeyValueStore) Keys(prefix string) ([]string, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	return keysWithPrefix(store.values, prefix), nil
+}
+
+func (store *fileKeyValueStore) Write(batch map[string]json.RawMessage) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	n, err := store.file.Write(data)
+	if err != nil {
+		store.file.Truncate(store.size)
+		return err
+	}
+	store.size += int64(n)
+	applyBatch(store.values, batch)
+	if store.size > minCompactSize && store.size > 4*store.compacted {
+		return store.compact()
+	}
+	return nil
+}
+
+// compact writes every document out as a single batch, to a new file that
+// replaces the old one so a crash never leaves a half written file behind
+func (store *fileKeyValueStore) compact() error {
+	data, err := json.Marshal(store.values)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	tmp := store.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, store.path); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(store.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if store.file != nil {
+		store.file.Close()
+	}
+	store.file = file
+	store.size = int64(len(data))
+	store.compacted = store.size
+	return nil
+}
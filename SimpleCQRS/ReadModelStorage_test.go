@@ -0,0 +1,48 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func openFileKeyValueStore(t *testing.T, path string) KeyValueStore {
+	store, err := NewFileKeyValueStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFileKeyValueStoreReplaysItsLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "readmodel.json")
+	store := openFileKeyValueStore(t, path)
+	if err := store.Write(map[string]json.RawMessage{"a": json.RawMessage("1"), "b": json.RawMessage("2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Write(map[string]json.RawMessage{"a": nil, "c": json.RawMessage("3")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a write cut short is ignored
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.WriteString(`{"d":`)
+	file.Close()
+	reopened := openFileKeyValueStore(t, path)
+	if keys, _ := reopened.Keys(""); !reflect.DeepEqual(keys, []string{"b", "c"}) {
+		t.Fatal("deleted or torn keys are back", keys)
+	}
+	if err := reopened.Write(map[string]json.RawMessage{"d": json.RawMessage("4")}); err != nil {
+		t.Fatal(err)
+	}
+
+	store = openFileKeyValueStore(t, path)
+	if keys, _ := store.Keys(""); !reflect.DeepEqual(keys, []string{"b", "c", "d"}) {
+		t.Fatal(keys)
+	}
+	if value, ok, _ := store.Get("c"); !ok || string(value) != "3" {
+		t.Fatal(string(value), ok)
+	}
+}
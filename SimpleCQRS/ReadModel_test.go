@@ -0,0 +1,77 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestReadModelWaitsForTheWriteATokenStandsFor(t *testing.T) {
+	store := NewEventStore(discardEvents{})
+	db := NewBSDB()
+	rmf := NewReadModelFacade(&db)
+	rm := newInventoryReadModel(&db)
+	created, _ := store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "bolts")}, -1)
+	renamed, _ := store.SaveEvents("a", []Event{NewInventoryItemRenamed("a", "nuts")}, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := rmf.WaitFor(ctx, renamed.Token()); err == nil {
+		t.Fatal("waited for a write the read model has not seen")
+	}
+	if err := rmf.WaitFor(context.Background(), ConsistencyToken{}); err != nil {
+		t.Fatal("no token has nothing to wait for", err)
+	}
+
+	waited := make(chan error)
+	go func() { waited <- rmf.WaitFor(context.Background(), renamed.Token()) }()
+	for _, evt := range append(created.Events, renamed.Events...) {
+		if err := rm.Process(evt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+	if item, err := rmf.GetInventoryItemDetails("a"); err != nil || item.Name != "nuts" {
+		t.Fatalf("%+v %v", item, err)
+	}
+}
+
+func TestReadModelKeepsDeactivatedItemsInTheArchive(t *testing.T) {
+	deactivatedAt := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	store := NewEventStoreWithClock(discardEvents{}, NewVirtualClock(deactivatedAt))
+	db := NewBSDB()
+	rmf := NewReadModelFacade(&db)
+	rm := newInventoryReadModel(&db)
+	a, _ := store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "bolts"), NewItemsCheckedInToInventory("a", 3), NewInventoryItemDeactivated("a")}, -1)
+	b, _ := store.SaveEvents("b", []Event{NewInventoryItemCreated("b", "nuts")}, -1)
+	for _, evt := range append(a.Events, b.Events...) {
+		rm.Process(evt)
+	}
+
+	ids := func(status InventoryItemStatus) []Guid {
+		page, err := rmf.GetInventoryItems(InventoryItemListOptions{Status: status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]Guid, 0)
+		for _, item := range page.Items {
+			ids = append(ids, item.Id)
+		}
+		return ids
+	}
+	if active := ids(""); len(active) != 1 || active[0] != "b" {
+		t.Fatal(active)
+	}
+	if archived := ids(InactiveItems); len(archived) != 1 || archived[0] != "a" {
+		t.Fatal(archived)
+	}
+	if all := ids(AllItems); len(all) != 2 {
+		t.Fatal(all)
+	}
+	item, err := rmf.GetInventoryItemDetails("a")
+	if err != nil || item.Active || !item.DeactivatedAt.Equal(deactivatedAt) || item.CurrentCount != 3 {
+		t.Fatalf("%+v %v", item, err)
+	}
+}
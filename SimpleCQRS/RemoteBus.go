@@ -0,0 +1,462 @@
+package SimpleCQRS
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrBrokerConnectionLost = errors.New("broker connection lost")
+
+type remoteSubscription struct {
+	id        string
+	topic     string
+	group     string
+	deliver   func(ctx context.Context, f brokerFrame) (Commit, error)
+	filter    EventFilter
+	processor EventProcessor // nil for command handlers
+}
+
+// remoteCommit is a Commit on its way back to the process that dispatched the command
+type remoteCommit struct {
+	AggregateId Guid
+	Version     int
+	Position    int64
+	Events      []remoteEvent
+}
+
+type remoteEvent struct {
+	Type string
+	Data json.RawMessage
+}
+
+// RemoteBus sends commands and events through a Broker, so handlers and
+// processors can live in other processes. Command handlers compete for
+// commands. Every processor gets every event, unless another process that
+// dialled with the same name registered the same processor, in which case
+// they compete for them.
+type RemoteBus struct {
+	name          string
+	commands      *CommandCodec
+	events        *EventCodec
+	conn          net.Conn
+	encoder       *json.Encoder
+	writing       sync.Mutex
+	subscriptions []*remoteSubscription
+	nextSub       int
+	groups        map[string]int
+	replies       map[string]chan CommandResult
+	idempotency   IdempotencyStore
+	s             sync.Mutex
+
+	// lifecycle
+	started    bool
+	stopped    bool
+	ctx        context.Context
+	abandon    context.CancelFunc
+	deliveries sync.WaitGroup
+	inFlight   int
+	closed     chan struct{}
+}
+
+// DialBroker connects to a broker on a "tcp" or "unix" address. Messages are
+// only taken from the broker once the bus is started.
+//
+// The broker can deliver a command again, so each one is sent with an
+// idempotency key, its own if it has one, and a command handled already is
+// answered with the original result. The keys are remembered in memory until
+// UseIdempotencyStore is given somewhere else to keep them.
+func DialBroker(network, address, name string, commands *CommandCodec, events *EventCodec) (*RemoteBus, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	rb := &RemoteBus{
+		name:          name,
+		commands:      commands,
+		events:        events,
+		conn:          conn,
+		encoder:       json.NewEncoder(conn),
+		subscriptions: make([]*remoteSubscription, 0),
+		groups:        make(map[string]int),
+		replies:       make(map[string]chan CommandResult),
+		idempotency:   NewInMemoryIdempotencyStore(10000, 24*time.Hour, SystemClock),
+		closed:        make(chan struct{}),
+	}
+	rb.ctx, rb.abandon = context.WithCancel(context.Background())
+	go rb.receive()
+	return rb, nil
+}
+
+func (rb *RemoteBus) send(f brokerFrame) error {
+	rb.writing.Lock()
+	defer rb.writing.Unlock()
+
+	return rb.encoder.Encode(f)
+}
+
+func (rb *RemoteBus) receive() {
+	defer close(rb.closed)
+
+	scanner := bufio.NewScanner(rb.conn)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var f brokerFrame
+		if err := json.Unmarshal(scanner.Bytes(), &f); err != nil {
+			Logger.Println("Dropping bad frame from broker:", err)
+			continue
+		}
+		switch f.Op {
+		case "deliver":
+			rb.deliver(f)
+		case "reply":
+			rb.reply(f)
+		}
+	}
+
+	rb.s.Lock()
+	defer rb.s.Unlock()
+	for id, resp := range rb.replies {
+		delete(rb.replies, id)
+		select {
+		case resp <- CommandResult{Err: ErrBrokerConnectionLost}:
+		default:
+		}
+	}
+}
+
+func (rb *RemoteBus) reply(f brokerFrame) {
+	rb.s.Lock()
+	resp, ok := rb.replies[f.Id]
+	delete(rb.replies, f.Id)
+	rb.s.Unlock()
+
+	if !ok {
+		return
+	}
+	var result CommandResult
+	if f.Error != "" {
+		result.Err = errors.New(f.Error)
+	} else if len(f.Payload) > 0 {
+		var err error
+		if result.Commit, err = rb.decodeCommit(f.Payload); err != nil {
+			result.Err = err
+		}
+	}
+	select {
+	case resp <- result:
+	default:
+	}
+}
+
+// deliver runs each delivery on its own goroutine so replies keep flowing
+// while handlers dispatch commands of their own. The broker sends a
+// subscription one message at a time, so they are still handled in order.
+func (rb *RemoteBus) deliver(f brokerFrame) {
+	rb.s.Lock()
+	var sub *remoteSubscription
+	for _, s := range rb.subscriptions {
+		if s.id == f.Sub {
+			sub = s
+		}
+	}
+	if sub == nil || rb.stopped {
+		rb.s.Unlock()
+		rb.send(brokerFrame{Op: "nack", Sub: f.Sub, Id: f.Id})
+		return
+	}
+	rb.inFlight++
+	rb.deliveries.Add(1)
+	rb.s.Unlock()
+
+	go func() {
+		defer rb.deliveries.Done()
+		if f.Redelivered {
+			Logger.Println("Redelivery of", f.Type, f.Id)
+		}
+		commit, err := sub.deliver(rb.ctx, f)
+		if f.WantReply {
+			reply := brokerFrame{Op: "reply", Id: f.Id}
+			if err == nil {
+				reply.Payload, err = rb.encodeCommit(commit)
+			}
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			rb.send(reply)
+		}
+		op := "ack"
+		if err != nil && !f.WantReply {
+			op = "nack" // a command's error is its answer, a processor's error is worth another try
+		}
+		rb.send(brokerFrame{Op: op, Sub: f.Sub, Id: f.Id})
+
+		rb.s.Lock()
+		rb.inFlight--
+		rb.s.Unlock()
+	}()
+}
+
+func (rb *RemoteBus) subscribe(sub *remoteSubscription) error {
+	rb.s.Lock()
+	defer rb.s.Unlock()
+
+	if rb.stopped {
+		return ErrBusStopped
+	}
+	sub.id = strconv.Itoa(rb.nextSub)
+	rb.nextSub++
+	rb.subscriptions = append(rb.subscriptions, sub)
+	if rb.started {
+		return rb.send(brokerFrame{Op: "subscribe", Topic: sub.topic, Group: sub.group, Sub: sub.id})
+	}
+	return nil
+}
+
+func (rb *RemoteBus) encodeCommit(commit Commit) (json.RawMessage, error) {
+	rc := remoteCommit{commit.AggregateId, commit.Version, commit.Position, make([]remoteEvent, 0)}
+	for _, evt := range commit.Events {
+		name, data, err := rb.events.Encode(evt)
+		if err != nil {
+			return nil, err
+		}
+		rc.Events = append(rc.Events, remoteEvent{name, data})
+	}
+	return json.Marshal(rc)
+}
+
+func (rb *RemoteBus) decodeCommit(data json.RawMessage) (Commit, error) {
+	var rc remoteCommit
+	if err := json.Unmarshal(data, &rc); err != nil {
+		return Commit{}, err
+	}
+	commit := Commit{AggregateId: rc.AggregateId, Version: rc.Version, Position: rc.Position, Events: make([]Event, 0)}
+	for _, re := range rc.Events {
+		evt, err := rb.events.Decode(re.Type, re.Data)
+		if err != nil {
+			return Commit{}, err
+		}
+		commit.Events = append(commit.Events, evt)
+	}
+	return commit, nil
+}
+
+func commandTopic(name string) string {
+	return "command." + name
+}
+
+func eventTopic(name string) string {
+	return "event." + name
+}
+
+// UseIdempotencyStore records the commands handled in store, one shared by
+// every process handling commands catches those redelivered to another
+func (rb *RemoteBus) UseIdempotencyStore(store IdempotencyStore) {
+	rb.s.Lock()
+	defer rb.s.Unlock()
+
+	rb.idempotency = store
+}
+
+func (rb *RemoteBus) SetCommandHandler(cmdType reflect.Type, handler CommandHandler) error {
+	rb.s.Lock()
+	for _, sub := range rb.subscriptions {
+		if sub.topic == commandTopic(cmdType.Name()) {
+			rb.s.Unlock()
+			return errors.New("command handler already registered")
+		}
+	}
+	rb.s.Unlock()
+
+	return rb.subscribe(&remoteSubscription{
+		topic: commandTopic(cmdType.Name()),
+		group: commandGroup,
+		deliver: func(ctx context.Context, f brokerFrame) (Commit, error) {
+			cmd, err := rb.commands.Decode(f.Type, f.Payload)
+			if err != nil {
+				return Commit{}, err
+			}
+			rb.s.Lock()
+			store := rb.idempotency
+			rb.s.Unlock()
+			key := idempotencyKey(store, cmd)
+			if processed, ok := alreadyProcessed(store, key); ok {
+				Logger.Println("Duplicate remote command, original result:", processed.Error)
+				result := processed.Result()
+				return result.Commit, result.Err
+			}
+			Logger.Println("Processing remote command:", cmd)
+			commit, err := handler(ctx, cmd)
+			recordProcessed(store, key, CommandResult{commit, err})
+			return commit, err
+		},
+	})
+}
+
+func (rb *RemoteBus) AddEventProcessor(eventType reflect.Type, processor EventProcessor) error {
+	_, err := rb.SubscribeEvents(EventFilter{Types: []reflect.Type{eventType}}, processor)
+	return err
+}
+
+// SubscribeEvents asks the broker for the topics the filter could match and
+// leaves the rest of the filtering to this side
+func (rb *RemoteBus) SubscribeEvents(filter EventFilter, processor EventProcessor) (func(), error) {
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+	topic := eventTopic("*")
+	if len(filter.Types) == 1 {
+		topic = eventTopic(filter.Types[0].Name())
+	} else if filter.Names != "" {
+		topic = eventTopic(filter.Names)
+	}
+
+	rb.s.Lock()
+	for _, sub := range rb.subscriptions {
+		if sub.processor != nil && reflect.DeepEqual(sub.filter, filter) && sameProcessor(sub.processor, processor) {
+			rb.s.Unlock()
+			return nil, ErrAlreadySubscribed
+		}
+	}
+	n := rb.groups[topic]
+	rb.groups[topic] = n + 1
+	rb.s.Unlock()
+
+	sub := &remoteSubscription{
+		topic:     topic,
+		group:     fmt.Sprintf("%v.%v", rb.name, n),
+		filter:    filter,
+		processor: processor,
+		deliver: func(ctx context.Context, f brokerFrame) (Commit, error) {
+			evt, err := rb.events.Decode(f.Type, f.Payload)
+			if err != nil {
+				return Commit{}, err
+			}
+			if !filter.Matches(evt) {
+				return Commit{}, nil
+			}
+			return Commit{}, processor(evt)
+		},
+	}
+	if err := rb.subscribe(sub); err != nil {
+		return nil, err
+	}
+	return func() { rb.unsubscribe(sub) }, nil
+}
+
+func (rb *RemoteBus) unsubscribe(sub *remoteSubscription) {
+	rb.s.Lock()
+	defer rb.s.Unlock()
+
+	for i, s := range rb.subscriptions {
+		if s == sub {
+			rb.subscriptions = append(rb.subscriptions[:i], rb.subscriptions[i+1:]...)
+			if rb.started && !rb.stopped {
+				rb.send(brokerFrame{Op: "unsubscribe", Sub: sub.id})
+			}
+			return
+		}
+	}
+}
+
+// Dispatch hands the command to the broker, it waits there until a handler
+// takes it. The response comes back from whichever process handled it.
+func (rb *RemoteBus) Dispatch(cmd Command, syncResp chan CommandResult) CommandSubmissionError {
+	id := string(NewGuid())
+	if ic, ok := cmd.(IdempotentCommand); ok && ic.IdempotencyKey() == "" {
+		cmd = ic.WithIdempotencyKey(id)
+	}
+	name, data, err := rb.commands.Encode(cmd)
+	if err != nil {
+		return err
+	}
+
+	rb.s.Lock()
+	if rb.stopped {
+		rb.s.Unlock()
+		return ErrBusStopped
+	}
+	if syncResp != nil {
+		rb.replies[id] = syncResp
+	}
+	rb.s.Unlock()
+
+	Logger.Println("Sending command:", cmd)
+	err = rb.send(brokerFrame{Op: "send", Topic: commandTopic(name), Id: id, Type: name, Payload: data, WantReply: syncResp != nil})
+	if err != nil {
+		rb.s.Lock()
+		delete(rb.replies, id)
+		rb.s.Unlock()
+	}
+	return err
+}
+
+func (rb *RemoteBus) Publish(evt Event) error {
+	name, data, err := rb.events.Encode(evt)
+	if err != nil {
+		return err
+	}
+	return rb.send(brokerFrame{Op: "publish", Topic: eventTopic(name), Id: string(NewGuid()), Type: name, Payload: data})
+}
+
+// Start subscribes to everything registered so far, anything registered
+// later is subscribed straight away
+func (rb *RemoteBus) Start() error {
+	rb.s.Lock()
+	defer rb.s.Unlock()
+
+	if rb.stopped {
+		return ErrBusStopped
+	}
+	if rb.started {
+		return nil
+	}
+	rb.started = true
+	for _, sub := range rb.subscriptions {
+		if err := rb.send(brokerFrame{Op: "subscribe", Topic: sub.topic, Group: sub.group, Sub: sub.id}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop turns away new deliveries and waits for the ones being handled to be
+// acknowledged before disconnecting. Anything the broker has not delivered
+// stays there for the next consumer. If ctx ends first the handlers are
+// abandoned, the broker redelivers their messages elsewhere, and an
+// *IncompleteShutdownError says how many there were.
+func (rb *RemoteBus) Stop(ctx context.Context) error {
+	rb.s.Lock()
+	if rb.stopped {
+		rb.s.Unlock()
+		return nil
+	}
+	rb.stopped = true
+	rb.s.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		rb.deliveries.Wait()
+		close(drained)
+	}()
+
+	var result error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		rb.s.Lock()
+		result = &IncompleteShutdownError{InFlight: rb.inFlight}
+		rb.s.Unlock()
+	}
+	rb.abandon()
+	rb.conn.Close()
+	<-rb.closed
+	return result
+}
@@ -0,0 +1,67 @@
+package SimpleCQRS
+
+import (
+	"time"
+)
+
+type ReorderState struct {
+	Count          int
+	ReorderPoint   int // 0 if the item has none, and is never reordered
+	ReorderPending bool
+	Delivery       Guid // the scheduled check-in of a pending reorder
+}
+
+const reorderUser = "ReorderSaga"
+
+// NewReorderSaga raises a reorder when an item's stock drops below its
+// reorder point, after the lead time the reordered quantity is checked in by
+// the scheduler. The reorder stays pending until that check-in has happened.
+func NewReorderSaga(quantity int, leadTime time.Duration, store SagaStore, events EventStore, scheduler *Scheduler) *Saga[ReorderState] {
+	saga := NewSaga[ReorderState]("reorder", store, events, scheduler.dispatcher)
+	saga.ScheduleWith(scheduler)
+
+	// reorder raises a reorder if the item is low and there is none pending
+	reorder := func(sc *SagaContext, state *ReorderState) {
+		if state.Count < state.ReorderPoint && !state.ReorderPending {
+			state.ReorderPending = true
+			// the scheduler checks it in against the item's version at the time
+			state.Delivery = sc.Schedule(CheckInItemsToInventory{
+				Issued:          Issued{User: reorderUser},
+				InventoryItemId: sc.CorrelationId,
+				Count:           quantity,
+			}, leadTime)
+		}
+	}
+
+	StartSagaWith(saga, func(sc *SagaContext, state *ReorderState, evt InventoryItemCreated) error {
+		state.Count = 0
+		return nil
+	})
+	AdvanceSagaWith(saga, func(sc *SagaContext, state *ReorderState, evt ItemsCheckedInToInventory) error {
+		state.Count += evt.Count()
+		if evt.User() == reorderUser {
+			state.ReorderPending = false
+			state.Delivery = ""
+		}
+		reorder(sc, state)
+		return nil
+	})
+	AdvanceSagaWith(saga, func(sc *SagaContext, state *ReorderState, evt ItemsRemovedFromInventory) error {
+		state.Count -= evt.Count()
+		reorder(sc, state)
+		return nil
+	})
+	AdvanceSagaWith(saga, func(sc *SagaContext, state *ReorderState, evt ReorderPointSet) error {
+		state.ReorderPoint = evt.ReorderPoint()
+		reorder(sc, state)
+		return nil
+	})
+	AdvanceSagaWith(saga, func(sc *SagaContext, state *ReorderState, evt InventoryItemDeactivated) error {
+		if state.Delivery != "" {
+			sc.CancelScheduled(state.Delivery)
+		}
+		sc.Complete()
+		return nil
+	})
+	return saga
+}
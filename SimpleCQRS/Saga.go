@@ -0,0 +1,347 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SagaContext is handed to saga handlers so they can react to what happened
+type SagaContext struct {
+	CorrelationId Guid
+	now           time.Time
+	versions      map[Guid]int
+	timeouts      map[string]time.Time
+	commands      []Command
+	scheduled     []sagaScheduledCommand
+	cancelled     []Guid
+	completed     bool
+}
+
+type sagaScheduledCommand struct {
+	id  Guid
+	cmd Command
+	due time.Time
+}
+
+// Dispatch queues a command, the saga's new state is only saved once it is sent
+func (sc *SagaContext) Dispatch(cmd Command) {
+	sc.commands = append(sc.commands, cmd)
+}
+
+// Schedule queues a command for the saga's Scheduler to send after the delay,
+// the saga's new state is only saved once it is scheduled. The Scheduler retries it until it
+// succeeds, so a saga can wait for the events it causes.
+func (sc *SagaContext) Schedule(cmd Command, after time.Duration) Guid {
+	id := NewGuid()
+	sc.scheduled = append(sc.scheduled, sagaScheduledCommand{id, cmd, sc.now.Add(after)})
+	return id
+}
+
+// CancelScheduled takes back a command from Schedule that has not been sent yet
+func (sc *SagaContext) CancelScheduled(id Guid) {
+	sc.cancelled = append(sc.cancelled, id)
+}
+
+// RequestTimeout asks for the saga's timeout handler to be called with name after the delay
+func (sc *SagaContext) RequestTimeout(name string, after time.Duration) {
+	sc.timeouts[name] = sc.now.Add(after)
+}
+
+func (sc *SagaContext) CancelTimeout(name string) {
+	delete(sc.timeouts, name)
+}
+
+// Complete marks the saga as finished, later events for it are ignored
+func (sc *SagaContext) Complete() {
+	sc.completed = true
+}
+
+// LastVersion is the version of the latest event the saga has seen for an aggregate
+func (sc *SagaContext) LastVersion(aggregateId Guid) int {
+	return sc.versions[aggregateId]
+}
+
+type SagaEventHandler[S any] func(sc *SagaContext, state *S, evt Event) error
+type SagaTimeoutHandler[S any] func(sc *SagaContext, state *S, name string) error
+
+// Saga is a process manager whose state S is persisted in a SagaStore and
+// advanced by events. Events are applied in version order per aggregate;
+// duplicates are skipped and any event that overtook an earlier one is
+// applied after it by catching up from the EventStore.
+type Saga[S any] struct {
+	name       string
+	store      SagaStore
+	events     EventStore
+	dispatcher CommandDispatcher
+	scheduler  *Scheduler
+	clock      Clock
+	handlers   map[reflect.Type]SagaEventHandler[S]
+	starters   map[reflect.Type]bool
+	correlate  func(evt AggregateEvent) Guid
+	onTimeout  SagaTimeoutHandler[S]
+	s          sync.Mutex
+}
+
+func NewSaga[S any](name string, store SagaStore, events EventStore, dispatcher CommandDispatcher) *Saga[S] {
+	return &Saga[S]{
+		name:       name,
+		store:      store,
+		events:     events,
+		dispatcher: dispatcher,
+		clock:      SystemClock,
+		handlers:   make(map[reflect.Type]SagaEventHandler[S]),
+		starters:   make(map[reflect.Type]bool),
+		correlate:  func(evt AggregateEvent) Guid { return evt.Id() },
+		onTimeout:  func(sc *SagaContext, state *S, name string) error { return nil },
+	}
+}
+
+// CorrelateBy replaces the default correlation id, which is the aggregate id of the event
+func (saga *Saga[S]) CorrelateBy(correlate func(evt AggregateEvent) Guid) {
+	saga.correlate = correlate
+}
+
+func (saga *Saga[S]) OnTimeout(handler SagaTimeoutHandler[S]) {
+	saga.onTimeout = handler
+}
+
+// ScheduleWith sends the commands the saga schedules through scheduler, and
+// times the saga's timeouts by the scheduler's clock
+func (saga *Saga[S]) ScheduleWith(scheduler *Scheduler) {
+	saga.scheduler = scheduler
+	saga.clock = scheduler.clock
+}
+
+// StartSagaWith registers an event that starts a new saga (or advances a running one)
+func StartSagaWith[E AggregateEvent, S any](saga *Saga[S], handler func(sc *SagaContext, state *S, evt E) error) {
+	AdvanceSagaWith(saga, handler)
+	saga.starters[typeOf[E]()] = true
+}
+
+// AdvanceSagaWith registers an event that only advances an already running saga
+func AdvanceSagaWith[E AggregateEvent, S any](saga *Saga[S], handler func(sc *SagaContext, state *S, evt E) error) {
+	saga.handlers[typeOf[E]()] = func(sc *SagaContext, state *S, evt Event) error {
+		return handler(sc, state, evt.(E))
+	}
+}
+
+// Subscribe registers the saga for every event type it handles
+func (saga *Saga[S]) Subscribe(r EventProcessorRegistry) error {
+	for eventType := range saga.handlers {
+		if err := r.AddEventProcessor(eventType, saga.Handle); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (saga *Saga[S]) Handle(evt Event) error {
+	ae, ok := evt.(AggregateEvent)
+	if !ok {
+		return errors.New("saga passed an event without an aggregate")
+	}
+
+	saga.s.Lock()
+	defer saga.s.Unlock()
+
+	correlationId := saga.correlate(ae)
+	instance, err := saga.store.Load(saga.name, correlationId)
+	if err != nil {
+		return err
+	}
+	if instance != nil && instance.Completed {
+		return nil
+	}
+	history, err := saga.history(ae)
+	if err != nil {
+		return err
+	}
+	if instance == nil {
+		// an event may overtake the one that starts the saga, which is
+		// already in the store and is where the saga starts from
+		start := saga.firstStarter(history)
+		if start == nil {
+			return nil
+		}
+		instance = &SagaInstance{
+			SagaType:      saga.name,
+			CorrelationId: correlationId,
+			Versions:      map[Guid]int{ae.Id(): start.Version() - 1},
+			Timeouts:      make(map[string]time.Time),
+		}
+	}
+
+	last, seen := instance.Versions[ae.Id()]
+	if !seen {
+		last = ae.Version() - 1
+	}
+	pending := make([]Event, 0)
+	for _, e := range history {
+		if e.Version() > last {
+			pending = append(pending, e)
+		}
+	}
+	if len(pending) == 0 {
+		Logger.Println("Saga", saga.name, "skipping already applied event:", evt)
+		return nil
+	}
+
+	return saga.apply(instance, func(sc *SagaContext, state *S) error {
+		for _, e := range pending {
+			if handler, ok := saga.handlers[reflect.TypeOf(e)]; ok {
+				if err := handler(sc, state, e); err != nil {
+					return err
+				}
+			}
+			sc.versions[ae.Id()] = e.Version()
+		}
+		return nil
+	})
+}
+
+// history returns every event of evt's aggregate up to its head in the
+// store, so events that overtook evt are applied along with it
+func (saga *Saga[S]) history(evt AggregateEvent) ([]Event, error) {
+	history, err := saga.events.GetEventsForAggregate(evt.Id())
+	if err != nil {
+		return nil, err
+	}
+	if len(history) == 0 || history[len(history)-1].Version() < evt.Version() {
+		history = append(history, evt)
+	}
+	return history, nil
+}
+
+func (saga *Saga[S]) firstStarter(history []Event) Event {
+	for _, e := range history {
+		if saga.starters[reflect.TypeOf(e)] {
+			return e
+		}
+	}
+	return nil
+}
+
+// ProcessTimeouts calls the timeout handler for every timeout that is due at now
+func (saga *Saga[S]) ProcessTimeouts(now time.Time) error {
+	saga.s.Lock()
+	defer saga.s.Unlock()
+
+	instances, err := saga.store.LoadAll(saga.name)
+	if err != nil {
+		return err
+	}
+	for _, instance := range instances {
+		if instance.Completed {
+			continue
+		}
+		for name, due := range instance.Timeouts {
+			if due.After(now) {
+				continue
+			}
+			err := saga.apply(instance, func(sc *SagaContext, state *S) error {
+				delete(sc.timeouts, name)
+				return saga.onTimeout(sc, state, name)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RunTimeouts checks for due timeouts every interval until stop is called
+func (saga *Saga[S]) RunTimeouts(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-saga.clock.After(interval):
+				if err := saga.ProcessTimeouts(saga.clock.Now()); err != nil {
+					Logger.Println("Saga", saga.name, "timeout error:", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// apply runs change against the instance's state, then sends the commands
+// the handlers asked for and only saves the result once they have all gone.
+// If any cannot be sent the state is left as it was, so the events are
+// applied again, and the commands asked for again, the next time the saga is
+// handed an event for the aggregate.
+func (saga *Saga[S]) apply(instance *SagaInstance, change func(sc *SagaContext, state *S) error) error {
+	var state S
+	if len(instance.State) > 0 {
+		if err := json.Unmarshal(instance.State, &state); err != nil {
+			return err
+		}
+	}
+	versions := make(map[Guid]int, len(instance.Versions))
+	for id, version := range instance.Versions {
+		versions[id] = version
+	}
+	timeouts := make(map[string]time.Time, len(instance.Timeouts))
+	for name, due := range instance.Timeouts {
+		timeouts[name] = due
+	}
+	sc := &SagaContext{
+		CorrelationId: instance.CorrelationId,
+		now:           saga.clock.Now(),
+		versions:      versions,
+		timeouts:      timeouts,
+		commands:      make([]Command, 0),
+	}
+	if err := change(sc, &state); err != nil {
+		return err
+	}
+	if saga.scheduler == nil && len(sc.scheduled)+len(sc.cancelled) > 0 {
+		return fmt.Errorf("saga %v schedules commands but has no scheduler", saga.name)
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	scheduled := make([]Guid, 0, len(sc.scheduled))
+	// unschedule takes back what was scheduled when the rest cannot be done
+	unschedule := func(err error) error {
+		for _, id := range scheduled {
+			saga.scheduler.Cancel(id)
+		}
+		return fmt.Errorf("saga %v for %v: %w", saga.name, instance.CorrelationId, err)
+	}
+	for _, s := range sc.scheduled {
+		if err := saga.scheduler.scheduleAs(s.id, s.cmd, s.due); err != nil {
+			return unschedule(err)
+		}
+		scheduled = append(scheduled, s.id)
+	}
+	for _, cmd := range sc.commands {
+		if err := saga.dispatcher.Dispatch(cmd, nil); err != nil {
+			return unschedule(err)
+		}
+	}
+	saved := *instance
+	saved.State = data
+	saved.Versions = sc.versions
+	saved.Timeouts = sc.timeouts
+	saved.Completed = instance.Completed || sc.completed
+	if err := saga.store.Save(&saved); err != nil {
+		return unschedule(err)
+	}
+	*instance = saved
+	for _, id := range sc.cancelled {
+		if err := saga.scheduler.Cancel(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
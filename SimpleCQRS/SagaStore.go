@@ -0,0 +1,164 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// SagaInstance is the persisted state of one running saga
+type SagaInstance struct {
+	SagaType      string
+	CorrelationId Guid
+	Versions      map[Guid]int // last event version applied, per aggregate
+	Timeouts      map[string]time.Time
+	Completed     bool
+	State         json.RawMessage
+}
+
+type SagaStore interface {
+	// Load returns nil if there is no saga for the correlation id
+	Load(sagaType string, correlationId Guid) (*SagaInstance, error)
+	LoadAll(sagaType string) ([]*SagaInstance, error)
+	Save(instance *SagaInstance) error
+}
+
+func cloneSagaInstance(instance *SagaInstance) *SagaInstance {
+	c := *instance
+	c.Versions = make(map[Guid]int, len(instance.Versions))
+	for k, v := range instance.Versions {
+		c.Versions[k] = v
+	}
+	c.Timeouts = make(map[string]time.Time, len(instance.Timeouts))
+	for k, v := range instance.Timeouts {
+		c.Timeouts[k] = v
+	}
+	c.State = append(json.RawMessage(nil), instance.State...)
+	return &c
+}
+
+type inMemorySagaStore struct {
+	instances map[string]map[Guid]*SagaInstance
+	s         sync.RWMutex
+}
+
+func NewInMemorySagaStore() SagaStore {
+	return &inMemorySagaStore{instances: make(map[string]map[Guid]*SagaInstance)}
+}
+
+func (store *inMemorySagaStore) Load(sagaType string, correlationId Guid) (*SagaInstance, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	instance, ok := store.instances[sagaType][correlationId]
+	if !ok {
+		return nil, nil
+	}
+	return cloneSagaInstance(instance), nil
+}
+
+func (store *inMemorySagaStore) LoadAll(sagaType string) ([]*SagaInstance, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	instances := make([]*SagaInstance, 0, len(store.instances[sagaType]))
+	for _, instance := range store.instances[sagaType] {
+		instances = append(instances, cloneSagaInstance(instance))
+	}
+	return instances, nil
+}
+
+func (store *inMemorySagaStore) Save(instance *SagaInstance) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	byId, ok := store.instances[instance.SagaType]
+	if !ok {
+		byId = make(map[Guid]*SagaInstance)
+		store.instances[instance.SagaType] = byId
+	}
+	byId[instance.CorrelationId] = cloneSagaInstance(instance)
+	return nil
+}
+
+// fileSagaStore keeps one JSON file per saga instance under dir/<saga type>/
+type fileSagaStore struct {
+	dir string
+	s   sync.RWMutex
+}
+
+func NewFileSagaStore(dir string) (SagaStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &fileSagaStore{dir: dir}, nil
+}
+
+func (store *fileSagaStore) path(sagaType string, correlationId Guid) string {
+	return filepath.Join(store.dir, sagaType, string(correlationId)+".json")
+}
+
+func (store *fileSagaStore) read(path string) (*SagaInstance, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	instance := &SagaInstance{}
+	if err := json.Unmarshal(data, instance); err != nil {
+		return nil, err
+	}
+	return instance, nil
+}
+
+func (store *fileSagaStore) Load(sagaType string, correlationId Guid) (*SagaInstance, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	instance, err := store.read(store.path(sagaType, correlationId))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return instance, err
+}
+
+func (store *fileSagaStore) LoadAll(sagaType string) ([]*SagaInstance, error) {
+	store.s.RLock()
+	defer store.s.RUnlock()
+
+	paths, err := filepath.Glob(filepath.Join(store.dir, sagaType, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	instances := make([]*SagaInstance, 0, len(paths))
+	for _, path := range paths {
+		instance, err := store.read(path)
+		if err != nil {
+			return nil, err
+		}
+		instances = append(instances, instance)
+	}
+	return instances, nil
+}
+
+func (store *fileSagaStore) Save(instance *SagaInstance) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return err
+	}
+	path := store.path(instance.SagaType, instance.CorrelationId)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a half written saga behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
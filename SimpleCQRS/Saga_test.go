@@ -0,0 +1,226 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+type discardEvents struct{}
+
+func (discardEvents) Publish(evt Event) error { return nil }
+
+type countingState struct {
+	Count    int
+	Versions []int
+}
+
+func newCountingSaga(store SagaStore, events EventStore) *Saga[countingState] {
+	saga := NewSaga[countingState]("counting", store, events, nil)
+	StartSagaWith(saga, func(sc *SagaContext, state *countingState, evt InventoryItemCreated) error {
+		state.Versions = append(state.Versions, evt.Version())
+		return nil
+	})
+	AdvanceSagaWith(saga, func(sc *SagaContext, state *countingState, evt ItemsCheckedInToInventory) error {
+		state.Count += evt.Count()
+		state.Versions = append(state.Versions, evt.Version())
+		return nil
+	})
+	AdvanceSagaWith(saga, func(sc *SagaContext, state *countingState, evt ItemsRemovedFromInventory) error {
+		state.Count -= evt.Count()
+		state.Versions = append(state.Versions, evt.Version())
+		return nil
+	})
+	return saga
+}
+
+func sagaState[S any](t *testing.T, store SagaStore, sagaType string, id Guid) (S, *SagaInstance) {
+	var state S
+	instance, err := store.Load(sagaType, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance != nil {
+		if err := json.Unmarshal(instance.State, &state); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return state, instance
+}
+
+func TestSagaAppliesEventsInVersionOrder(t *testing.T) {
+	events := NewEventStore(discardEvents{})
+	saved := []Event{
+		NewInventoryItemCreated("a", "widget"),
+		NewItemsCheckedInToInventory("a", 5),
+		NewItemsRemovedFromInventory("a", 2),
+		NewItemsCheckedInToInventory("a", 4),
+	}
+	for i, evt := range saved {
+		if _, err := events.SaveEvents("a", []Event{evt}, i-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store := NewInMemorySagaStore()
+	saga := newCountingSaga(store, events)
+
+	// the removal overtakes the events before it, including the one that
+	// starts the saga, then those turn up late and one of them twice
+	for _, i := range []int{2, 0, 1, 1, 3} {
+		if err := saga.Handle(saved[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	state, _ := sagaState[countingState](t, store, "counting", "a")
+	if state.Count != 7 {
+		t.Fatalf("count is %v, want 7", state.Count)
+	}
+	if len(state.Versions) != 4 {
+		t.Fatalf("applied versions %v, want each once", state.Versions)
+	}
+	for i, v := range state.Versions {
+		if v != i {
+			t.Fatalf("applied versions %v, want them in order", state.Versions)
+		}
+	}
+}
+
+func TestSagaIgnoresEventsBeforeItStarts(t *testing.T) {
+	events := NewEventStore(discardEvents{})
+	checkIn := NewItemsCheckedInToInventory("a", 5)
+	events.SaveEvents("a", []Event{checkIn}, -1)
+	store := NewInMemorySagaStore()
+
+	if err := newCountingSaga(store, events).Handle(checkIn); err != nil {
+		t.Fatal(err)
+	}
+	if _, instance := sagaState[countingState](t, store, "counting", "a"); instance != nil {
+		t.Fatalf("started by %v", checkIn)
+	}
+}
+
+// flakyDispatcher turns commands away until it is told to take them
+type flakyDispatcher struct {
+	refuse bool
+	sent   []Command
+}
+
+func (fd *flakyDispatcher) Dispatch(cmd Command, syncResp chan CommandResult) CommandSubmissionError {
+	if fd.refuse {
+		return errors.New("command queue full")
+	}
+	fd.sent = append(fd.sent, cmd)
+	return nil
+}
+
+func TestSagaOnlySavesOnceItsCommandsAreSent(t *testing.T) {
+	events := NewEventStore(discardEvents{})
+	saved := []Event{NewInventoryItemCreated("a", "widget"), NewItemsCheckedInToInventory("a", 5), NewItemsCheckedInToInventory("a", 1)}
+	for i, evt := range saved {
+		events.SaveEvents("a", []Event{evt}, i-1)
+	}
+	store := NewInMemorySagaStore()
+	dispatcher := &flakyDispatcher{refuse: true}
+	saga := NewSaga[countingState]("counting", store, events, dispatcher)
+	StartSagaWith(saga, func(sc *SagaContext, state *countingState, evt InventoryItemCreated) error {
+		return nil
+	})
+	AdvanceSagaWith(saga, func(sc *SagaContext, state *countingState, evt ItemsCheckedInToInventory) error {
+		state.Count += evt.Count()
+		sc.Dispatch(RemoveItemsFromInventory{InventoryItemId: "a", Count: evt.Count()})
+		return nil
+	})
+
+	saga.Handle(saved[0])
+	if err := saga.Handle(saved[1]); err == nil {
+		t.Fatal("no error for a command that could not be sent")
+	}
+	if state, _ := sagaState[countingState](t, store, "counting", "a"); state.Count != 0 {
+		t.Fatalf("saved %+v without sending its command", state)
+	}
+
+	// the next event applies the one that failed again
+	dispatcher.refuse = false
+	if err := saga.Handle(saved[2]); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := sagaState[countingState](t, store, "counting", "a"); state.Count != 6 || len(dispatcher.sent) != 2 {
+		t.Fatalf("%+v, sent %v", state, dispatcher.sent)
+	}
+}
+
+func waitForSaga(t *testing.T, store SagaStore, id Guid, done func(state ReorderState) bool) ReorderState {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		state, instance := sagaState[ReorderState](t, store, "reorder", id)
+		if instance != nil && done(state) {
+			return state
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("saga stuck at %+v", state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReorderSagaKeepsTheReorderPendingUntilItIsCheckedIn(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus, storage, scheduler, schedule := newScheduledInventory(t, clock)
+	sagas := NewInMemorySagaStore()
+	if err := NewReorderSaga(20, time.Hour, sagas, storage, scheduler).Subscribe(bus); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatchAndWait(t, bus, CreateInventoryItem{InventoryItemId: "a", Name: "widget"})
+	dispatchAndWait(t, bus, CheckInItemsToInventory{InventoryItemId: "a", OriginalVersion: 0, Count: 2})
+	if waitForSaga(t, sagas, "a", func(state ReorderState) bool { return state.Count == 2 }).ReorderPending {
+		t.Fatal("reordered an item without a reorder point")
+	}
+	dispatchAndWait(t, bus, SetReorderPoint{InventoryItemId: "a", OriginalVersion: 1, ReorderPoint: 5})
+	state := waitForSaga(t, sagas, "a", func(state ReorderState) bool { return state.ReorderPoint == 5 })
+	if !state.ReorderPending {
+		t.Fatal("no reorder when the reorder point went above the count")
+	}
+	clock.Advance(time.Hour)
+	scheduler.DispatchDue()
+	waitForSaga(t, sagas, "a", func(state ReorderState) bool { return !state.ReorderPending && state.Count == 22 })
+	dispatchAndWait(t, bus, RemoveItemsFromInventory{InventoryItemId: "a", OriginalVersion: 3, Count: 20})
+	state = waitForSaga(t, sagas, "a", func(state ReorderState) bool { return state.ReorderPending })
+	if pending, _ := schedule.All(); len(pending) != 1 || pending[0].Id != state.Delivery {
+		t.Fatalf("want the delivery %v scheduled, have %+v", state.Delivery, pending)
+	}
+
+	// the item changes before the delivery is due
+	dispatchAndWait(t, bus, RemoveItemsFromInventory{InventoryItemId: "a", OriginalVersion: 4, Count: 1})
+	clock.Advance(30 * time.Minute)
+	scheduler.DispatchDue()
+	if !waitForSaga(t, sagas, "a", func(state ReorderState) bool { return state.Count == 1 }).ReorderPending {
+		t.Fatal("reorder no longer pending before the delivery")
+	}
+
+	clock.Advance(30 * time.Minute)
+	if err := scheduler.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	state = waitForSaga(t, sagas, "a", func(state ReorderState) bool { return !state.ReorderPending })
+	if state.Count != 21 || countOf(t, storage, "a") != 21 {
+		t.Fatalf("saga counts %v, store %v, want 21", state.Count, countOf(t, storage, "a"))
+	}
+
+	dispatchAndWait(t, bus, RemoveItemsFromInventory{InventoryItemId: "a", OriginalVersion: 6, Count: 20})
+	waitForSaga(t, sagas, "a", func(state ReorderState) bool { return state.ReorderPending })
+	dispatchAndWait(t, bus, DeactivateInventoryItem{InventoryItemId: "a", OriginalVersion: 7})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, instance := sagaState[ReorderState](t, sagas, "reorder", "a"); instance.Completed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("saga not completed by the deactivation")
+		}
+	}
+	if pending, _ := schedule.All(); len(pending) != 0 {
+		t.Fatalf("delivery to a deactivated item still scheduled: %+v", pending)
+	}
+}
@@ -0,0 +1,439 @@
+package SimpleCQRS
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type ScheduledCommand struct {
+	Id          Guid
+	Due         time.Time
+	CommandType string
+	Command     json.RawMessage
+	Attempts    int    // dispatches that have failed so far
+	LastError   string `json:",omitempty"`
+	// Key is the idempotency key the command is sent with, the id unless an
+	// attempt has come back with an error and the next has to be sent afresh
+	Key string `json:",omitempty"`
+}
+
+type ScheduleStore interface {
+	// Add saves a pending command, replacing any with the same id
+	Add(sc ScheduledCommand) error
+	Remove(id Guid) error
+	All() ([]ScheduledCommand, error)
+	// DeadLetter moves a command that will never be sent out of the pending ones
+	DeadLetter(sc ScheduledCommand) error
+	DeadLetters() ([]ScheduledCommand, error)
+}
+
+type inMemoryScheduleStore struct {
+	pending map[Guid]ScheduledCommand
+	dead    map[Guid]ScheduledCommand
+	s       sync.Mutex
+}
+
+func NewInMemoryScheduleStore() ScheduleStore {
+	return &inMemoryScheduleStore{pending: make(map[Guid]ScheduledCommand), dead: make(map[Guid]ScheduledCommand)}
+}
+
+func (store *inMemoryScheduleStore) Add(sc ScheduledCommand) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	store.pending[sc.Id] = sc
+	return nil
+}
+
+func (store *inMemoryScheduleStore) Remove(id Guid) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	delete(store.pending, id)
+	return nil
+}
+
+func (store *inMemoryScheduleStore) All() ([]ScheduledCommand, error) {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	return scheduledCommands(store.pending), nil
+}
+
+func (store *inMemoryScheduleStore) DeadLetter(sc ScheduledCommand) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	delete(store.pending, sc.Id)
+	store.dead[sc.Id] = sc
+	return nil
+}
+
+func (store *inMemoryScheduleStore) DeadLetters() ([]ScheduledCommand, error) {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	return scheduledCommands(store.dead), nil
+}
+
+func scheduledCommands(byId map[Guid]ScheduledCommand) []ScheduledCommand {
+	all := make([]ScheduledCommand, 0, len(byId))
+	for _, sc := range byId {
+		all = append(all, sc)
+	}
+	return all
+}
+
+// fileScheduleStore keeps every pending command in a single JSON file that is
+// rewritten on each change, and the dead letters in another beside it
+type fileScheduleStore struct {
+	path string
+	dead string
+	s    sync.Mutex
+}
+
+func NewFileScheduleStore(path string) (ScheduleStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return &fileScheduleStore{path: path, dead: path + ".dead"}, nil
+}
+
+func (store *fileScheduleStore) read(path string) (map[Guid]ScheduledCommand, error) {
+	byId := make(map[Guid]ScheduledCommand)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return byId, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return byId, json.Unmarshal(data, &byId)
+}
+
+func (store *fileScheduleStore) write(path string, byId map[Guid]ScheduledCommand) error {
+	data, err := json.Marshal(byId)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (store *fileScheduleStore) Add(sc ScheduledCommand) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	pending, err := store.read(store.path)
+	if err != nil {
+		return err
+	}
+	pending[sc.Id] = sc
+	return store.write(store.path, pending)
+}
+
+func (store *fileScheduleStore) Remove(id Guid) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	pending, err := store.read(store.path)
+	if err != nil {
+		return err
+	}
+	delete(pending, id)
+	return store.write(store.path, pending)
+}
+
+func (store *fileScheduleStore) All() ([]ScheduledCommand, error) {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	pending, err := store.read(store.path)
+	if err != nil {
+		return nil, err
+	}
+	return scheduledCommands(pending), nil
+}
+
+// DeadLetter saves the dead letter before removing the pending command, so a
+// crash in between leaves it in both rather than in neither
+func (store *fileScheduleStore) DeadLetter(sc ScheduledCommand) error {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	dead, err := store.read(store.dead)
+	if err != nil {
+		return err
+	}
+	dead[sc.Id] = sc
+	if err := store.write(store.dead, dead); err != nil {
+		return err
+	}
+	pending, err := store.read(store.path)
+	if err != nil {
+		return err
+	}
+	delete(pending, sc.Id)
+	return store.write(store.path, pending)
+}
+
+func (store *fileScheduleStore) DeadLetters() ([]ScheduledCommand, error) {
+	store.s.Lock()
+	defer store.s.Unlock()
+
+	dead, err := store.read(store.dead)
+	if err != nil {
+		return nil, err
+	}
+	return scheduledCommands(dead), nil
+}
+
+// Scheduler holds commands until they are due and then dispatches them. As
+// pending commands live in the ScheduleStore, a restarted scheduler picks up
+// where the last one left off and sends anything that fell due while it was down.
+//
+// A VersionedCommand is sent against its aggregate's version when it falls
+// due, read from events, rather than the version it was scheduled with.
+type Scheduler struct {
+	RetryDelay    time.Duration // before a failed command is tried again
+	MaxAttempts   int           // failures before a command is dead lettered
+	ResultTimeout time.Duration // how long to wait for a command's result
+
+	store      ScheduleStore
+	codec      *CommandCodec
+	dispatcher CommandDispatcher
+	events     EventStore
+	clock      Clock
+	wake       chan struct{}
+	sending    map[Guid]bool // taken by a DispatchDue that has not finished with them
+	s          sync.Mutex
+}
+
+func NewScheduler(store ScheduleStore, codec *CommandCodec, dispatcher CommandDispatcher, events EventStore, clock Clock) *Scheduler {
+	return &Scheduler{
+		RetryDelay:    time.Minute,
+		MaxAttempts:   5,
+		ResultTimeout: 30 * time.Second,
+		store:         store,
+		codec:         codec,
+		dispatcher:    dispatcher,
+		events:        events,
+		clock:         clock,
+		wake:          make(chan struct{}, 1),
+		sending:       make(map[Guid]bool),
+	}
+}
+
+func (sch *Scheduler) Schedule(cmd Command, due time.Time) (Guid, error) {
+	id := NewGuid()
+	return id, sch.scheduleAs(id, cmd, due)
+}
+
+func (sch *Scheduler) scheduleAs(id Guid, cmd Command, due time.Time) error {
+	name, data, err := sch.codec.Encode(cmd)
+	if err != nil {
+		return err
+	}
+	if err := sch.store.Add(ScheduledCommand{Id: id, Due: due, CommandType: name, Command: data}); err != nil {
+		return err
+	}
+	sch.notify()
+	return nil
+}
+
+func (sch *Scheduler) ScheduleAfter(cmd Command, delay time.Duration) (Guid, error) {
+	return sch.Schedule(cmd, sch.clock.Now().Add(delay))
+}
+
+func (sch *Scheduler) Cancel(id Guid) error {
+	if err := sch.store.Remove(id); err != nil {
+		return err
+	}
+	sch.notify()
+	return nil
+}
+
+// Pending returns the commands still waiting to be sent, soonest first
+func (sch *Scheduler) Pending() ([]ScheduledCommand, error) {
+	all, err := sch.store.All()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Due.Before(all[j].Due) })
+	return all, nil
+}
+
+// DeadLetters returns the commands that were given up on
+func (sch *Scheduler) DeadLetters() ([]ScheduledCommand, error) {
+	return sch.store.DeadLetters()
+}
+
+// DispatchDue sends every command that is due and waits for its result. A
+// command is only removed from the store once it has been handled, one that
+// fails is tried again after RetryDelay until it has failed MaxAttempts times
+// and is dead lettered, as is one that cannot be decoded. Only the store
+// failing stops the rest from being sent. A command that is already being
+// sent by another call is left to it.
+func (sch *Scheduler) DispatchDue() error {
+	due, err := sch.takeDue()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		sch.s.Lock()
+		defer sch.s.Unlock()
+
+		for _, sc := range due {
+			delete(sch.sending, sc.Id)
+		}
+	}()
+
+	for _, sc := range due {
+		cmd, err := sch.codec.Decode(sc.CommandType, sc.Command)
+		if err != nil {
+			if err := sch.failed(sc, err, false); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := sch.dispatch(sc, cmd); err != nil {
+			if err := sch.failed(sc, err, true); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := sch.store.Remove(sc.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeDue marks the commands that are due as being sent, so they are only
+// sent once however many calls to DispatchDue overlap
+func (sch *Scheduler) takeDue() ([]ScheduledCommand, error) {
+	sch.s.Lock()
+	defer sch.s.Unlock()
+
+	pending, err := sch.Pending()
+	if err != nil {
+		return nil, err
+	}
+	now := sch.clock.Now()
+	due := make([]ScheduledCommand, 0)
+	for _, sc := range pending {
+		if sc.Due.After(now) {
+			break
+		}
+		if !sch.sending[sc.Id] {
+			sch.sending[sc.Id] = true
+			due = append(due, sc)
+		}
+	}
+	return due, nil
+}
+
+// errNoResult is a dispatch whose outcome is unknown, it may yet succeed
+var errNoResult = errors.New("no result")
+
+// dispatch sends the command with the scheduled command's idempotency key,
+// so one that is sent again after it timed out is not handled twice
+func (sch *Scheduler) dispatch(sc ScheduledCommand, cmd Command) error {
+	if vc, ok := cmd.(VersionedCommand); ok && sch.events != nil {
+		history, err := sch.events.GetEventsForAggregate(vc.AggregateId())
+		if err != nil {
+			return err
+		}
+		cmd = vc.AtVersion(history[len(history)-1].Version())
+	}
+	if ic, ok := cmd.(IdempotentCommand); ok {
+		key := sc.Key
+		if key == "" {
+			key = string(sc.Id)
+		}
+		cmd = ic.WithIdempotencyKey(key)
+	}
+
+	Logger.Println("Dispatching scheduled command:", cmd)
+	result := make(chan CommandResult, 1)
+	if err := sch.dispatcher.Dispatch(cmd, result); err != nil {
+		return err
+	}
+	select {
+	case r := <-result:
+		return r.Err
+	case <-sch.clock.After(sch.ResultTimeout):
+		return fmt.Errorf("%w after %v", errNoResult, sch.ResultTimeout)
+	}
+}
+
+func (sch *Scheduler) failed(sc ScheduledCommand, err error, retry bool) error {
+	sc.Attempts++
+	sc.LastError = err.Error()
+	if !errors.Is(err, errNoResult) {
+		// the error is remembered against the key, so it would only be repeated
+		sc.Key = fmt.Sprintf("%v-%v", sc.Id, sc.Attempts)
+	}
+	if retry && sc.Attempts < sch.MaxAttempts {
+		Logger.Printf("Scheduled command %v failed, attempt %v: %v", sc.Id, sc.Attempts, err)
+		sc.Due = sch.clock.Now().Add(sch.RetryDelay)
+		return sch.store.Add(sc)
+	}
+	Logger.Printf("Scheduled command %v dead lettered after %v attempts: %v", sc.Id, sc.Attempts, err)
+	return sch.store.DeadLetter(sc)
+}
+
+// next returns how long until the next command is due
+func (sch *Scheduler) next() (time.Duration, bool) {
+	pending, err := sch.Pending()
+	if err != nil || len(pending) == 0 {
+		return 0, false
+	}
+	return pending[0].Due.Sub(sch.clock.Now()), true
+}
+
+func (sch *Scheduler) notify() {
+	select {
+	case sch.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches commands as they fall due until stop is called, stop waits
+// for any dispatch in progress. If dispatching fails the command is retried
+// after retryInterval.
+func (sch *Scheduler) Run(retryInterval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			var due <-chan time.Time
+			if err := sch.DispatchDue(); err != nil {
+				Logger.Println("Scheduler error:", err)
+				due = sch.clock.After(retryInterval)
+			} else if d, ok := sch.next(); ok {
+				due = sch.clock.After(d)
+			}
+
+			select {
+			case <-due:
+			case <-sch.wake:
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
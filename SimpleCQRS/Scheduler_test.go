@@ -0,0 +1,205 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newScheduledInventory(t *testing.T, clock Clock) (*FakeBus, EventStore, *Scheduler, ScheduleStore) {
+	bus := NewFakeBus(false)
+	storage := NewEventStore(bus)
+	commands := NewInventoryCommandHandlers(InventoryItemRepository{Storage: storage})
+	RegisterCommandHandler(bus, commands.HandleCreateInventoryItem)
+	RegisterCommandHandler(bus, commands.HandleCheckInItemsToInventory)
+	RegisterCommandHandler(bus, commands.HandleRemoveItemsFromInventory)
+	RegisterCommandHandler(bus, commands.HandleDeactivateInventoryItem)
+	RegisterCommandHandler(bus, commands.HandleSetReorderPoint)
+	bus.Start()
+	t.Cleanup(func() { bus.Stop(context.Background()) })
+
+	store := NewInMemoryScheduleStore()
+	scheduler := NewScheduler(store, NewInventoryCommandCodec(), bus, storage, clock)
+	scheduler.ResultTimeout = time.Second
+	return bus, storage, scheduler, store
+}
+
+func dispatchAndWait(t *testing.T, bus CommandDispatcher, cmd Command) Commit {
+	result := make(chan CommandResult, 1)
+	if err := bus.Dispatch(cmd, result); err != nil {
+		t.Fatal(err)
+	}
+	r := <-result
+	if r.Err != nil {
+		t.Fatal(r.Err)
+	}
+	return r.Commit
+}
+
+func countOf(t *testing.T, storage EventStore, id Guid) int {
+	history, err := storage.GetEventsForAggregate(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, evt := range history {
+		switch e := evt.(type) {
+		case ItemsCheckedInToInventory:
+			count += e.Count()
+		case ItemsRemovedFromInventory:
+			count -= e.Count()
+		}
+	}
+	return count
+}
+
+func TestSchedulerSendsAgainstTheVersionWhenDue(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus, storage, scheduler, store := newScheduledInventory(t, clock)
+
+	dispatchAndWait(t, bus, CreateInventoryItem{InventoryItemId: "a", Name: "widget"})
+	if _, err := scheduler.ScheduleAfter(CheckInItemsToInventory{InventoryItemId: "a", OriginalVersion: 0, Count: 5}, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// the item moves on after the check-in was scheduled
+	dispatchAndWait(t, bus, CheckInItemsToInventory{InventoryItemId: "a", OriginalVersion: 0, Count: 2})
+
+	if err := scheduler.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.All(); len(pending) != 1 {
+		t.Fatalf("sent before it was due, %v pending", len(pending))
+	}
+
+	clock.Advance(time.Hour)
+	if err := scheduler.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.All(); len(pending) != 0 {
+		t.Fatalf("%v still pending", len(pending))
+	}
+	if count := countOf(t, storage, "a"); count != 7 {
+		t.Fatalf("count is %v, want 7", count)
+	}
+}
+
+func TestSchedulerRetriesThenDeadLettersFailures(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus, storage, scheduler, store := newScheduledInventory(t, clock)
+	scheduler.MaxAttempts = 2
+
+	dispatchAndWait(t, bus, CreateInventoryItem{InventoryItemId: "a", Name: "widget"})
+	if _, err := scheduler.Schedule(RemoveItemsFromInventory{InventoryItemId: "a", Count: -1}, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	store.Add(ScheduledCommand{Id: "garbled", Due: clock.Now(), CommandType: "CheckInItemsToInventory", Command: []byte("{")})
+	if _, err := scheduler.Schedule(CheckInItemsToInventory{InventoryItemId: "a", Count: 3}, clock.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Second)
+	if err := scheduler.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	// the bad entries did not stop the good one
+	if count := countOf(t, storage, "a"); count != 3 {
+		t.Fatalf("count is %v, want 3", count)
+	}
+	pending, _ := store.All()
+	// under a new idempotency key, the failure is remembered against the old one
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" || pending[0].Key == "" {
+		t.Fatalf("want the failed removal waiting to be retried, have %+v", pending)
+	}
+	if !pending[0].Due.Equal(clock.Now().Add(scheduler.RetryDelay)) {
+		t.Fatalf("retry due %v", pending[0].Due)
+	}
+	dead, _ := store.DeadLetters()
+	if len(dead) != 1 || dead[0].Id != "garbled" {
+		t.Fatalf("want the garbled entry dead lettered, have %+v", dead)
+	}
+
+	clock.Advance(scheduler.RetryDelay)
+	if err := scheduler.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.All(); len(pending) != 0 {
+		t.Fatalf("%v still pending", len(pending))
+	}
+	if dead, _ := store.DeadLetters(); len(dead) != 2 {
+		t.Fatalf("%v dead letters, want 2", len(dead))
+	}
+}
+
+func TestFileScheduleStoreKeepsDeadLetters(t *testing.T) {
+	path := t.TempDir() + "/schedule.json"
+	store, err := NewFileScheduleStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add(ScheduledCommand{Id: "a"})
+	store.Add(ScheduledCommand{Id: "b"})
+	if err := store.DeadLetter(ScheduledCommand{Id: "a", Attempts: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, _ := NewFileScheduleStore(path)
+	pending, _ := reopened.All()
+	dead, _ := reopened.DeadLetters()
+	if len(pending) != 1 || pending[0].Id != "b" || len(dead) != 1 || dead[0].Attempts != 5 {
+		t.Fatalf("pending %+v, dead %+v", pending, dead)
+	}
+}
+
+// unansweredDispatcher sends commands on but loses the first result
+type unansweredDispatcher struct {
+	bus     CommandDispatcher
+	handled chan CommandResult
+	lost    bool
+}
+
+func (ud *unansweredDispatcher) Dispatch(cmd Command, syncResp chan CommandResult) CommandSubmissionError {
+	if ud.lost {
+		return ud.bus.Dispatch(cmd, syncResp)
+	}
+	ud.lost = true
+	return ud.bus.Dispatch(cmd, ud.handled)
+}
+
+func TestSchedulerDoesNotApplyACommandTwiceAfterATimeout(t *testing.T) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus, storage, _, store := newScheduledInventory(t, clock)
+	bus.UseIdempotencyStore(NewInMemoryIdempotencyStore(100, time.Hour, clock))
+	dispatcher := &unansweredDispatcher{bus: bus, handled: make(chan CommandResult, 1)}
+	scheduler := NewScheduler(store, NewInventoryCommandCodec(), dispatcher, storage, clock)
+
+	dispatchAndWait(t, bus, CreateInventoryItem{InventoryItemId: "a", Name: "widget"})
+	id, _ := scheduler.Schedule(CheckInItemsToInventory{InventoryItemId: "a", Count: 5}, clock.Now())
+	dispatched := make(chan error)
+	go func() { dispatched <- scheduler.DispatchDue() }()
+	<-dispatcher.handled
+	// the result timeout runs on the scheduler's clock
+	for waiting := 0; waiting == 0; time.Sleep(time.Millisecond) {
+		clock.s.Lock()
+		waiting = len(clock.waiters)
+		clock.s.Unlock()
+	}
+	clock.Advance(scheduler.ResultTimeout)
+	if err := <-dispatched; err != nil {
+		t.Fatal(err)
+	}
+	pending, _ := store.All()
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].Key != "" {
+		t.Fatalf("want the timed out check-in waiting to be retried under %v, have %+v", id, pending)
+	}
+
+	clock.Advance(scheduler.RetryDelay)
+	if err := scheduler.DispatchDue(); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := store.All(); len(pending) != 0 {
+		t.Fatalf("%v still pending", len(pending))
+	}
+	if count := countOf(t, storage, "a"); count != 5 {
+		t.Fatalf("count is %v, want the check-in applied once", count)
+	}
+}
@@ -0,0 +1,286 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FaultProfile describes how badly a transport misbehaves. Delays are picked
+// uniformly between the min and max, probabilities are between 0 and 1.
+// Duplicates and drops only apply to event deliveries.
+type FaultProfile struct {
+	MinCommandDelay      time.Duration
+	MaxCommandDelay      time.Duration
+	MinEventDelay        time.Duration
+	MaxEventDelay        time.Duration
+	ReorderProbability   float64
+	DuplicateProbability float64
+	DropProbability      float64
+}
+
+// InducedDelayFaults is the eventual consistency FakeBus has always been able to mimic
+func InducedDelayFaults() FaultProfile {
+	return FaultProfile{
+		MinCommandDelay: 1 * time.Second,
+		MaxCommandDelay: 3 * time.Second,
+		MaxEventDelay:   10 * time.Second,
+	}
+}
+
+// faults makes the random choices for a FaultProfile from a seeded source
+type faults struct {
+	profile FaultProfile
+	rng     *rand.Rand
+	s       sync.Mutex
+}
+
+func newFaults(profile FaultProfile, seed int64) *faults {
+	return &faults{profile: profile, rng: rand.New(rand.NewSource(seed))}
+}
+
+func (f *faults) between(min, max time.Duration) time.Duration {
+	f.s.Lock()
+	defer f.s.Unlock()
+
+	if max <= min {
+		return min
+	}
+	return min + time.Duration(f.rng.Int63n(int64(max-min)))
+}
+
+func (f *faults) commandDelay() time.Duration {
+	return f.between(f.profile.MinCommandDelay, f.profile.MaxCommandDelay)
+}
+
+func (f *faults) eventDelay() time.Duration {
+	return f.between(f.profile.MinEventDelay, f.profile.MaxEventDelay)
+}
+
+func (f *faults) chance(p float64) bool {
+	f.s.Lock()
+	defer f.s.Unlock()
+
+	return p > 0 && f.rng.Float64() < p
+}
+
+// deliveries is how many times an event should be delivered, 0 if it is dropped
+func (f *faults) deliveries() int {
+	if f.chance(f.profile.DropProbability) {
+		return 0
+	}
+	if f.chance(f.profile.DuplicateProbability) {
+		return 2
+	}
+	return 1
+}
+
+func (f *faults) pick(n int) int {
+	f.s.Lock()
+	defer f.s.Unlock()
+
+	return f.rng.Intn(n)
+}
+
+type simulatedSubscription struct {
+	filter       EventFilter
+	processor    EventProcessor
+	unsubscribed bool
+}
+
+type simulatedMessage struct {
+	due         time.Time
+	seq         int
+	description string
+	deliver     func()
+}
+
+// SimulatedBus is a single threaded transport driven by a VirtualClock. It
+// only moves when stepped, and every choice it makes comes from its seed, so
+// a run can be replayed exactly by building a new bus with the same seed and
+// sending it the same messages, e.g.
+//
+//	bus := NewSimulatedBus(seed, profile, NewVirtualClock(start))
+//	... register handlers, dispatch commands ...
+//	bus.RunUntilIdle(1000)
+//	fmt.Println(bus.Trace())
+type SimulatedBus struct {
+	seed            int64
+	faults          *faults
+	clock           *VirtualClock
+	commandHandlers map[reflect.Type]CommandHandler
+	subscriptions   []*simulatedSubscription
+	pending         []simulatedMessage
+	sequence        int
+	trace           []string
+	s               sync.Mutex
+}
+
+func NewSimulatedBus(seed int64, profile FaultProfile, clock *VirtualClock) *SimulatedBus {
+	return &SimulatedBus{
+		seed:            seed,
+		faults:          newFaults(profile, seed),
+		clock:           clock,
+		commandHandlers: make(map[reflect.Type]CommandHandler),
+		subscriptions:   make([]*simulatedSubscription, 0),
+		pending:         make([]simulatedMessage, 0),
+		trace:           make([]string, 0),
+	}
+}
+
+func (sb *SimulatedBus) Seed() int64 {
+	return sb.seed
+}
+
+// Trace lists everything the bus did in order, two runs with the same seed
+// and the same inputs produce the same trace
+func (sb *SimulatedBus) Trace() []string {
+	sb.s.Lock()
+	defer sb.s.Unlock()
+
+	return append([]string(nil), sb.trace...)
+}
+
+func (sb *SimulatedBus) SetCommandHandler(cmdType reflect.Type, handler CommandHandler) error {
+	sb.s.Lock()
+	defer sb.s.Unlock()
+
+	if _, ok := sb.commandHandlers[cmdType]; ok {
+		return errors.New("command handler already registered")
+	}
+	sb.commandHandlers[cmdType] = handler
+	return nil
+}
+
+func (sb *SimulatedBus) AddEventProcessor(eventType reflect.Type, processor EventProcessor) error {
+	_, err := sb.SubscribeEvents(EventFilter{Types: []reflect.Type{eventType}}, processor)
+	return err
+}
+
+func (sb *SimulatedBus) SubscribeEvents(filter EventFilter, processor EventProcessor) (func(), error) {
+	if err := filter.validate(); err != nil {
+		return nil, err
+	}
+
+	sb.s.Lock()
+	defer sb.s.Unlock()
+
+	for _, sub := range sb.subscriptions {
+		if reflect.DeepEqual(sub.filter, filter) && sameProcessor(sub.processor, processor) {
+			return nil, ErrAlreadySubscribed
+		}
+	}
+	sub := &simulatedSubscription{filter: filter, processor: processor}
+	sb.subscriptions = append(sb.subscriptions, sub)
+	return func() {
+		sb.s.Lock()
+		defer sb.s.Unlock()
+
+		sub.unsubscribed = true
+		for i, s := range sb.subscriptions {
+			if s == sub {
+				sb.subscriptions = append(sb.subscriptions[:i], sb.subscriptions[i+1:]...)
+				break
+			}
+		}
+	}, nil
+}
+
+func (sb *SimulatedBus) Dispatch(cmd Command, syncResp chan CommandResult) CommandSubmissionError {
+	sb.s.Lock()
+	defer sb.s.Unlock()
+
+	handler, ok := sb.commandHandlers[reflect.TypeOf(cmd)]
+	if !ok {
+		return errors.New("no handler registered")
+	}
+	sb.enqueue(sb.faults.commandDelay(), fmt.Sprintf("command %T %v", cmd, cmd), func() {
+		commit, err := handler(context.Background(), cmd)
+		result := CommandResult{commit, err}
+		select {
+		case syncResp <- result:
+		default:
+		}
+	})
+	return nil
+}
+
+func (sb *SimulatedBus) Publish(evt Event) error {
+	sb.s.Lock()
+	defer sb.s.Unlock()
+
+	for i, sub := range sb.subscriptions {
+		if !sub.filter.Matches(evt) {
+			continue
+		}
+		description := fmt.Sprintf("event %T v%v to processor %v", evt, evt.Version(), i)
+		copies := sb.faults.deliveries()
+		if copies == 0 {
+			sb.trace = append(sb.trace, sb.clock.Now().Format(time.RFC3339Nano)+" dropped "+description)
+		}
+		for c := 0; c < copies; c++ {
+			sub := sub
+			sb.enqueue(sb.faults.eventDelay(), description, func() {
+				sb.s.Lock()
+				unsubscribed := sub.unsubscribed
+				sb.s.Unlock()
+				if !unsubscribed {
+					sub.processor(evt)
+				}
+			})
+		}
+	}
+	return nil
+}
+
+func (sb *SimulatedBus) enqueue(delay time.Duration, description string, deliver func()) {
+	sb.sequence++
+	sb.pending = append(sb.pending, simulatedMessage{sb.clock.Now().Add(delay), sb.sequence, description, deliver})
+}
+
+// Step delivers one message, returning false if there was nothing to deliver.
+// Normally the message due soonest goes next, but the fault profile can have
+// another pending message jump the queue.
+func (sb *SimulatedBus) Step() bool {
+	sb.s.Lock()
+	if len(sb.pending) == 0 {
+		sb.s.Unlock()
+		return false
+	}
+	sort.Slice(sb.pending, func(i, j int) bool {
+		if sb.pending[i].due.Equal(sb.pending[j].due) {
+			return sb.pending[i].seq < sb.pending[j].seq
+		}
+		return sb.pending[i].due.Before(sb.pending[j].due)
+	})
+	next := 0
+	if len(sb.pending) > 1 && sb.faults.chance(sb.faults.profile.ReorderProbability) {
+		next = sb.faults.pick(len(sb.pending))
+	}
+	msg := sb.pending[next]
+	sb.pending = append(sb.pending[:next], sb.pending[next+1:]...)
+	if now := sb.clock.Now(); msg.due.After(now) {
+		sb.clock.Advance(msg.due.Sub(now))
+	}
+	sb.trace = append(sb.trace, sb.clock.Now().Format(time.RFC3339Nano)+" delivered "+msg.description)
+	sb.s.Unlock()
+
+	// delivered without the lock held, handlers publish and dispatch in turn
+	msg.deliver()
+	return true
+}
+
+// RunUntilIdle steps until nothing is pending or maxSteps is reached, and
+// returns the number of messages delivered
+func (sb *SimulatedBus) RunUntilIdle(maxSteps int) int {
+	steps := 0
+	for steps < maxSteps && sb.Step() {
+		steps++
+	}
+	return steps
+}
@@ -0,0 +1,71 @@
+package SimpleCQRS
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// simulateReadModel saves an item's history and has the bus deliver it to
+// the read model, reordered and duplicated as the seed decides
+func simulateReadModel(t *testing.T, seed int64) ([]string, ReadModelFacade) {
+	clock := NewVirtualClock(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	bus := NewSimulatedBus(seed, FaultProfile{MaxEventDelay: 5 * time.Second, ReorderProbability: 0.3, DuplicateProbability: 0.3}, clock)
+	store := NewEventStoreWithClock(bus, clock)
+	db := NewBSDB()
+	rm := newInventoryReadModel(&db)
+	if _, err := bus.SubscribeEvents(EventFilter{}, rm.Process); err != nil {
+		t.Fatal(err)
+	}
+
+	history := []Event{NewInventoryItemCreated("a", "widget")}
+	for count := 1; count <= 5; count++ {
+		history = append(history, NewItemsCheckedInToInventory("a", count))
+	}
+	history = append(history, NewInventoryItemRenamed("a", "gadget"), NewItemsRemovedFromInventory("a", 3))
+	for i, evt := range history {
+		if _, err := store.SaveEvents("a", []Event{evt}, i-1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bus.RunUntilIdle(1000)
+	return bus.Trace(), NewReadModelFacade(&db)
+}
+
+func TestReadModelIsRightWhateverOrderEventsArriveIn(t *testing.T) {
+	var reordered, duplicated bool
+	for seed := int64(1); seed <= 20; seed++ {
+		trace, rmf := simulateReadModel(t, seed)
+		again, _ := simulateReadModel(t, seed)
+		if !reflect.DeepEqual(trace, again) {
+			t.Fatalf("seed %v: two runs delivered differently", seed)
+		}
+
+		details, err := rmf.GetInventoryItemDetails("a")
+		if err != nil {
+			t.Fatalf("seed %v: %v", seed, err)
+		}
+		if details.Name != "gadget" || details.CurrentCount != 12 || details.Version != 7 {
+			t.Fatalf("seed %v: %+v", seed, details)
+		}
+		page, _ := rmf.GetInventoryItems(InventoryItemListOptions{})
+		if len(page.Items) != 1 || page.Items[0].Name != "gadget" || page.Items[0].CurrentCount != 12 {
+			t.Fatalf("seed %v: %+v", seed, page.Items)
+		}
+
+		// the versions in the order they were delivered
+		versions := make([]string, 0, len(trace))
+		for _, line := range trace {
+			fields := strings.Fields(line)
+			versions = append(versions, fields[len(fields)-4])
+		}
+		duplicated = duplicated || len(versions) > 8
+		for i := 1; i < len(versions); i++ {
+			reordered = reordered || versions[i] < versions[i-1]
+		}
+	}
+	if !reordered || !duplicated {
+		t.Fatalf("no seed reordered (%v) or duplicated (%v) events", reordered, duplicated)
+	}
+}
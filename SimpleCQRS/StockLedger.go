@@ -0,0 +1,261 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StockMovementDto is a check in or removal, with the count it left behind
+type StockMovementDto struct {
+	Id       Guid
+	Version  int
+	Position int64
+	Time     time.Time
+	User     string
+	Change   int // positive for a check in, negative for a removal
+	Balance  int
+}
+
+type StockPeriod string
+
+const (
+	Daily  StockPeriod = "day"
+	Weekly StockPeriod = "week" // weeks start on Monday
+)
+
+// StockMovementTotals adds up an item's movements over a day or a week
+type StockMovementTotals struct {
+	Id        Guid
+	Start     time.Time // UTC midnight at the start of the period
+	In        int
+	Out       int
+	Movements int
+}
+
+func (t StockMovementTotals) Net() int {
+	return t.In - t.Out
+}
+
+type StockMoverDto struct {
+	Id        Guid
+	Name      string
+	In        int
+	Out       int
+	Movements int
+}
+
+type IdleItemDto struct {
+	Id           Guid
+	Name         string
+	Balance      int
+	LastMovement time.Time // zero if it has never moved
+	IdleSince    time.Time // the last movement, or when the item was created if it has never moved
+}
+
+func periodStart(t time.Time, period StockPeriod) time.Time {
+	day := time.Date(t.UTC().Year(), t.UTC().Month(), t.UTC().Day(), 0, 0, 0, 0, time.UTC)
+	if period == Weekly {
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	}
+	return day
+}
+
+type ledgerItem struct {
+	name         string
+	active       bool
+	created      time.Time
+	balance      int
+	movements    []StockMovementDto
+	totals       map[StockPeriod]map[time.Time]*StockMovementTotals
+	lastMovement time.Time
+}
+
+// StockLedgerView records every movement of stock and keeps daily and weekly
+// totals of them, as a Projection. Items are tracked from their creation so
+// those that never move can be reported as idle.
+type StockLedgerView struct {
+	items      map[Guid]*ledgerItem
+	projection *DeclaredProjection[*StockLedgerView]
+	s          sync.RWMutex
+}
+
+func NewStockLedgerView() *StockLedgerView {
+	view := &StockLedgerView{items: make(map[Guid]*ledgerItem)}
+	p := NewDeclaredProjection(view, &view.s)
+	ProjectWith(p, func(view *StockLedgerView, evt InventoryItemCreated) error {
+		view.items[evt.Id()] = &ledgerItem{
+			name:    evt.Name(),
+			active:  true,
+			created: evt.Time(),
+			totals:  map[StockPeriod]map[time.Time]*StockMovementTotals{Daily: {}, Weekly: {}},
+		}
+		return nil
+	})
+	ProjectWith(p, func(view *StockLedgerView, evt InventoryItemRenamed) error {
+		return view.update(evt, func(item *ledgerItem) { item.name = evt.NewName() })
+	})
+	ProjectWith(p, func(view *StockLedgerView, evt InventoryItemDeactivated) error {
+		return view.update(evt, func(item *ledgerItem) { item.active = false })
+	})
+	ProjectWith(p, func(view *StockLedgerView, evt ItemsCheckedInToInventory) error {
+		return view.update(evt, func(item *ledgerItem) { view.move(item, evt, evt.Time(), evt.Count()) })
+	})
+	ProjectWith(p, func(view *StockLedgerView, evt ItemsRemovedFromInventory) error {
+		return view.update(evt, func(item *ledgerItem) { view.move(item, evt, evt.Time(), -evt.Count()) })
+	})
+	view.projection = p
+	return view
+}
+
+func (view *StockLedgerView) Process(evt Event) error {
+	return view.projection.Process(evt)
+}
+
+func (view *StockLedgerView) Skip(evt Event) error {
+	return view.projection.Skip(evt)
+}
+
+func (view *StockLedgerView) update(evt AggregateEvent, change func(item *ledgerItem)) error {
+	item, ok := view.items[evt.Id()]
+	if !ok {
+		return fmt.Errorf("no ledger for item %v", evt.Id())
+	}
+	change(item)
+	return nil
+}
+
+func (view *StockLedgerView) move(item *ledgerItem, evt Event, at time.Time, change int) {
+	item.balance += change
+	movement := StockMovementDto{Version: evt.Version(), Time: at, Change: change, Balance: item.balance}
+	movement.Id = evt.(AggregateEvent).Id()
+	if pe, ok := evt.(PositionedEvent); ok {
+		movement.Position = pe.Position()
+	}
+	if ue, ok := evt.(AttributedEvent); ok {
+		movement.User = ue.User()
+	}
+	item.movements = append(item.movements, movement)
+	item.lastMovement = at
+
+	for period, totals := range item.totals {
+		start := periodStart(at, period)
+		t, ok := totals[start]
+		if !ok {
+			t = &StockMovementTotals{Id: movement.Id, Start: start}
+			totals[start] = t
+		}
+		if change > 0 {
+			t.In += change
+		} else {
+			t.Out -= change
+		}
+		t.Movements++
+	}
+}
+
+func (view *StockLedgerView) GetStockMovements(id Guid) ([]StockMovementDto, error) {
+	view.s.RLock()
+	defer view.s.RUnlock()
+
+	item, ok := view.items[id]
+	if !ok {
+		return nil, fmt.Errorf("no ledger for item %v", id)
+	}
+	tmp := make([]StockMovementDto, len(item.movements))
+	copy(tmp, item.movements)
+	return tmp, nil
+}
+
+// GetStockTotals lists the periods between from and to the item moved in, oldest first
+func (view *StockLedgerView) GetStockTotals(id Guid, period StockPeriod, from, to time.Time) ([]StockMovementTotals, error) {
+	view.s.RLock()
+	defer view.s.RUnlock()
+
+	item, ok := view.items[id]
+	if !ok {
+		return nil, fmt.Errorf("no ledger for item %v", id)
+	}
+	totals, ok := item.totals[period]
+	if !ok {
+		return nil, fmt.Errorf("no %q totals, only %q and %q", period, Daily, Weekly)
+	}
+	result := make([]StockMovementTotals, 0)
+	for start, t := range totals {
+		if !start.Before(periodStart(from, period)) && start.Before(to) {
+			result = append(result, *t)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result, nil
+}
+
+// GetTopMovers ranks active items by how much stock moved in and out between from and to
+func (view *StockLedgerView) GetTopMovers(from, to time.Time, limit int) []StockMoverDto {
+	view.s.RLock()
+	defer view.s.RUnlock()
+
+	movers := make([]StockMoverDto, 0)
+	for id, item := range view.items {
+		if !item.active {
+			continue
+		}
+		mover := StockMoverDto{Id: id, Name: item.name}
+		for start, t := range item.totals[Daily] {
+			if !start.Before(periodStart(from, Daily)) && start.Before(to) {
+				mover.In += t.In
+				mover.Out += t.Out
+				mover.Movements += t.Movements
+			}
+		}
+		if mover.Movements > 0 {
+			movers = append(movers, mover)
+		}
+	}
+	sort.Slice(movers, func(i, j int) bool {
+		if a, b := movers[i].In+movers[i].Out, movers[j].In+movers[j].Out; a != b {
+			return a > b
+		}
+		return movers[i].Id < movers[j].Id
+	})
+	if limit > 0 && len(movers) > limit {
+		movers = movers[:limit]
+	}
+	return movers
+}
+
+// GetIdleItems lists active items that have not moved since, longest idle first
+func (view *StockLedgerView) GetIdleItems(since time.Time) []IdleItemDto {
+	view.s.RLock()
+	defer view.s.RUnlock()
+
+	idle := make([]IdleItemDto, 0)
+	for id, item := range view.items {
+		last := item.lastMovement
+		if last.IsZero() {
+			last = item.created
+		}
+		if item.active && last.Before(since) {
+			idle = append(idle, IdleItemDto{id, item.name, item.balance, item.lastMovement, last})
+		}
+	}
+	sort.Slice(idle, func(i, j int) bool {
+		if !idle[i].IdleSince.Equal(idle[j].IdleSince) {
+			return idle[i].IdleSince.Before(idle[j].IdleSince)
+		}
+		return idle[i].Id < idle[j].Id
+	})
+	return idle
+}
+
+func (view *StockLedgerView) WaitFor(ctx context.Context, token ConsistencyToken) error {
+	return view.projection.WaitFor(ctx, token)
+}
+
+// NewStockLedger is the stock ledger readers see, as the StockLedger
+// projection
+func NewStockLedger() *Swappable[*StockLedgerView] {
+	return NewSwappable("StockLedger", NewStockLedgerView)
+}
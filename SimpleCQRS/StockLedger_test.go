@@ -0,0 +1,53 @@
+package SimpleCQRS
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStockLedgerTotalsMovementsByDayAndWeek(t *testing.T) {
+	friday := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewVirtualClock(friday)
+	store := NewEventStoreWithClock(discardEvents{}, clock)
+	ledger := NewStockLedger()
+	runner := NewProjectionRunner(store, NewInMemoryCheckpointStore())
+	if err := runner.Add(ledger.Definition()); err != nil {
+		t.Fatal(err)
+	}
+
+	store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "bolts"), NewItemsCheckedInToInventory("a", 10)}, -1)
+	store.SaveEvents("b", []Event{NewInventoryItemCreated("b", "nuts")}, -1)
+	store.SaveEvents("c", []Event{NewInventoryItemCreated("c", "washers"), NewItemsCheckedInToInventory("c", 50), NewInventoryItemDeactivated("c")}, -1)
+	clock.Advance(24 * time.Hour)
+	store.SaveEvents("a", []Event{NewItemsRemovedFromInventory("a", 3)}, 1)
+	clock.Advance(3 * 24 * time.Hour)
+	store.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", 2)}, 2)
+	runner.CatchUp(nil)
+	view := ledger.Load()
+	tuesday := clock.Now()
+
+	movements, err := view.GetStockMovements("a")
+	if err != nil || len(movements) != 3 || movements[1].Change != -3 || movements[2].Balance != 9 {
+		t.Fatalf("%+v %v", movements, err)
+	}
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	daily, _ := view.GetStockTotals("a", Daily, friday, tuesday)
+	if len(daily) != 3 || daily[0].Start != day(1) || daily[0].In != 10 || daily[1].Out != 3 || daily[2].Start != day(5) || daily[2].Net() != 2 {
+		t.Fatalf("%+v", daily)
+	}
+	weekly, _ := view.GetStockTotals("a", Weekly, friday, tuesday)
+	if len(weekly) != 2 || weekly[0].Start != day(1).AddDate(0, 0, -4) || weekly[0].Net() != 7 || weekly[0].Movements != 2 || weekly[1].Start != day(4) {
+		t.Fatalf("%+v", weekly)
+	}
+	if _, err := view.GetStockTotals("a", "month", friday, tuesday); err == nil {
+		t.Fatal("totals by month")
+	}
+
+	// deactivated items neither move nor idle
+	if movers := view.GetTopMovers(friday, tuesday, 10); len(movers) != 1 || movers[0].Id != "a" || movers[0].In != 12 || movers[0].Out != 3 {
+		t.Fatalf("%+v", movers)
+	}
+	if idle := view.GetIdleItems(day(4)); len(idle) != 1 || idle[0].Id != "b" || !idle[0].IdleSince.Equal(friday) || !idle[0].LastMovement.IsZero() {
+		t.Fatalf("%+v", idle)
+	}
+}
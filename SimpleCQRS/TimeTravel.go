@@ -0,0 +1,171 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrBeyondHead = errors.New("the event store has not got that far")
+
+// PointInTime is a position in the event store or a moment, the zero value is now
+type PointInTime struct {
+	Position int64
+	Time     time.Time
+}
+
+func (p PointInTime) IsZero() bool {
+	return p.Position == 0 && p.Time.IsZero()
+}
+
+// String is the point in a form ParsePointInTime reads back
+func (p PointInTime) String() string {
+	switch {
+	case p.Position > 0:
+		return strconv.FormatInt(p.Position, 10)
+	case !p.Time.IsZero():
+		return p.Time.Format(time.RFC3339)
+	}
+	return ""
+}
+
+// ParsePointInTime reads a position, an RFC 3339 time, or a date which
+// means the end of that day in UTC
+func ParsePointInTime(s string) (PointInTime, error) {
+	if s == "" {
+		return PointInTime{}, nil
+	}
+	if position, err := strconv.ParseInt(s, 10, 64); err == nil && position > 0 {
+		return PointInTime{Position: position}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return PointInTime{Time: t}, nil
+	}
+	if day, err := time.Parse("2006-01-02", s); err == nil {
+		return PointInTime{Time: day.AddDate(0, 0, 1).Add(-time.Nanosecond)}, nil
+	}
+	return PointInTime{}, fmt.Errorf("%q is not a position, a time or a date", s)
+}
+
+// TimeTravel builds the read model as it was at a point in the past, by
+// replaying the event store into a BSDB of its own. The most recently asked
+// for points are kept.
+type TimeTravel struct {
+	BatchSize int
+
+	store    EventStore
+	capacity int
+	models   map[int64]ReadModel // by the position they were built to
+	order    []int64             // least recently used first
+	s        sync.Mutex
+}
+
+func NewTimeTravel(store EventStore, capacity int) *TimeTravel {
+	return &TimeTravel{
+		BatchSize: 500,
+		store:     store,
+		capacity:  capacity,
+		models:    make(map[int64]ReadModel),
+		order:     make([]int64, 0),
+	}
+}
+
+// At returns the read model as it was at p, or as it is now if p is zero
+func (tt *TimeTravel) At(p PointInTime) (ReadModel, error) {
+	position, err := tt.resolve(p)
+	if err != nil {
+		return nil, err
+	}
+	if rm, ok := tt.cached(position); ok {
+		return rm, nil
+	}
+
+	model := NewInventoryReadModel()
+	var at int64
+	for at < position {
+		max := tt.BatchSize
+		if left := position - at; left < int64(max) {
+			max = int(left)
+		}
+		events, err := tt.store.ReadAll(at, max)
+		if err != nil {
+			return nil, err
+		}
+		for _, evt := range events {
+			if err := model.Process(evt); err != nil {
+				return nil, fmt.Errorf("replaying position %v: %v", at+1, err)
+			}
+			at++
+		}
+	}
+	rm := NewReadModelFacade(model.DB())
+	tt.remember(position, &rm)
+	return &rm, nil
+}
+
+// resolve turns p into the position of the last event saved at or before it
+func (tt *TimeTravel) resolve(p PointInTime) (int64, error) {
+	head := tt.store.Head()
+	if p.Time.IsZero() {
+		if p.Position > head {
+			return 0, fmt.Errorf("%w: position %v is after the last event, %v", ErrBeyondHead, p.Position, head)
+		}
+		if p.Position == 0 {
+			return head, nil
+		}
+		return p.Position, nil
+	}
+	// events are saved in time order, so the first one after p can be searched for
+	var err error
+	after := sort.Search(int(head), func(i int) bool {
+		var events []Event
+		if err == nil {
+			events, err = tt.store.ReadAll(int64(i), 1)
+		}
+		if err != nil || len(events) == 0 {
+			return true
+		}
+		te, ok := events[0].(TimedEvent)
+		return ok && te.Time().After(p.Time)
+	})
+	return int64(after), err
+}
+
+func (tt *TimeTravel) cached(position int64) (ReadModel, bool) {
+	tt.s.Lock()
+	defer tt.s.Unlock()
+
+	rm, ok := tt.models[position]
+	if ok {
+		tt.touch(position)
+	}
+	return rm, ok
+}
+
+func (tt *TimeTravel) remember(position int64, rm ReadModel) {
+	tt.s.Lock()
+	defer tt.s.Unlock()
+
+	if _, ok := tt.models[position]; !ok {
+		tt.order = append(tt.order, position)
+	}
+	tt.models[position] = rm
+	tt.touch(position)
+	for len(tt.order) > tt.capacity {
+		delete(tt.models, tt.order[0])
+		tt.order = tt.order[1:]
+	}
+}
+
+// touch moves position to the most recently used end
+func (tt *TimeTravel) touch(position int64) {
+	for i, p := range tt.order {
+		if p == position {
+			tt.order = append(append(tt.order[:i:i], tt.order[i+1:]...), position)
+			return
+		}
+	}
+}
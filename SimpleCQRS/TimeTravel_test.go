@@ -0,0 +1,70 @@
+package SimpleCQRS
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTimeTravelBuildsTheReadModelAsItWas(t *testing.T) {
+	nine := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	clock := NewVirtualClock(nine)
+	store := NewEventStoreWithClock(discardEvents{}, clock)
+	store.SaveEvents("a", []Event{NewInventoryItemCreated("a", "bolts")}, -1)
+	clock.Advance(time.Hour)
+	store.SaveEvents("a", []Event{NewInventoryItemRenamed("a", "nuts")}, 0)
+	clock.Advance(time.Hour)
+	store.SaveEvents("a", []Event{NewItemsCheckedInToInventory("a", 5)}, 1)
+	past := NewTimeTravel(store, 2)
+
+	item := func(p PointInTime) InventoryItemDetailsDto {
+		rm, err := past.At(p)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		dto, err := rm.GetInventoryItemDetails("a")
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		return dto
+	}
+	if first := item(PointInTime{Position: 1}); first.Name != "bolts" || first.Version != 0 {
+		t.Fatalf("%+v", first)
+	}
+	if halfPastTen := item(PointInTime{Time: nine.Add(90 * time.Minute)}); halfPastTen.Name != "nuts" || halfPastTen.CurrentCount != 0 {
+		t.Fatalf("%+v", halfPastTen)
+	}
+	if now := item(PointInTime{}); now.CurrentCount != 5 {
+		t.Fatalf("%+v", now)
+	}
+
+	before, _ := past.At(PointInTime{Time: nine.Add(-time.Minute)})
+	if _, err := before.GetInventoryItemDetails("a"); err == nil {
+		t.Fatal("the item before it was created")
+	}
+	if _, err := past.At(PointInTime{Position: 4}); !errors.Is(err, ErrBeyondHead) {
+		t.Fatal(err)
+	}
+	// the same point is built once
+	again, _ := past.At(PointInTime{Position: 1})
+	if once, _ := past.At(PointInTime{Time: nine.Add(time.Minute)}); once != again {
+		t.Fatal("built twice")
+	}
+}
+
+func TestParsePointInTime(t *testing.T) {
+	cases := map[string]PointInTime{
+		"":                     {},
+		"12":                   {Position: 12},
+		"2024-03-01T09:30:00Z": {Time: time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)},
+		"2024-03-01":           {Time: time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)},
+	}
+	for s, want := range cases {
+		if p, err := ParsePointInTime(s); err != nil || !p.Time.Equal(want.Time) || p.Position != want.Position {
+			t.Errorf("ParsePointInTime(%q) = %+v, %v, want %+v", s, p, err, want)
+		}
+	}
+	if _, err := ParsePointInTime("yesterday"); err == nil {
+		t.Error("parsed yesterday")
+	}
+}
@@ -0,0 +1,44 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// typeOf returns the reflect.Type used as the registration key for T
+func typeOf[T any]() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// RegisterCommandHandler wires a handler for commands of type C, e.g.
+//
+//	RegisterCommandHandler(bus, commands.HandleCreateInventoryItem)
+//
+// The command type is taken from the handler's signature, so a handler can
+// never be registered against the wrong command type.
+func RegisterCommandHandler[C Command](r CommandHandlerRegistry, handler func(ctx context.Context, cmd C) (Commit, error)) error {
+	return r.SetCommandHandler(typeOf[C](), func(ctx context.Context, cmd Command) (Commit, error) {
+		c, ok := cmd.(C)
+		if !ok {
+			return Commit{}, fmt.Errorf("handler for %v passed %T", typeOf[C](), cmd)
+		}
+		return handler(ctx, c)
+	})
+}
+
+// RegisterEventProcessor wires a processor for events of type E, e.g.
+//
+//	RegisterEventProcessor(bus, func(evt InventoryItemDeactivated) error {
+//		fmt.Println("Deactivated", evt.Id(), "by", evt.User())
+//		return nil
+//	})
+func RegisterEventProcessor[E Event](r EventProcessorRegistry, processor func(evt E) error) error {
+	return r.AddEventProcessor(typeOf[E](), func(evt Event) error {
+		e, ok := evt.(E)
+		if !ok {
+			return fmt.Errorf("processor for %v passed %T", typeOf[E](), evt)
+		}
+		return processor(e)
+	})
+}
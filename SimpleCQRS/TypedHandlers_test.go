@@ -0,0 +1,59 @@
+package SimpleCQRS
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+// handlerRegistry keeps what was registered with it
+type handlerRegistry struct {
+	commands map[reflect.Type]CommandHandler
+	events   map[reflect.Type]EventProcessor
+}
+
+func (r *handlerRegistry) SetCommandHandler(cmdType reflect.Type, handler CommandHandler) error {
+	r.commands[cmdType] = handler
+	return nil
+}
+
+func (r *handlerRegistry) AddEventProcessor(eventType reflect.Type, processor EventProcessor) error {
+	r.events[eventType] = processor
+	return nil
+}
+
+func TestHandlersAreRegisteredForTheTypeInTheirSignature(t *testing.T) {
+	r := &handlerRegistry{make(map[reflect.Type]CommandHandler), make(map[reflect.Type]EventProcessor)}
+	var checkedIn CheckInItemsToInventory
+	RegisterCommandHandler(r, func(ctx context.Context, cmd CheckInItemsToInventory) (Commit, error) {
+		checkedIn = cmd
+		return Commit{}, nil
+	})
+	var renamed InventoryItemRenamed
+	RegisterEventProcessor(r, func(evt InventoryItemRenamed) error {
+		renamed = evt
+		return nil
+	})
+
+	handler, ok := r.commands[reflect.TypeOf(CheckInItemsToInventory{})]
+	if !ok || len(r.commands) != 1 {
+		t.Fatal(r.commands)
+	}
+	if _, err := handler(context.Background(), CheckInItemsToInventory{InventoryItemId: "a", Count: 3}); err != nil || checkedIn.Count != 3 {
+		t.Fatal(checkedIn, err)
+	}
+	if _, err := handler(context.Background(), RemoveItemsFromInventory{}); err == nil {
+		t.Fatal("handled a command of the wrong type")
+	}
+
+	processor, ok := r.events[reflect.TypeOf(InventoryItemRenamed{})]
+	if !ok || len(r.events) != 1 {
+		t.Fatal(r.events)
+	}
+	if err := processor(NewInventoryItemRenamed("a", "bolts")); err != nil || renamed.NewName() != "bolts" {
+		t.Fatal(renamed, err)
+	}
+	if err := processor(NewInventoryItemDeactivated("a")); err == nil {
+		t.Fatal("processed an event of the wrong type")
+	}
+}
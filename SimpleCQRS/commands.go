@@ -2,29 +2,164 @@ package SimpleCQRS
 
 type Command interface{}
 
+// IdempotentCommand is implemented by commands that can carry an idempotency
+// key, a command with an empty key is never deduplicated
+type IdempotentCommand interface {
+	IdempotencyKey() string
+	// WithIdempotencyKey returns a copy of the command carrying key
+	WithIdempotencyKey(key string) Command
+}
+
+// Idempotent is embedded in commands to give them an optional idempotency key
+type Idempotent struct {
+	Key string
+}
+
+func (i Idempotent) IdempotencyKey() string {
+	return i.Key
+}
+
+// AttributedCommand is implemented by commands that say who sent them
+type AttributedCommand interface {
+	IssuedBy() string
+}
+
+// Issued is embedded in commands to record who sent them, the events they
+// cause are stamped with the same user
+type Issued struct {
+	User string
+}
+
+func (i Issued) IssuedBy() string {
+	return i.User
+}
+
+// VersionedCommand is implemented by commands that change an existing
+// aggregate at the version they were issued against
+type VersionedCommand interface {
+	AggregateId() Guid
+	// AtVersion returns a copy of the command issued against version
+	AtVersion(version int) Command
+}
+
 type DeactivateInventoryItem struct {
+	Idempotent
+	Issued
 	InventoryItemId Guid
 	OriginalVersion int
 }
 
+func (c DeactivateInventoryItem) WithIdempotencyKey(key string) Command {
+	c.Key = key
+	return c
+}
+
+func (c DeactivateInventoryItem) AggregateId() Guid {
+	return c.InventoryItemId
+}
+
+func (c DeactivateInventoryItem) AtVersion(version int) Command {
+	c.OriginalVersion = version
+	return c
+}
+
 type CreateInventoryItem struct {
+	Idempotent
+	Issued
 	InventoryItemId Guid
 	Name            string
 }
 
+func (c CreateInventoryItem) WithIdempotencyKey(key string) Command {
+	c.Key = key
+	return c
+}
+
 type RenameInventoryItem struct {
+	Idempotent
+	Issued
 	InventoryItemId Guid
 	OriginalVersion int
 	NewName         string
 }
+
+func (c RenameInventoryItem) WithIdempotencyKey(key string) Command {
+	c.Key = key
+	return c
+}
+
+func (c RenameInventoryItem) AggregateId() Guid {
+	return c.InventoryItemId
+}
+
+func (c RenameInventoryItem) AtVersion(version int) Command {
+	c.OriginalVersion = version
+	return c
+}
+
 type CheckInItemsToInventory struct {
+	Idempotent
+	Issued
 	InventoryItemId Guid
 	OriginalVersion int
 	Count           int
 }
 
+func (c CheckInItemsToInventory) WithIdempotencyKey(key string) Command {
+	c.Key = key
+	return c
+}
+
+func (c CheckInItemsToInventory) AggregateId() Guid {
+	return c.InventoryItemId
+}
+
+func (c CheckInItemsToInventory) AtVersion(version int) Command {
+	c.OriginalVersion = version
+	return c
+}
+
 type RemoveItemsFromInventory struct {
+	Idempotent
+	Issued
 	InventoryItemId Guid
 	OriginalVersion int
 	Count           int
 }
+
+func (c RemoveItemsFromInventory) WithIdempotencyKey(key string) Command {
+	c.Key = key
+	return c
+}
+
+func (c RemoveItemsFromInventory) AggregateId() Guid {
+	return c.InventoryItemId
+}
+
+func (c RemoveItemsFromInventory) AtVersion(version int) Command {
+	c.OriginalVersion = version
+	return c
+}
+
+// SetReorderPoint sets the count below which the item is low on stock, 0 clears it
+type SetReorderPoint struct {
+	Idempotent
+	Issued
+	InventoryItemId Guid
+	OriginalVersion int
+	ReorderPoint    int
+}
+
+func (c SetReorderPoint) WithIdempotencyKey(key string) Command {
+	c.Key = key
+	return c
+}
+
+func (c SetReorderPoint) AggregateId() Guid {
+	return c.InventoryItemId
+}
+
+func (c SetReorderPoint) AtVersion(version int) Command {
+	c.OriginalVersion = version
+	return c
+}
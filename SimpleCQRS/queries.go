@@ -0,0 +1,105 @@
+package SimpleCQRS
+
+import "time"
+
+type Query interface{}
+
+// QueryFor is embedded in a query to declare the type of its result
+type QueryFor[R any] struct{}
+
+func (QueryFor[R]) queryResult(R) {}
+
+type TypedQuery[R any] interface {
+	queryResult(R)
+}
+
+// VersionedQuery is implemented by queries that need the projection to have
+// caught up to at least a given version before they are answered
+type VersionedQuery interface {
+	MinimumVersion() int
+}
+
+// VersionedResult is implemented by query results that know which version
+// of the projection produced them
+type VersionedResult interface {
+	ProjectionVersion() int
+}
+
+type GetInventoryItems struct {
+	QueryFor[InventoryItemPage]
+	InventoryItemListOptions
+	After ConsistencyToken // if set, answered once the list reflects this write
+	AsOf  PointInTime      // if set, the list as it was then
+}
+
+// SearchInventoryItems finds active items by name, best matches first
+type SearchInventoryItems struct {
+	QueryFor[[]InventorySearchResult]
+	Text  string
+	Limit int // every match if 0
+	After ConsistencyToken
+}
+
+// GetInventoryItemHistory lists every event of an item, oldest first
+type GetInventoryItemHistory struct {
+	QueryFor[[]InventoryItemHistoryEntry]
+	Id    Guid
+	After ConsistencyToken
+}
+
+type GetStockMovements struct {
+	QueryFor[[]StockMovementDto]
+	Id    Guid
+	After ConsistencyToken
+}
+
+// GetStockTotals adds up an item's movements per day or week, the zero
+// times mean from the start and up to now
+type GetStockTotals struct {
+	QueryFor[[]StockMovementTotals]
+	Id     Guid
+	Period StockPeriod
+	From   time.Time
+	To     time.Time
+}
+
+// GetTopMovers ranks items by movement over the last Days days
+type GetTopMovers struct {
+	QueryFor[[]StockMoverDto]
+	Days  int
+	Limit int
+}
+
+// GetIdleItems lists items that have not moved in Days days
+type GetIdleItems struct {
+	QueryFor[[]IdleItemDto]
+	Days int
+}
+
+// GetLowStockItems lists the items below their reorder points
+type GetLowStockItems struct {
+	QueryFor[[]LowStockItemDto]
+	After ConsistencyToken
+}
+
+// GetLowStockAlerts lists the alerts raised, newest first
+type GetLowStockAlerts struct {
+	QueryFor[[]LowStockAlert]
+	Limit int // every alert if 0
+	After ConsistencyToken
+}
+
+type GetInventoryItemDetails struct {
+	QueryFor[InventoryItemDetailsDto]
+	Id         Guid
+	MinVersion int
+	AsOf       PointInTime // if set, the item as it was then
+}
+
+// MinimumVersion is 0 for a query about the past, which has nothing to wait for
+func (q GetInventoryItemDetails) MinimumVersion() int {
+	if !q.AsOf.IsZero() {
+		return 0
+	}
+	return q.MinVersion
+}
@@ -1,6 +1,7 @@
 module SimpleCQRS
 
-require (
-	github.com/gorilla/mux v1.6.2 // indirect
-	github.com/julienschmidt/httprouter v1.2.0 // indirect
-)
+go 1.21
+
+require github.com/gorilla/mux v1.6.2
+
+require github.com/gorilla/context v1.1.2 // indirect